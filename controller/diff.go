@@ -0,0 +1,150 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/ftarlao/goblocksync/controller/routines"
+	"github.com/ftarlao/goblocksync/data/configuration"
+	"github.com/ftarlao/goblocksync/data/messages"
+	"github.com/ftarlao/goblocksync/utils"
+	"io"
+	"os"
+)
+
+// Dry run (block mode), hashes are exchanged and compared as in a sync but the destination is not written. The source
+// collects the differing blocks in extents; when the master is the destination the source sends the extents as
+// ExtentMessages before the EndMessage. The master prints the report, a destination longer than the source is reported
+// with its tail.
+
+// Differing region [Start, Start+Length)
+type Extent struct {
+	Start  int64
+	Length int64
+}
+
+type DiffReport struct {
+	SourceFile      string
+	DestinationFile string
+	BlockSize       int64
+	HashAlgorithm   string
+	// Differing regions, adjacent regions are merged
+	Extents         []Extent
+	DifferingBlocks int64
+	DifferingBytes  int64
+	// Sizes of the files [bytes], the destination bytes beyond the source size are the tail (not in the extents)
+	SourceSize      int64
+	DestinationSize int64
+	DestinationTail int64
+}
+
+func NewDiffReport(config configuration.Configuration) *DiffReport {
+	return &DiffReport{
+		SourceFile:      config.SourceFile.FileName,
+		DestinationFile: config.DestinationFile.FileName,
+		BlockSize:       config.BlockSize,
+		HashAlgorithm:   config.HashAlgorithm,
+		Extents:         []Extent{},
+		SourceSize:      config.SourceFile.Size,
+		DestinationSize: config.DestinationFile.Size,
+		DestinationTail: utils.IntMax(config.DestinationFile.Size-config.SourceFile.Size, 0)}
+}
+
+// Adds a differing region, regions should be provided in location order
+func (r *DiffReport) Add(start int64, length int64) {
+	r.DifferingBlocks += (length + r.BlockSize - 1) / r.BlockSize
+	r.DifferingBytes += length
+	if last := len(r.Extents) - 1; last >= 0 && r.Extents[last].Start+r.Extents[last].Length == start {
+		r.Extents[last].Length += length
+		return
+	}
+	r.Extents = append(r.Extents, Extent{start, length})
+}
+
+// Writes the report as text or JSON (configuration.ReportText, configuration.ReportJSON)
+func (r *DiffReport) Write(w io.Writer, format string) error {
+	if format == configuration.ReportJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(r)
+	}
+	var b bytes.Buffer
+	fmt.Fprintln(&b, "Source file:\t\t", r.SourceFile)
+	fmt.Fprintln(&b, "Destination file:\t", r.DestinationFile)
+	fmt.Fprintln(&b, "Differing extents (start-end, bytes):")
+	for _, e := range r.Extents {
+		fmt.Fprintf(&b, "%d-%d\t%d\n", e.Start, e.Start+e.Length, e.Length)
+	}
+	fmt.Fprintln(&b, "Extents:\t\t", len(r.Extents))
+	fmt.Fprintln(&b, "Differing blocks:\t", r.DifferingBlocks)
+	fmt.Fprintln(&b, "Differing bytes:\t", r.DifferingBytes)
+	fmt.Fprintln(&b, "Destination tail:\t", r.DestinationTail, "bytes beyond the source size")
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// Dry run of the destination, the file is only hashed
+func (d *destinationV1) diff() error {
+	var f io.ReadSeeker
+	file, err := os.Open(d.Config.DestinationFile.FileName)
+	if err == nil {
+		defer file.Close()
+		f = file
+		err = d.Config.DestinationFile.UpdateFile(file)
+		if err != nil {
+			return err
+		}
+	} else if os.IsNotExist(err) {
+		//all the source blocks differ
+		f = bytes.NewReader(nil)
+	} else {
+		return err
+	}
+
+	algorithm, err := hashAlgorithm(d.Config)
+	if err != nil {
+		return err
+	}
+	hasher := routines.NewHasherImplAlgorithm(d.Config.BlockSize, f, d.Config.StartLoc, algorithm, d.Config.HashWorkers)
+	err = hasher.Start()
+	if err != nil {
+		return err
+	}
+	defer hasher.Stop()
+	d.progress.SetHasher(hasher, d.Config.StartLoc)
+
+	sender := startSender(func(done chan bool) error {
+		return forwardToSource(d.netManager, hasher.GetOutMsgChannel(), nil, done)
+	})
+	defer sender.stop()
+
+	report := NewDiffReport(d.Config)
+	inChan := d.netManager.GetInMsgChannel()
+	for {
+		select {
+		case err = <-sender.err:
+			return err
+		case msg, ok := <-inChan:
+			if !ok {
+				return closedError(d.netManager, "connection closed by the source before the end of the dry run")
+			}
+			switch msg.GetMessageID() {
+			case messages.ExtentMessageID:
+				extent := msg.(*messages.ExtentMessage)
+				report.Add(extent.StartLoc, extent.Length)
+			case messages.EndMessageID:
+				if d.Config.IsMaster {
+					err = report.Write(os.Stdout, d.Config.ReportFormat)
+					if err != nil {
+						return err
+					}
+				}
+				return d.netManager.Send(msg)
+			case messages.ErrorMessageID:
+				return d.netManager.MessageError(msg.(*messages.ErrorMessage))
+			default:
+				return fmt.Errorf("unexpected message type %d received by the destination", msg.GetMessageID())
+			}
+		}
+	}
+}
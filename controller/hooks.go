@@ -0,0 +1,59 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ftarlao/goblocksync/data/configuration"
+	"github.com/ftarlao/goblocksync/utils"
+	"log/slog"
+	"os"
+	"os/exec"
+)
+
+// Sync hooks. The master runs the pre hook before the session and the post hook after it. A hook is a command in the
+// remote shell syntax (utils.SplitCommandLine, no shell) run with the environment of the master plus
+// GOBLOCKSYNC_SESSION, GOBLOCKSYNC_SOURCE and GOBLOCKSYNC_DESTINATION ([host:]path, as provided). A failing pre hook
+// (non-zero exit) fails the sync before the slave is started. The post hook runs once the pre hook succeeded, also
+// after a failed sync, with GOBLOCKSYNC_STATUS set to "ok" or "failed"; its failure fails a successful sync. The
+// output of the hooks goes to stderr, stdout has the summaries and reports only.
+
+const (
+	hookStatusOK     = "ok"
+	hookStatusFailed = "failed"
+)
+
+// Runs the hook named name, nothing when command is empty. Status is the outcome of the sync, empty before the sync
+func runHook(config configuration.Configuration, logger *slog.Logger, name string, command string, status string) error {
+	if command == "" {
+		return nil
+	}
+	args, err := utils.SplitCommandLine(command)
+	if err == nil && len(args) == 0 {
+		err = errors.New("empty command")
+	}
+	if err != nil {
+		return fmt.Errorf("%s hook: %w", name, err)
+	}
+	source, destination := config.SourceFile.FileName, config.DestinationFile.FileName
+	if config.RemoteHost != "" {
+		if config.IsSource {
+			destination = config.RemoteHost + ":" + destination
+		} else {
+			source = config.RemoteHost + ":" + source
+		}
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), "GOBLOCKSYNC_SESSION="+config.SessionID, "GOBLOCKSYNC_SOURCE="+source,
+		"GOBLOCKSYNC_DESTINATION="+destination)
+	if status != "" {
+		cmd.Env = append(cmd.Env, "GOBLOCKSYNC_STATUS="+status)
+	}
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	logger.Debug("Running hook", offsetAttr(config.StartLoc), "hook", name, "command", command)
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("%s hook failed: %w", name, err)
+	}
+	return nil
+}
@@ -1,16 +1,23 @@
 package controller
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
-
+	"fmt"
 	"github.com/ftarlao/goblocksync/controller/routines"
 	"github.com/ftarlao/goblocksync/data/configuration"
 	"github.com/ftarlao/goblocksync/data/messages"
 	"github.com/ftarlao/goblocksync/utils"
+	"github.com/ftarlao/goblocksync/utils/compression"
+	"github.com/ftarlao/goblocksync/utils/hashing"
 	"io"
-	"log"
+	"log/slog"
+	"net"
 	"os"
 	"os/exec"
+	"sync"
+	"time"
 )
 
 //Interface for Master and Slave both
@@ -24,59 +31,226 @@ type Initiator interface {
 
 type master struct {
 	Config configuration.Configuration
+	// running session, for the changes at runtime
+	session *masterSession
+	logger  *slog.Logger
+	// connections shared with other sessions, nil when the session has its own slave
+	pool *SlavePool
+}
+
+type masterSession struct {
+	lock       sync.Mutex
+	netManager *routines.NetworkManager
+	// sync offset, the start location till the session completes
+	offset int64
 }
 
+// The session ID is generated here when empty, the records of the caller share it (Logger)
 func NewMaster(conf configuration.Configuration) master {
-	return master{conf}
+	if conf.SessionID == "" {
+		conf.SessionID = newSessionID()
+	}
+	return master{conf, &masterSession{offset: conf.StartLoc}, nil, nil}
 }
 
 func (m master) GetConfig() configuration.Configuration {
 	return m.Config
 }
 
+// Logger of the records of the caller about the session, with the session ID, the role and the current sync offset
+func (m master) Logger() *slog.Logger {
+	m.session.lock.Lock()
+	defer m.session.lock.Unlock()
+	return sessionLogger(m.Config).With(offsetAttr(m.session.offset))
+}
+
 func (m master) Start() (err error) {
+	m.logger = sessionLogger(m.Config)
+	//the hooks see the locations as provided, the session completes them with the slave details
+	provided := m.Config
+	err = runHook(provided, m.logger, "pre", provided.PreHook, "")
+	if err == nil {
+		err = m.start()
+		status := hookStatusOK
+		if err != nil {
+			status = hookStatusFailed
+		}
+		if hookErr := runHook(provided, m.logger, "post", provided.PostHook, status); err == nil {
+			err = hookErr
+		}
+	}
+	if errors.Is(err, ErrFilesDiffer) {
+		m.completed()
+		m.logger.Info("Session completed, files differ", offsetAttr(m.Config.SourceFile.Size))
+		return err
+	}
+	if err != nil {
+		m.logger.Error("Session failed", offsetAttr(m.Config.StartLoc), "error", err)
+		return err
+	}
+	m.completed()
+	m.logger.Info("Session completed", offsetAttr(m.Config.SourceFile.Size))
+	return nil
+}
 
-	//TODO to understand golang logging and change/remove prints with 'professional' stuff
-	// execute slave locally and connect slave with encoder/decoder
-	in, out, err := execSlave()
-	//defer cmd.Process.Kill()
+// Moves the sync offset to the end of the source
+func (m master) completed() {
+	m.session.lock.Lock()
+	m.session.offset = m.Config.SourceFile.Size
+	m.session.lock.Unlock()
+}
+
+func (m *master) start() (err error) {
+	// execute slave, locally or on the remote host, or connect to the slave daemon
+	slaveName := "local"
+	if m.Config.ConnectAddress != "" {
+		slaveName = m.Config.ConnectAddress
+	} else if m.Config.RemoteHost != "" {
+		slaveName = m.Config.RemoteHost
+	}
+	m.logger.Info("Session started", offsetAttr(m.Config.StartLoc), "slave", slaveName)
+	conn, err := m.connect()
 	if err != nil {
 		return err
 	}
 
-	// perform Handshake
-	bestProtocol, err := handshake(in, out)
+	m.session.lock.Lock()
+	m.session.netManager = conn.netManager
+	m.session.lock.Unlock()
+
+	err = m.run(conn)
+	//no runtime change after the stop
+	m.session.lock.Lock()
+	m.session.netManager = nil
+	m.session.lock.Unlock()
+	//the connection of a completed session carries the next sessions of the pool
+	if m.pool != nil && err == nil {
+		err = m.pool.release(conn)
+	} else if closeErr := conn.close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
 		return err
 	}
-	log.Println("Best selected protocol: ", *bestProtocol)
+	//the sync is complete, nothing to resume
+	if m.Config.JournalFile != "" {
+		err = os.Remove(m.Config.JournalFile)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	return err
+}
+
+// Changes the bandwidth limit of the running session, on both the peers
+func (m master) SetBandwidthLimit(rate int64, burst int64) error {
+	m.session.lock.Lock()
+	defer m.session.lock.Unlock()
+	if m.session.netManager == nil {
+		return errors.New("no running session")
+	}
+	m.session.netManager.SetBandwidthLimit(rate, burst)
+	return m.session.netManager.Send(messages.NewBandwidthMessage(rate, burst))
+}
 
-	//Prepare encoder/decoder based on configuration
-	_, outEncoder := routines.EncoderInOut(in, out)
-	//send complemented configuration to slave
+// Connection to the slave, from the pool when the master has one
+func (m *master) connect() (*slaveConn, error) {
+	if m.pool != nil {
+		return m.pool.acquire(m.Config, m.logger)
+	}
+	return openConn(m.Config, m.logger)
+}
+
+func (m *master) run(conn *slaveConn) error {
+	// algorithms chosen in the handshake of the connection
+	netManager, algorithm := conn.netManager, conn.algorithm
+	m.Config.HashAlgorithm = algorithm.Name
+	m.Config.Compression = conn.codec.Name
+	netManager.SetCompression(conn.codec, m.Config.BlockSize)
+	netManager.SetBandwidthLimit(m.Config.BandwidthLimit, m.Config.BandwidthBurst)
+
+	//send complemented configuration to slave, with the local file details
+	_, err := m.Config.LocalFile().Update()
+	if err != nil {
+		return err
+	}
 	remoteConf := m.Config.Complement()
-	err = outEncoder.Encode(remoteConf)
+	err = netManager.Send(&remoteConf)
 	if err != nil {
 		return err
 	}
 
-	//execute source or destination controller (for selected protocol version)
-	source, err := NewSource(m.Config, *bestProtocol, in, out)
+	//the slave replies with its file details, both peers agree on both files before the sync
+	msg, err := receiveMessage(netManager)
 	if err != nil {
 		return err
 	}
-	err = source.Start()
-	return err
+	details, ok := msg.(*messages.FileDetailsMessage)
+	if !ok {
+		return fmt.Errorf("expected file details from slave, received message type %d", msg.GetMessageID())
+	}
+	*m.Config.RemoteFile() = details.Details
+	m.logger.Info("Files discovered", offsetAttr(m.Config.StartLoc), "source", m.Config.SourceFile.String(),
+		"destination", m.Config.DestinationFile.String())
+	err = m.Config.CheckFiles()
+	if err != nil {
+		return err
+	}
+	//the slave is waiting the role messages, it is notified of the journal failures
+	if m.Config.Resume {
+		err = checkResume(m.Config)
+		if err != nil {
+			netManager.Send(messages.NewErrorMessage(err))
+			return err
+		}
+	}
+	//a stale journal should not survive a new sync, the region before StartLoc is confirmed
+	if m.Config.JournalFile != "" {
+		err = saveCheckpoint(m.Config, m.Config.StartLoc)
+		if err != nil {
+			netManager.Send(messages.NewErrorMessage(err))
+			return err
+		}
+	}
+	//the limits of a directory tree are set on the listed files
+	if !m.Config.Recursive {
+		limits := messages.NewLimits(m.Config, algorithm)
+		netManager.SetLimits(limits)
+		m.logger.Debug("Message limits set", offsetAttr(m.Config.StartLoc), "max_message", limits.MaxMessageSize())
+	}
+
+	//execute source or destination controller (for selected protocol version)
+	return startRole(m.Config, conn.protocol, netManager)
 }
 
 //Slave
 
 type slave struct {
 	Config configuration.Configuration
+	// protocol streams
+	in  io.Reader
+	out io.Writer
+	// address of the master, when known
+	master string
+	// directory confining the local files of a daemon session, no confinement when empty
+	root string
+	// closed when the daemon shuts down, the slave waiting the next session ends
+	shutdown chan bool
+	// session records, the session is known once the configuration is received
+	logger *slog.Logger
 }
 
+// Slave speaking the protocol over stdin/stdout. The protocol stream takes the stdout: os.Stdout is redirected to
+// stderr, so that nothing else is ever written there
 func NewSlave() slave {
-	return slave{}
+	out := os.Stdout
+	os.Stdout = os.Stderr
+	return slave{in: os.Stdin, out: out}
+}
+
+// Slave speaking the protocol over the provided streams, e.g. a network connection
+func NewStreamSlave(in io.Reader, out io.Writer) slave {
+	return slave{in: in, out: out}
 }
 
 func (m slave) GetConfig() configuration.Configuration {
@@ -84,73 +258,319 @@ func (m slave) GetConfig() configuration.Configuration {
 }
 
 func (m slave) Start() error {
+	m.logger = slog.Default().With(configuration.LogSession, "", configuration.LogRole, "slave")
+	if m.master != "" {
+		m.logger = m.logger.With("master", m.master)
+	}
+	err := m.start()
+	if err != nil {
+		m.logger.Error("Session failed", offsetAttr(m.Config.StartLoc), "error", err)
+	}
+	return err
+}
+
+func (m *slave) start() error {
+	//stdout may be the protocol stream, nothing else should be written there
+	netManager := routines.NewNetworkManager(configuration.DefaultNetworkChannelSize, m.in, m.out)
+	err := netManager.Start()
+	if err != nil {
+		return err
+	}
+	err = m.run(netManager)
+	stopErr := netManager.Stop()
+	if err != nil {
+		return err
+	}
+	return stopErr
+}
 
+// Runs the sessions of the master, the streams carry further sessions when both the peers accept them
+func (m *slave) run(netManager *routines.NetworkManager) error {
 	//send hello+version/receive hello+version, choose protocol version
-	protocol, err := handshake(os.Stdin, os.Stdout)
+	protocol, algorithm, codec, sessions, err := handshake(netManager, hashing.Names(), compression.Names())
 	if err != nil {
 		return err
 	}
 
 	//receive complemented configuration from master
-	//execute source or destination controller (for selected protocol version)
-
-	if m.Config.IsSource {
-		source, err := NewSource(m.Config, *protocol, os.Stdin, os.Stdout)
+	msg, err := receiveMessage(netManager)
+	for err == nil && msg != nil {
+		err = m.session(netManager, msg, *protocol, algorithm, codec)
 		if err != nil {
 			return err
 		}
-		err = source.Start()
-	} else {
-		destination, err := NewDestination(m.Config, *protocol, os.Stdin, os.Stdout)
+		m.logger.Info("Session completed", offsetAttr(m.Config.SourceFile.Size))
+		if !sessions {
+			return nil
+		}
+		msg, err = m.nextSession(netManager)
+	}
+	return err
+}
+
+// Waits the configuration of the next session, nil when the master closes the streams or the daemon shuts down
+func (m *slave) nextSession(netManager *routines.NetworkManager) (messages.Message, error) {
+	//the next session sets its own limits
+	netManager.SetLimits(messages.DefaultLimits())
+	select {
+	case msg, ok := <-netManager.GetInMsgChannel():
+		if !ok {
+			return nil, netManager.Err()
+		}
+		if msg.GetMessageID() == messages.ErrorMessageID {
+			err := netManager.MessageError(msg.(*messages.ErrorMessage))
+			if errors.Is(err, io.EOF) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		return msg, nil
+	case <-m.shutdown:
+		return nil, nil
+	}
+}
+
+// Session of the received configuration message
+func (m *slave) session(netManager *routines.NetworkManager, msg messages.Message, protocol int, algorithm hashing.HashAlgorithm, codec compression.Algorithm) (err error) {
+	conf, ok := msg.(*configuration.Configuration)
+	if !ok {
+		return fmt.Errorf("expected configuration from master, received message type %d", msg.GetMessageID())
+	}
+	m.Config = *conf
+	m.logger = sessionLogger(m.Config)
+	if m.master != "" {
+		m.logger = m.logger.With("master", m.master)
+	}
+	m.logger.Info("Session started", offsetAttr(m.Config.StartLoc), "protocol", protocol, "hash", algorithm.Name,
+		"compression", codec.Name)
+	_, err = m.Config.Validate()
+	if err != nil {
+		return err
+	}
+	//both peers select the algorithm with the same rule, a different choice means a broken peer
+	if m.Config.HashAlgorithm != algorithm.Name {
+		return fmt.Errorf("hash algorithm mismatch, master selected %q, slave selected %q", m.Config.HashAlgorithm, algorithm.Name)
+	}
+	if m.Config.Compression != codec.Name {
+		return fmt.Errorf("compression mismatch, master selected %q, slave selected %q", m.Config.Compression, codec.Name)
+	}
+	netManager.SetCompression(codec, m.Config.BlockSize)
+	netManager.SetBandwidthLimit(m.Config.BandwidthLimit, m.Config.BandwidthBurst)
+
+	if m.root != "" {
+		local := m.Config.LocalFile()
+		local.FileName, err = confine(m.root, local.FileName)
 		if err != nil {
+			netManager.Send(messages.NewErrorMessage(err))
 			return err
 		}
-		err = destination.Start()
+	}
 
+	//reply with the local file details, the master checks them too
+	_, err = m.Config.LocalFile().Update()
+	if err != nil {
+		netManager.Send(messages.NewErrorMessage(err))
+		return err
+	}
+	err = netManager.Send(messages.NewFileDetailsMessage(*m.Config.LocalFile()))
+	if err != nil {
+		return err
+	}
+	err = m.Config.CheckFiles()
+	if err != nil {
+		return err
+	}
+	//the limits of a directory tree are set on the listed files
+	if !m.Config.Recursive {
+		limits := messages.NewLimits(m.Config, algorithm)
+		netManager.SetLimits(limits)
+		m.logger.Debug("Message limits set", offsetAttr(m.Config.StartLoc), "max_message", limits.MaxMessageSize())
 	}
 
-	return nil
+	//execute source or destination controller (for selected protocol version)
+	return startRole(m.Config, protocol, netManager)
 }
 
-// Executes slave locally, inDecoder sends objects to the process, outEncoder reads objects from the process
-func execSlave() (in io.Reader, out io.Writer, err error) {
-	execName := os.Args[0]
+// Executes the source or destination controller (the directory tree sync in recursive mode), depending on the
+// configuration. The master reports the progress on stderr when enabled
+func startRole(config configuration.Configuration, protocol int, netManager *routines.NetworkManager) error {
+	if config.Recursive {
+		return syncTree(config, protocol, netManager)
+	}
+	var role interface {
+		Start() error
+		GetProgress() *routines.Progress
+	}
+	var err error
+	if config.IsSource {
+		role, err = NewSource(config, protocol, netManager)
+	} else {
+		role, err = NewDestination(config, protocol, netManager)
+	}
+	if err != nil {
+		return err
+	}
+	if config.IsMaster && config.Progress {
+		routines.NewProgressReporter(role.GetProgress(), os.Stderr, sessionLogger(config)).Start()
+	}
+	err = role.Start()
+	role.GetProgress().Finish()
+	return err
+}
 
-	cmd := exec.Command(execName, "-S")
+// Opens the protocol streams to the slave, wait releases the slave resources once the streams are closed
+func openSlave(config configuration.Configuration) (in io.ReadCloser, out io.WriteCloser, wait func() error, err error) {
+	if config.ConnectAddress != "" {
+		tlsConfig, err := ClientTLSConfig(config)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		conn, err := net.DialTimeout("tcp", config.ConnectAddress, configuration.DialTimeout)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if tlsConfig != nil {
+			//the TLS handshake is performed by the protocol handshake
+			conn = tls.Client(conn, tlsConfig)
+		}
+		return conn, conn, func() error { return nil }, nil
+	}
+	cmd, in, out, err := execSlave(config)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return in, out, cmd.Wait, nil
+}
 
-	out, _ = cmd.StdinPipe()
-	in, _ = cmd.StdoutPipe()
+// Builds the slave command. The local slave is this executable, the remote one is started through the remote shell
+// template, as in '<rsh> host <remote command> -S'. The slave logs as the master (-v, -log-format)
+func SlaveCommand(config configuration.Configuration) (*exec.Cmd, error) {
+	slaveArgs := []string{"-S"}
+	if config.Verbose {
+		slaveArgs = append(slaveArgs, "-v")
+	}
+	if config.LogFormat != "" && config.LogFormat != configuration.LogText {
+		slaveArgs = append(slaveArgs, "-log-format", config.LogFormat)
+	}
+	if config.RemoteHost == "" {
+		return exec.Command(os.Args[0], slaveArgs...), nil
+	}
+	rsh, err := utils.SplitCommandLine(config.RemoteShell)
+	if err != nil {
+		return nil, err
+	}
+	if len(rsh) == 0 {
+		return nil, errors.New("empty remote shell command")
+	}
+	args := append(append(rsh[1:], config.RemoteHost, config.RemoteCommand), slaveArgs...)
+	return exec.Command(rsh[0], args...), nil
+}
+
+// Executes slave, returns the slave process, in reads data from the process and out sends data to the process
+func execSlave(config configuration.Configuration) (cmd *exec.Cmd, in io.ReadCloser, out io.WriteCloser, err error) {
+	cmd, err = SlaveCommand(config)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	//slave diagnostics go to our stderr
+	cmd.Stderr = os.Stderr
+
+	out, err = cmd.StdinPipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	in, err = cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
 
 	err = cmd.Start()
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	return
 }
 
-func handshake(in io.Reader, out io.Writer) (bestProtocol *int, err error) {
-	inDecoder, outEncoder := routines.EncoderInOut(in, out)
+// Receives one message from the peer, ErrorMessages from the peer are turned into errors
+func receiveMessage(netManager *routines.NetworkManager) (messages.Message, error) {
+	select {
+	case m, ok := <-netManager.GetInMsgChannel():
+		if !ok {
+			return nil, closedError(netManager, "connection closed by the peer")
+		}
+		if m.GetMessageID() == messages.ErrorMessageID {
+			return nil, netManager.MessageError(m.(*messages.ErrorMessage))
+		}
+		return m, nil
+	case <-time.After(configuration.HandshakeTimeout):
+		return nil, errors.New("timeout waiting for a message from the peer")
+	}
+}
+
+// Error of an input channel closed before the end of the protocol, it wraps the failure of the network manager
+func closedError(netManager *routines.NetworkManager, text string) error {
+	if err := netManager.Err(); err != nil {
+		return fmt.Errorf("%s: %w", text, err)
+	}
+	return errors.New(text)
+}
 
+// Exchanges the hello messages, chooses the protocol version, the strongest common hash algorithm and the preferred
+// common compression algorithm. Sessions is set when both the peers accept further sessions on the streams
+func handshake(netManager *routines.NetworkManager, hashes []string, compressions []string) (bestProtocol *int, algorithm hashing.HashAlgorithm, codec compression.Algorithm, sessions bool, err error) {
+	// TLS handshake first, so that its failures are reported as they are and not as a broken stream
+	if tlsConn, ok := netManager.InStream.(*tls.Conn); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), configuration.HandshakeTimeout)
+		err = tlsConn.HandshakeContext(ctx)
+		cancel()
+		if err != nil {
+			return bestProtocol, algorithm, codec, sessions, fmt.Errorf("TLS handshake failed: %w", err)
+		}
+	}
 	// send hello+version
-	err = messages.EncodeMessage(outEncoder, messages.NewHelloInfo())
-	//err = outEncoder.Encode(messages.NewHelloInfo())
+	hello := messages.NewHelloInfo()
+	hello.SupportedProtocols = netManager.GetSupportedProtocols()
+	hello.SupportedHashes = hashes
+	hello.SupportedCompressions = compressions
+	hello.Checksums = netManager.GetChecksums()
+	err = netManager.Send(hello)
 	if err != nil {
-		return bestProtocol, err
+		return bestProtocol, algorithm, codec, sessions, err
 	}
 	// receive hello+version
-	var remoteHelloInfo *messages.HelloInfoMessage
-	m, err := messages.DecodeMessage(inDecoder)
-	//err = inDecoder.Decode(&remoteHelloInfo)
-	remoteHelloInfo = m.(*messages.HelloInfoMessage)
+	m, err := receiveMessage(netManager)
+	if err != nil {
+		return bestProtocol, algorithm, codec, sessions, err
+	}
+	remoteHelloInfo, ok := m.(*messages.HelloInfoMessage)
+	if !ok {
+		return bestProtocol, algorithm, codec, sessions, fmt.Errorf("expected hello message from peer, received message type %d", m.GetMessageID())
+	}
+
+	// let's choose protocol version, the messages after the hello use its encoding and carry the CRC32C trailers when
+	// both the peers want them
+	best, err := routines.BestProtocol(hello.SupportedProtocols, remoteHelloInfo.SupportedProtocols)
+	if err != nil {
+		return bestProtocol, algorithm, codec, sessions, err
+	}
+	bestProtocol = &best
+	err = netManager.SwitchProtocol(best, hello.Checksums && remoteHelloInfo.Checksums)
+	if err != nil {
+		return bestProtocol, algorithm, codec, sessions, err
+	}
+
+	// ..the hash algorithm
+	algorithm, err = hashing.SelectBest(hashes, remoteHelloInfo.SupportedHashes)
 	if err != nil {
-		return bestProtocol, err
+		return bestProtocol, algorithm, codec, sessions, err
 	}
 
-	// let's choose protocol version
-	inter := utils.SliceIntersection(configuration.SupportedProtocols, remoteHelloInfo.SupportedProtocols)
-	if len(inter) == 0 {
-		return bestProtocol, errors.New("master and slave protocols versions are no compatible")
+	// ..and the compression, peers without compression support send raw blocks
+	remoteCompressions := remoteHelloInfo.SupportedCompressions
+	if len(remoteCompressions) == 0 {
+		remoteCompressions = []string{compression.None}
 	}
-	bestProtocol = utils.SliceMax(inter)
-	return bestProtocol, err
+	codec, err = compression.SelectBest(compressions, remoteCompressions)
+	sessions = hello.Sessions && remoteHelloInfo.Sessions
+	return bestProtocol, algorithm, codec, sessions, err
 }
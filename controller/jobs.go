@@ -0,0 +1,281 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ftarlao/goblocksync/data/configuration"
+	"github.com/ftarlao/goblocksync/utils"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Job runner. A manifest (JSON) lists the source/destination pairs to sync; each pair is a job with its own master
+// session, and at most Parallel jobs run at once. The options of a job override the manifest defaults, which override
+// the command line options. The jobs share a pool of slave connections (remote shell or daemon connection): a
+// connection opened for a job carries the sessions of the following jobs with the same transport, hash and compression
+// options, so that at most Parallel slaves run for each transport. The summary lines of the concurrent jobs are not
+// printed, the job report has their results.
+
+// Job manifest, e.g.
+//
+//	{"Parallel": 2, "Defaults": {"Connect": "backup:7373", "BandwidthLimit": "50M"},
+//	 "Jobs": [{"Name": "lun0", "Source": "/dev/sdb", "Destination": "backup:/images/lun0.img", "BlockSize": "64K"}]}
+type Manifest struct {
+	// Max number of jobs running at once, 1 when zero
+	Parallel int
+	Defaults JobOptions
+	Jobs     []Job
+}
+
+type Job struct {
+	// Name in the summary, the destination when empty
+	Name string
+	// [[user@]host:]path, as the -s and -d options
+	Source      string
+	Destination string
+	JobOptions
+}
+
+// Options of a job, zero values keep the defaults. Sizes are numbers or strings with K, M, G, T suffixes
+type JobOptions struct {
+	BlockSize   utils.Size
+	Mode        string
+	Hash        string
+	HashWorkers int
+	Compression string
+	// Bandwidth limit [bytes/s] and burst [bytes]
+	BandwidthLimit utils.Size
+	BandwidthBurst utils.Size
+	SizePolicy     string
+	Sparse         *bool
+	// Checkpoint journal of the block mode, no journal when empty
+	Journal string
+	// Commands run before and after the sync (see hooks.go)
+	PreHook  string
+	PostHook string
+	// Transport of the slave: daemon address host:port, or remote shell and path of the remote executable
+	Connect       string
+	RemoteShell   string
+	RemoteCommand string
+	// TLS of the daemon connection, as the -tls-* options
+	TLSCert string
+	TLSKey  string
+	TLSCA   string
+	TLSPin  string
+}
+
+// Job with its resolved configuration
+type ResolvedJob struct {
+	Name   string
+	Config configuration.Configuration
+}
+
+// Outcome of a job
+type JobResult struct {
+	Name            string
+	SourceFile      string
+	DestinationFile string
+	RemoteHost      string
+	Failed          bool
+	Error           string
+	Seconds         float64
+}
+
+type JobReport struct {
+	Jobs       []JobResult
+	FailedJobs int
+}
+
+// Reads the manifest, unknown fields are refused
+func LoadManifest(fileName string) (*Manifest, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var m Manifest
+	err = decoder.Decode(&m)
+	if err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %w", fileName, err)
+	}
+	if len(m.Jobs) == 0 {
+		return nil, errors.New("no jobs in the manifest " + fileName)
+	}
+	if m.Parallel < 0 {
+		return nil, errors.New("the number of parallel jobs should not be negative")
+	}
+	return &m, nil
+}
+
+// Resolves and validates the configurations of the jobs, base is the master configuration of the command line
+func (m *Manifest) Resolve(base configuration.Configuration) ([]ResolvedJob, error) {
+	jobs := make([]ResolvedJob, 0, len(m.Jobs))
+	for i, job := range m.Jobs {
+		name := job.Name
+		if name == "" {
+			name = job.Destination
+		}
+		config := base
+		m.Defaults.apply(&config)
+		job.JobOptions.apply(&config)
+		err := config.SetLocations(job.Source, job.Destination)
+		if err == nil {
+			_, err = config.Validate()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("job %d (%s): %w", i+1, name, err)
+		}
+		jobs = append(jobs, ResolvedJob{name, config})
+	}
+	return jobs, nil
+}
+
+func (o JobOptions) apply(c *configuration.Configuration) {
+	if o.BlockSize != 0 {
+		c.BlockSize = int64(o.BlockSize)
+	}
+	if o.Mode != "" {
+		c.Mode = o.Mode
+	}
+	if o.Hash != "" {
+		c.HashAlgorithm = o.Hash
+	}
+	if o.HashWorkers != 0 {
+		c.HashWorkers = o.HashWorkers
+	}
+	if o.Compression != "" {
+		c.Compression = o.Compression
+	}
+	if o.BandwidthLimit != 0 {
+		c.BandwidthLimit = int64(o.BandwidthLimit)
+	}
+	if o.BandwidthBurst != 0 {
+		c.BandwidthBurst = int64(o.BandwidthBurst)
+	}
+	if o.SizePolicy != "" {
+		c.SizePolicy = o.SizePolicy
+	}
+	if o.Sparse != nil {
+		c.Sparse = *o.Sparse
+	}
+	if o.Journal != "" {
+		c.JournalFile = o.Journal
+	}
+	if o.PreHook != "" {
+		c.PreHook = o.PreHook
+	}
+	if o.PostHook != "" {
+		c.PostHook = o.PostHook
+	}
+	if o.Connect != "" {
+		c.ConnectAddress = o.Connect
+	}
+	if o.RemoteShell != "" {
+		c.RemoteShell = o.RemoteShell
+	}
+	if o.RemoteCommand != "" {
+		c.RemoteCommand = o.RemoteCommand
+	}
+	if o.TLSCert != "" {
+		c.TLSCertFile = o.TLSCert
+	}
+	if o.TLSKey != "" {
+		c.TLSKeyFile = o.TLSKey
+	}
+	if o.TLSCA != "" {
+		c.TLSCAFile = o.TLSCA
+	}
+	if o.TLSPin != "" {
+		c.TLSPin = o.TLSPin
+	}
+}
+
+// Runs the jobs, at most parallel at once, the results are in the job order. A failed job does not stop the others
+func RunJobs(jobs []ResolvedJob, parallel int) *JobReport {
+	if parallel < 1 {
+		parallel = 1
+	}
+	report := &JobReport{Jobs: make([]JobResult, len(jobs))}
+	pool := NewSlavePool()
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < parallel && w < len(jobs); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				report.Jobs[i] = runJob(pool, jobs[i], parallel > 1)
+			}
+		}()
+	}
+	for i := range jobs {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+	err := pool.Close()
+	if err != nil {
+		ProcessLogger(RoleJob).Warn("Slave connections not closed properly", "error", err)
+	}
+	for _, result := range report.Jobs {
+		if result.Failed {
+			report.FailedJobs++
+		}
+	}
+	return report
+}
+
+func runJob(pool *SlavePool, job ResolvedJob, concurrent bool) JobResult {
+	config := job.Config
+	//the progress and summary lines of concurrent jobs would overwrite or interleave each other
+	if concurrent {
+		config.Progress = false
+		config.NoSummary = true
+	}
+	result := JobResult{
+		Name:            job.Name,
+		SourceFile:      config.SourceFile.FileName,
+		DestinationFile: config.DestinationFile.FileName,
+		RemoteHost:      config.RemoteHost}
+	//the job records carry the session of the job
+	master := pool.NewMaster(config)
+	master.Logger().Info("Job started", "job", job.Name)
+	start := time.Now()
+	err := master.Start()
+	result.Seconds = time.Since(start).Seconds()
+	if err != nil {
+		result.Failed = true
+		result.Error = err.Error()
+		master.Logger().Error("Job failed", "job", job.Name, "error", err)
+	} else {
+		master.Logger().Info("Job completed", "job", job.Name)
+	}
+	return result
+}
+
+// Writes the report as text or JSON (configuration.ReportText, configuration.ReportJSON)
+func (r *JobReport) Write(w io.Writer, format string) error {
+	if format == configuration.ReportJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(r)
+	}
+	var b bytes.Buffer
+	fmt.Fprintln(&b, "Job summary (name, result, seconds):")
+	for _, job := range r.Jobs {
+		if job.Failed {
+			fmt.Fprintf(&b, "%s\tFAILED\t%.1f\t%s\n", job.Name, job.Seconds, job.Error)
+		} else {
+			fmt.Fprintf(&b, "%s\tOK\t%.1f\n", job.Name, job.Seconds)
+		}
+	}
+	fmt.Fprintln(&b, "Jobs:\t\t", len(r.Jobs))
+	fmt.Fprintln(&b, "Failed jobs:\t", r.FailedJobs)
+	_, err := w.Write(b.Bytes())
+	return err
+}
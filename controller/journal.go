@@ -0,0 +1,183 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ftarlao/goblocksync/data/configuration"
+	"os"
+	"path/filepath"
+)
+
+// Checkpoint journal of the master (block mode). The destination confirms the synced regions with checkpoints, the
+// master records the last confirmed location with the sync parameters and the identity of both the files. A resumed
+// sync starts from the confirmed location, only when parameters and files are the same: the source should be
+// unchanged (size, modification time, inode), the destination should be the same file (inode, device size). A
+// destination created by the sync on the slave is identified from the first journal of the resumed sync.
+
+type Journal struct {
+	// Files of the sync as discovered by the peers
+	SourceFile      configuration.FileDetails
+	DestinationFile configuration.FileDetails
+	// Remote peer of the sync, [user@]host or the daemon address
+	RemoteHost    string
+	HashAlgorithm string
+	BlockSize     int64
+	// All the blocks before ConfirmedLoc are synced [bytes]
+	ConfirmedLoc int64
+}
+
+// Journal of the sync described by the configuration (master side) with its file details, nothing is confirmed yet
+func NewJournal(config configuration.Configuration) *Journal {
+	j := &Journal{
+		SourceFile:      config.SourceFile,
+		DestinationFile: config.DestinationFile,
+		RemoteHost:      config.RemoteHost,
+		HashAlgorithm:   config.HashAlgorithm,
+		BlockSize:       config.BlockSize,
+		ConfirmedLoc:    config.StartLoc}
+	if config.ConnectAddress != "" {
+		j.RemoteHost = config.ConnectAddress
+	}
+	return j
+}
+
+func LoadJournal(fileName string) (*Journal, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var j Journal
+	err = json.Unmarshal(data, &j)
+	if err != nil {
+		return nil, fmt.Errorf("invalid journal %s: %w", fileName, err)
+	}
+	return &j, nil
+}
+
+// Writes the journal, the old journal is replaced only when the new one is complete
+func (j *Journal) Save(fileName string) error {
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(fileName), filepath.Base(fileName)+".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), fileName)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Checks that the sync described by the configuration is the one recorded in the journal, with the files discovered
+// in the configuration. HashAlgorithm is checked only when set in the configuration
+func (j *Journal) Check(config configuration.Configuration) error {
+	err := j.checkParameters(config)
+	if err == nil {
+		err = j.checkSource(config.SourceFile)
+	}
+	if err == nil {
+		err = j.checkDestination(config.DestinationFile)
+	}
+	return err
+}
+
+func (j *Journal) checkParameters(config configuration.Configuration) error {
+	if config.Mode != "" && config.Mode != configuration.ModeBlock {
+		return errors.New("only the block mode syncs can be resumed")
+	}
+	current := NewJournal(config)
+	switch {
+	case current.SourceFile.FileName != j.SourceFile.FileName ||
+		current.DestinationFile.FileName != j.DestinationFile.FileName || current.RemoteHost != j.RemoteHost:
+		return errors.New("cannot resume, the journal refers to different files")
+	case current.BlockSize != j.BlockSize:
+		return fmt.Errorf("cannot resume, the journal block size is %d bytes", j.BlockSize)
+	case config.HashAlgorithm != "" && config.HashAlgorithm != j.HashAlgorithm:
+		return fmt.Errorf("cannot resume, the journal hash algorithm is %s", j.HashAlgorithm)
+	case j.ConfirmedLoc < 0 || j.ConfirmedLoc%j.BlockSize != 0:
+		return errors.New("cannot resume, invalid confirmed location in the journal")
+	}
+	return nil
+}
+
+// The source should be unchanged
+func (j *Journal) checkSource(details configuration.FileDetails) error {
+	recorded := j.SourceFile
+	if details.Size != recorded.Size || details.ModTime != recorded.ModTime || details.Inode != recorded.Inode ||
+		details.IsDevice != recorded.IsDevice {
+		return errors.New("cannot resume, the source file changed")
+	}
+	return nil
+}
+
+// The destination is written by the sync, it should be the same file; a destination missing when the journal was
+// recorded is not identified
+func (j *Journal) checkDestination(details configuration.FileDetails) error {
+	recorded := j.DestinationFile
+	if recorded.ModTime == 0 {
+		return nil
+	}
+	if details.Inode != recorded.Inode || details.IsDevice != recorded.IsDevice ||
+		recorded.IsDevice && details.Size != recorded.Size {
+		return errors.New("cannot resume, the destination is a different file")
+	}
+	return nil
+}
+
+// Checks the journal with the local file, the configuration resumes the sync from the confirmed location with the
+// journal hash algorithm. The master checks the remote file with Check once discovered
+func (j *Journal) Resume(config *configuration.Configuration) error {
+	local := config.LocalFile()
+	_, err := local.Update()
+	if err == nil {
+		err = j.checkParameters(*config)
+	}
+	if err == nil && config.IsSource {
+		err = j.checkSource(*local)
+	} else if err == nil {
+		err = j.checkDestination(*local)
+	}
+	if err != nil {
+		return err
+	}
+	config.StartLoc = j.ConfirmedLoc
+	config.HashAlgorithm = j.HashAlgorithm
+	config.Resume = true
+	return nil
+}
+
+// Checks the journal of the resumed sync, once both the files are discovered
+func checkResume(config configuration.Configuration) error {
+	j, err := LoadJournal(config.JournalFile)
+	if err != nil {
+		return err
+	}
+	return j.Check(config)
+}
+
+// Records the confirmed location in the configuration journal. A local destination is discovered again, it may have
+// been created by the sync
+func saveCheckpoint(config configuration.Configuration, loc int64) error {
+	if !config.IsSource {
+		_, err := config.DestinationFile.Update()
+		if err != nil {
+			return err
+		}
+	}
+	j := NewJournal(config)
+	j.ConfirmedLoc = loc
+	return j.Save(config.JournalFile)
+}
@@ -0,0 +1,55 @@
+package controller
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/ftarlao/goblocksync/data/configuration"
+	"log/slog"
+)
+
+// Session log records. The master generates the session ID and sends it to the slave with the configuration; the
+// records of both the peers carry the session ID, the role of the peer and the sync offset (configuration.LogSession,
+// LogRole and LogOffset attributes). The records outside the sessions, e.g. of the daemon, carry an empty session, the
+// role of the process and a zero offset. The records go to stderr through the default slog logger, the stdout of the
+// slave is the protocol stream.
+
+// Roles of the records outside the sessions
+const (
+	RoleMaster = "master"
+	RoleJob    = "job"
+	RoleDaemon = "daemon"
+)
+
+// Random session ID, 16 hexadecimal digits
+func newSessionID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Role of the local peer, e.g. master/source
+func roleName(config configuration.Configuration) string {
+	peer, side := "slave", "destination"
+	if config.IsMaster {
+		peer = "master"
+	}
+	if config.IsSource {
+		side = "source"
+	}
+	return peer + "/" + side
+}
+
+// Logger of the session records of the local peer, the records add the offset
+func sessionLogger(config configuration.Configuration) *slog.Logger {
+	return slog.Default().With(configuration.LogSession, config.SessionID, configuration.LogRole, roleName(config))
+}
+
+// Logger of the records outside the sessions of the process with the role, e.g. RoleDaemon
+func ProcessLogger(role string) *slog.Logger {
+	return slog.Default().With(configuration.LogSession, "", configuration.LogRole, role, offsetAttr(0))
+}
+
+// Offset attribute of a session record
+func offsetAttr(offset int64) slog.Attr {
+	return slog.Int64(configuration.LogOffset, offset)
+}
@@ -0,0 +1,503 @@
+package controller
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/ftarlao/goblocksync/controller/routines"
+	"github.com/ftarlao/goblocksync/data/configuration"
+	"github.com/ftarlao/goblocksync/data/messages"
+	"github.com/ftarlao/goblocksync/utils"
+	"io"
+	"os"
+)
+
+// Merkle mode (protocol V1), the destination sends the hashes of the top level Merkle nodes (HashGroupMessage with
+// Level = MerkleLevels) followed by an EndMessage. The source compares them with its own top level hashes; for each
+// mismatching node it sends a HashRequestMessage and the destination replies with the hashes of the node children.
+// The refinement goes on down to the blocks (level 0), mismatching blocks are sent as DataBlockMessages. The end of
+// the session is the same as the block mode (EndMessage, acknowledged by the destination).
+
+// Merkle node, identified by start location and level
+type merkleNode struct {
+	startLoc int64
+	level    int
+	hash     []byte
+}
+
+func newMerkleTree(config configuration.Configuration) (routines.MerkleTree, error) {
+	algorithm, err := hashAlgorithm(config)
+	if err != nil {
+		return routines.MerkleTree{}, err
+	}
+	return routines.MerkleTree{BlockSize: config.BlockSize, Fanout: config.MerkleFanout, Algorithm: algorithm}, nil
+}
+
+//DESTINATION
+
+type destinationMerkle struct {
+	Config     configuration.Configuration
+	netManager *routines.NetworkManager
+	progress   *routines.Progress
+	// Whole-file digest of the source, checked after the writes
+	sourceDigest *messages.DigestMessage
+}
+
+func (d *destinationMerkle) GetConfig() configuration.Configuration {
+	return d.Config
+}
+
+func (d *destinationMerkle) GetProgress() *routines.Progress {
+	return d.progress
+}
+
+func (d *destinationMerkle) Start() error {
+	err := d.sync()
+	if err != nil {
+		d.netManager.Send(messages.NewErrorMessage(err))
+	}
+	return err
+}
+
+func (d *destinationMerkle) sync() error {
+	tree, err := newMerkleTree(d.Config)
+	if err != nil {
+		return err
+	}
+	f, err := routines.OpenWritable(d.Config.DestinationFile.FileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	//size before the sync, for the size policy
+	err = d.Config.DestinationFile.UpdateFile(f)
+	if err != nil {
+		return err
+	}
+
+	writer, err := newDestinationWriter(d.Config, f)
+	if err != nil {
+		return err
+	}
+	err = writer.Start()
+	if err != nil {
+		return err
+	}
+	defer writer.Stop()
+	d.progress.SetWriter(writer)
+
+	// hashes are sent by a dedicated goroutine, the source may be busy sending blocks and the main loop should always
+	// receive them
+	requests := make(chan *messages.HashRequestMessage, configuration.MerkleMaxPendingRequests)
+	sender := startSender(func(done chan bool) error {
+		return d.sendHashes(tree, f, requests, done)
+	})
+	defer sender.stop()
+
+	inChan := d.netManager.GetInMsgChannel()
+	writerIn := writer.GetInMsgChannel()
+	writerOut := writer.GetOutMsgChannel()
+	for {
+		select {
+		case err = <-sender.err:
+			return err
+		case writerMsg := <-writerOut:
+			if writerMsg.GetMessageID() == messages.EndMessageID {
+				//all the blocks have been written and synced
+				summary, err := completeDestination(d.Config, f, d.sourceDigest)
+				if err != nil {
+					return err
+				}
+				reportSize(d.Config, d.progress, summary)
+				//acknowledge
+				return d.netManager.Send(writerMsg)
+			}
+			return errors.New(writerMsg.(*messages.ErrorMessage).Err)
+		case msg, ok := <-inChan:
+			if !ok {
+				return closedError(d.netManager, "connection closed by the source before the end of the sync")
+			}
+			switch msg.GetMessageID() {
+			case messages.HashRequestMessageID:
+				request := msg.(*messages.HashRequestMessage)
+				level := int(request.Level)
+				if level < 1 || level > d.Config.MerkleLevels {
+					return fmt.Errorf("hash request for invalid merkle level %d", level)
+				}
+				select {
+				case requests <- request:
+				default:
+					return errors.New("too many pending hash requests from the source")
+				}
+			case messages.DataBlockMessageID, messages.ZeroBlockMessageID, messages.EndMessageID:
+				if dataMsg, ok := msg.(*messages.DataBlockMessage); ok {
+					d.progress.AddTransferred(int64(len(dataMsg.Data)))
+				}
+				//the writer never blocks on output, it consumes the whole input even after a failure
+				writerIn <- msg
+			case messages.DigestMessageID:
+				d.sourceDigest = msg.(*messages.DigestMessage)
+			case messages.ErrorMessageID:
+				return d.netManager.MessageError(msg.(*messages.ErrorMessage))
+			default:
+				return fmt.Errorf("unexpected message type %d received by the destination", msg.GetMessageID())
+			}
+		}
+	}
+}
+
+// Sends the top level hashes followed by an EndMessage, then replies to the hash requests till done. The source does
+// not send requests nor data before the EndMessage
+func (d *destinationMerkle) sendHashes(tree routines.MerkleTree, f io.ReaderAt, requests chan *messages.HashRequestMessage, done chan bool) error {
+	err := sendNodeHashes(d.netManager, tree, f, d.Config.StartLoc, -1, d.Config.MerkleLevels, done)
+	if err != nil {
+		return err
+	}
+	err = d.netManager.SendUntil(messages.NewEndMessage(), done)
+	if err != nil {
+		return err
+	}
+	for {
+		select {
+		case request := <-requests:
+			level := int(request.Level)
+			end := request.StartLoc + tree.NodeSize(level)
+			err = sendNodeHashes(d.netManager, tree, f, request.StartLoc, end, level-1, done)
+			if err != nil {
+				return err
+			}
+		case <-done:
+			return nil
+		}
+	}
+}
+
+// Sends the hashes of the level nodes in [start, end) as HashGroupMessages, the first group starts at start even when
+// the region is empty. The sending gives up when done is closed
+func sendNodeHashes(netManager *routines.NetworkManager, tree routines.MerkleTree, f io.ReaderAt, start int64, end int64, level int, done chan bool) error {
+	group := messages.NewHashGroupMessage(start)
+	group.Level = byte(level)
+	sent := false
+	err := tree.NodeHashes(f, start, end, level, func(startLoc int64, hash []byte) error {
+		if group.IsFull() {
+			err := netManager.SendUntil(group, done)
+			if err != nil {
+				return err
+			}
+			sent = true
+			group = messages.NewHashGroupMessage(startLoc)
+			group.Level = byte(level)
+		}
+		group.AddHash(hash)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !group.IsEmpty() || !sent {
+		group.TruncHashGroup()
+		return netManager.SendUntil(group, done)
+	}
+	return nil
+}
+
+//SOURCE
+
+type sourceMerkle struct {
+	Config     configuration.Configuration
+	netManager *routines.NetworkManager
+	progress   *routines.Progress
+	tree       routines.MerkleTree
+	sourceFile *os.File
+	sourceSize int64
+	// Mismatching nodes, waiting for refinement
+	queue []merkleNode
+	// Nodes whose children hashes have been requested, in request order
+	requested []merkleNode
+	// Number of blocks with matching hashes, including the blocks of the matching nodes
+	matchedBlocks int64
+	// Number of blocks (and bytes) sent to the destination
+	sentBlocks int64
+	sentBytes  int64
+	// Number of zero blocks sent as ZeroBlockMessages, and the pending zero region
+	zeroBlocks int64
+	zeros      zeroRange
+	// Whole-file digest of the source, computed by the reads of the top level hashes
+	digest *routines.DigestReader
+}
+
+func (s *sourceMerkle) GetConfig() configuration.Configuration {
+	return s.Config
+}
+
+func (s *sourceMerkle) GetProgress() *routines.Progress {
+	return s.progress
+}
+
+func (s *sourceMerkle) Start() error {
+	err := s.sync()
+	if err != nil {
+		s.netManager.Send(messages.NewErrorMessage(err))
+		return err
+	}
+	s.progress.Finish()
+	if s.Config.IsMaster && !s.Config.NoSummary {
+		fmt.Println("Matching blocks:\t", s.matchedBlocks)
+		fmt.Println("Transferred blocks:\t", s.sentBlocks, "(", s.sentBytes, "bytes )")
+		fmt.Println("Zero blocks:\t\t", s.zeroBlocks)
+		fmt.Println("Destination size:\t", describeSize(s.Config, s.sourceSize))
+		fmt.Println("Verified bytes:\t\t", s.sourceSize, "(", configuration.DigestAlgorithm, ")")
+	}
+	return nil
+}
+
+func (s *sourceMerkle) sync() (err error) {
+	s.tree, err = newMerkleTree(s.Config)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(s.Config.SourceFile.FileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s.sourceFile = f
+	err = s.Config.SourceFile.UpdateFile(f)
+	if err != nil {
+		return err
+	}
+	s.sourceSize = s.Config.SourceFile.Size
+	s.progress.SetTotal(s.sourceSize - s.Config.StartLoc)
+	digest, err := digestAlgorithm()
+	if err != nil {
+		return err
+	}
+	s.digest = routines.NewDigestReader(f, digest)
+
+	// local top level hashes, computed while the destination computes its own
+	top := s.Config.MerkleLevels
+	localTop := make(chan merkleNode, configuration.HashGroupChannelSize)
+	localErr := make(chan error, 1)
+	stopLocal := make(chan bool)
+	defer close(stopLocal)
+	go func() {
+		err := s.tree.NodeHashes(s.digest, s.Config.StartLoc, -1, top, func(startLoc int64, hash []byte) error {
+			select {
+			case localTop <- merkleNode{startLoc, top, hash}:
+				return nil
+			case <-stopLocal:
+				return errors.New("stopped")
+			}
+		})
+		close(localTop)
+		localErr <- err
+	}()
+
+	inChan := s.netManager.GetInMsgChannel()
+	var local *merkleNode
+	nextLocal := func() *merkleNode {
+		node, ok := <-localTop
+		if !ok {
+			return nil
+		}
+		return &node
+	}
+
+	// compare the top level nodes
+	for remoteEnded := false; !remoteEnded; {
+		msg, ok := <-inChan
+		if !ok {
+			return closedError(s.netManager, "connection closed by the destination before the end of the sync")
+		}
+		switch msg.GetMessageID() {
+		case messages.HashGroupMessageID:
+			remote := msg.(*messages.HashGroupMessage)
+			if int(remote.Level) != top || int(remote.NumHash) > len(remote.HashGroup) {
+				return errors.New("malformed top level hash group received from the destination")
+			}
+			for i := 0; i < int(remote.NumHash); i++ {
+				remoteLoc := remote.StartLoc + int64(i)*s.tree.NodeSize(top)
+				//local nodes without remote hash are missing on the destination (defensive)
+				for {
+					if local == nil {
+						local = nextLocal()
+					}
+					if local == nil || local.startLoc >= remoteLoc {
+						break
+					}
+					err = s.sendRegion(local.startLoc, local.startLoc+s.tree.NodeSize(top))
+					if err != nil {
+						return err
+					}
+					local = nil
+				}
+				if local != nil && local.startLoc == remoteLoc {
+					s.compare(*local, remote.HashGroup[i])
+					local = nil
+				}
+			}
+		case messages.EndMessageID:
+			remoteEnded = true
+		case messages.ErrorMessageID:
+			return s.netManager.MessageError(msg.(*messages.ErrorMessage))
+		default:
+			return fmt.Errorf("unexpected message type %d received by the source", msg.GetMessageID())
+		}
+	}
+	//the destination is shorter, the remaining nodes are sent
+	for {
+		if local == nil {
+			local = nextLocal()
+			if local == nil {
+				break
+			}
+		}
+		err = s.sendRegion(local.startLoc, local.startLoc+s.tree.NodeSize(top))
+		if err != nil {
+			return err
+		}
+		local = nil
+	}
+	err = <-localErr
+	if err != nil {
+		return err
+	}
+
+	// refine the mismatching nodes, with many requests in flight
+	for len(s.queue) > 0 || len(s.requested) > 0 {
+		for len(s.queue) > 0 && len(s.requested) < configuration.MerkleMaxPendingRequests {
+			node := s.queue[0]
+			s.queue = s.queue[1:]
+			if node.level == 0 {
+				err = s.sendRegion(node.startLoc, node.startLoc+s.Config.BlockSize)
+			} else {
+				err = s.netManager.Send(messages.NewHashRequestMessage(node.startLoc, byte(node.level)))
+				s.requested = append(s.requested, node)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if len(s.requested) == 0 {
+			continue
+		}
+		err = s.refine(inChan)
+		if err != nil {
+			return err
+		}
+	}
+
+	//the top level hashes cover the whole file
+	size, sum := s.digest.Sum()
+	s.sourceSize = size
+	err = s.netManager.Send(messages.NewDigestMessage(configuration.DigestAlgorithm, size, sum))
+	if err != nil {
+		return err
+	}
+
+	err = s.netManager.Send(messages.NewEndMessage())
+	if err != nil {
+		return err
+	}
+	//wait the acknowledge from the destination
+	for msg := range inChan {
+		switch msg.GetMessageID() {
+		case messages.EndMessageID:
+			return nil
+		case messages.ErrorMessageID:
+			return s.netManager.MessageError(msg.(*messages.ErrorMessage))
+		default:
+			return fmt.Errorf("unexpected message type %d received by the source", msg.GetMessageID())
+		}
+	}
+	return closedError(s.netManager, "connection closed before the destination acknowledged the end of the sync")
+}
+
+// Receives the children hashes of the first requested node, compares them with the local ones
+func (s *sourceMerkle) refine(inChan chan messages.Message) error {
+	node := s.requested[0]
+	s.requested = s.requested[1:]
+	childLevel := node.level - 1
+	end := node.startLoc + s.tree.NodeSize(node.level)
+
+	//the children are at most Fanout, a single group
+	msg, ok := <-inChan
+	if !ok {
+		return closedError(s.netManager, "connection closed by the destination before the end of the sync")
+	}
+	switch msg.GetMessageID() {
+	case messages.HashGroupMessageID:
+	case messages.ErrorMessageID:
+		return s.netManager.MessageError(msg.(*messages.ErrorMessage))
+	default:
+		return fmt.Errorf("unexpected message type %d received by the source", msg.GetMessageID())
+	}
+	remote := msg.(*messages.HashGroupMessage)
+	if int(remote.Level) != childLevel || remote.StartLoc != node.startLoc || int(remote.NumHash) > len(remote.HashGroup) {
+		return errors.New("unexpected hash group received from the destination, out of order reply")
+	}
+	remoteHashes := remote.HashGroup[:remote.NumHash]
+
+	i := 0
+	err := s.tree.NodeHashes(s.sourceFile, node.startLoc, end, childLevel, func(startLoc int64, hash []byte) error {
+		child := merkleNode{startLoc, childLevel, hash}
+		if i < len(remoteHashes) {
+			s.compare(child, remoteHashes[i])
+		} else {
+			s.queue = append(s.queue, child)
+		}
+		i++
+		return nil
+	})
+	return err
+}
+
+// Matching nodes are done, the others are queued for refinement
+func (s *sourceMerkle) compare(local merkleNode, remoteHash []byte) {
+	if bytes.Equal(local.hash, remoteHash) {
+		end := local.startLoc + s.tree.NodeSize(local.level)
+		if end > s.sourceSize {
+			end = s.sourceSize
+		}
+		s.matchedBlocks += (end - local.startLoc + s.Config.BlockSize - 1) / s.Config.BlockSize
+		s.progress.AddMatched(end - local.startLoc)
+		s.progress.AddCompared(end - local.startLoc)
+		return
+	}
+	s.queue = append(s.queue, local)
+}
+
+// Sends the source blocks in [start, end)
+func (s *sourceMerkle) sendRegion(start int64, end int64) error {
+	for startLoc := start; startLoc < end; startLoc += s.Config.BlockSize {
+		data := make([]byte, s.Config.BlockSize)
+		n, err := s.sourceFile.ReadAt(data, startLoc)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		s.progress.AddCompared(int64(n))
+		if utils.IsZero(data[:n]) {
+			s.zeroBlocks++
+			err = s.zeros.add(s.netManager, startLoc, int64(n))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		err = s.zeros.flush(s.netManager)
+		if err != nil {
+			return err
+		}
+		err = s.netManager.Send(messages.NewDataBlockMessage(startLoc, data[:n]))
+		if err != nil {
+			return err
+		}
+		s.sentBlocks++
+		s.sentBytes += int64(n)
+		s.progress.AddTransferred(int64(n))
+	}
+	return s.zeros.flush(s.netManager)
+}
@@ -0,0 +1,161 @@
+package controller
+
+import (
+	"fmt"
+	"github.com/ftarlao/goblocksync/controller/routines"
+	"github.com/ftarlao/goblocksync/data/configuration"
+	"github.com/ftarlao/goblocksync/data/messages"
+	"github.com/ftarlao/goblocksync/utils/compression"
+	"github.com/ftarlao/goblocksync/utils/hashing"
+	"log/slog"
+	"strconv"
+	"sync"
+)
+
+// Slave connections. A connection carries one session at a time; when both the peers accept further sessions (hello
+// Sessions), the slave waits the configuration of the next session once a session completes, till the master closes
+// the streams. The pool shares the connections among the sessions of a master process, e.g. the jobs of a manifest:
+// a completed session returns its connection, which is reused by the next session with the same transport, hash and
+// compression options. The connections are opened on demand, the concurrent sessions have one each.
+
+// Connection to the slave, with the choices of its handshake
+type slaveConn struct {
+	netManager *routines.NetworkManager
+	// releases the slave resources once the streams are closed
+	wait      func() error
+	protocol  int
+	algorithm hashing.HashAlgorithm
+	codec     compression.Algorithm
+	// the slave accepts further sessions
+	sessions bool
+	// pool key of the connection options
+	key string
+}
+
+// Opens the streams to the slave and performs the handshake, user selected hash and compression algorithms are the
+// only advertised ones
+func openConn(config configuration.Configuration, logger *slog.Logger) (*slaveConn, error) {
+	in, out, wait, err := openSlave(config)
+	if err != nil {
+		return nil, err
+	}
+
+	//single network manager for the whole connection, the gob stream state lives inside it
+	netManager := routines.NewNetworkManager(config.EstimateNetworkChannelSize(), in, out)
+	netManager.SetChecksums(!config.NoChecksums)
+	err = netManager.Start()
+	if err != nil {
+		return nil, err
+	}
+	conn := &slaveConn{netManager: netManager, wait: wait, key: poolKey(config)}
+
+	hashes := hashing.Names()
+	if config.HashAlgorithm != "" {
+		hashes = []string{config.HashAlgorithm}
+	}
+	compressions := compression.Names()
+	if config.Compression != "" {
+		compressions = []string{config.Compression}
+	}
+	protocol, algorithm, codec, sessions, err := handshake(netManager, hashes, compressions)
+	if err != nil {
+		conn.close()
+		return nil, err
+	}
+	conn.protocol, conn.algorithm, conn.codec, conn.sessions = *protocol, algorithm, codec, sessions
+	logger.Info("Handshake completed", offsetAttr(0), "protocol", conn.protocol, "hash", algorithm.Name,
+		"compression", codec.Name)
+	return conn, nil
+}
+
+// Closes the streams and waits the slave
+func (c *slaveConn) close() error {
+	stopErr := c.netManager.Stop()
+	waitErr := c.wait()
+	if stopErr != nil {
+		return stopErr
+	}
+	return waitErr
+}
+
+// Options of the connection: transport, logging of the slave, checksums and advertised algorithms
+func poolKey(c configuration.Configuration) string {
+	return fmt.Sprintf("%q", []string{c.ConnectAddress, c.TLSCertFile, c.TLSKeyFile, c.TLSCAFile, c.TLSPin,
+		c.RemoteHost, c.RemoteShell, c.RemoteCommand, strconv.FormatBool(c.Verbose), c.LogFormat,
+		strconv.FormatBool(c.NoChecksums), c.HashAlgorithm, c.Compression})
+}
+
+// Idle connections shared by the sessions
+type SlavePool struct {
+	lock sync.Mutex
+	idle map[string][]*slaveConn
+}
+
+func NewSlavePool() *SlavePool {
+	return &SlavePool{idle: make(map[string][]*slaveConn)}
+}
+
+// Master of a session over the connections of the pool
+func (p *SlavePool) NewMaster(conf configuration.Configuration) master {
+	m := NewMaster(conf)
+	m.pool = p
+	return m
+}
+
+// Idle connection with the session options, a new connection when none is idle. The connections closed by their
+// slaves meanwhile are discarded
+func (p *SlavePool) acquire(config configuration.Configuration, logger *slog.Logger) (*slaveConn, error) {
+	key := poolKey(config)
+	var conn *slaveConn
+	var stale []*slaveConn
+	p.lock.Lock()
+	for conn == nil && len(p.idle[key]) > 0 {
+		conns := p.idle[key]
+		conn = conns[len(conns)-1]
+		p.idle[key] = conns[:len(conns)-1]
+		if !conn.netManager.IsRunning() {
+			stale = append(stale, conn)
+			conn = nil
+		}
+	}
+	p.lock.Unlock()
+	for _, c := range stale {
+		c.close()
+	}
+	if conn == nil {
+		return openConn(config, logger)
+	}
+	logger.Debug("Slave connection reused", offsetAttr(config.StartLoc))
+	return conn, nil
+}
+
+// Keeps the connection of a completed session for the next sessions, the connection is closed when the slave does not
+// accept further sessions
+func (p *SlavePool) release(conn *slaveConn) error {
+	if !conn.sessions {
+		return conn.close()
+	}
+	//the next session sets its own limits
+	conn.netManager.SetLimits(messages.DefaultLimits())
+	p.lock.Lock()
+	p.idle[conn.key] = append(p.idle[conn.key], conn)
+	p.lock.Unlock()
+	return nil
+}
+
+// Closes the idle connections, their slaves end. Returns the first failure
+func (p *SlavePool) Close() error {
+	p.lock.Lock()
+	idle := p.idle
+	p.idle = make(map[string][]*slaveConn)
+	p.lock.Unlock()
+	var err error
+	for _, conns := range idle {
+		for _, conn := range conns {
+			if closeErr := conn.close(); err == nil {
+				err = closeErr
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,121 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/ftarlao/goblocksync/utils"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Configuration file with named profiles of the options passed repeatedly, e.g.
+//
+//	{"DefaultProfile": "backup",
+//	 "Profiles": {"backup": {"Connect": "backup:7373", "BlockSize": "64K", "Hash": "sha256", "BandwidthLimit": "50M"},
+//	              "lan": {"RemoteShell": "ssh -p 2222", "RemoteCommand": "/opt/bin/goblocksync", "Compression": "none",
+//	                      "PreHook": "/opt/bin/snapshot create", "PostHook": "/opt/bin/snapshot remove"}}}
+//
+// The options of a profile are the job options of the manifests, hooks included; the command line options override
+// them.
+type ConfigFile struct {
+	// Profile used when none is selected, no profile when empty
+	DefaultProfile string
+	Profiles       map[string]JobOptions
+}
+
+// Reads the configuration file and returns the named profile, the default profile when name is empty. Unknown fields
+// are refused
+func LoadProfile(fileName string, name string) (JobOptions, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return JobOptions{}, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var c ConfigFile
+	err = decoder.Decode(&c)
+	if err != nil {
+		return JobOptions{}, fmt.Errorf("invalid configuration file %s: %w", fileName, err)
+	}
+	if name == "" {
+		name = c.DefaultProfile
+		if name == "" {
+			return JobOptions{}, nil
+		}
+	}
+	profile, ok := c.Profiles[name]
+	if !ok {
+		names := make([]string, 0, len(c.Profiles))
+		for n := range c.Profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return JobOptions{}, errors.New("unknown profile " + name + " in " + fileName + ", available: " +
+			strings.Join(names, ", "))
+	}
+	return profile, nil
+}
+
+// Sets the flags not provided on the command line to the options, -e counts as -rsh. The options whose flag is not
+// defined in flags are ignored
+func (o JobOptions) ApplyToFlags(flags *flag.FlagSet) error {
+	provided := make(map[string]bool)
+	flags.Visit(func(fl *flag.Flag) {
+		provided[fl.Name] = true
+	})
+	provided["rsh"] = provided["rsh"] || provided["e"]
+	for name, value := range o.flagValues() {
+		if provided[name] || flags.Lookup(name) == nil {
+			continue
+		}
+		err := flags.Set(name, value)
+		if err != nil {
+			return fmt.Errorf("profile option -%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Flag values of the options that are set
+func (o JobOptions) flagValues() map[string]string {
+	values := make(map[string]string)
+	setString := func(name string, value string) {
+		if value != "" {
+			values[name] = value
+		}
+	}
+	setSize := func(name string, value utils.Size) {
+		if value != 0 {
+			values[name] = strconv.FormatInt(int64(value), 10)
+		}
+	}
+	setSize("block-size", o.BlockSize)
+	setString("mode", o.Mode)
+	setString("hash", o.Hash)
+	if o.HashWorkers != 0 {
+		values["hash-workers"] = strconv.Itoa(o.HashWorkers)
+	}
+	setString("compress", o.Compression)
+	setSize("bwlimit", o.BandwidthLimit)
+	setSize("bwburst", o.BandwidthBurst)
+	setString("size-policy", o.SizePolicy)
+	if o.Sparse != nil {
+		values["sparse"] = strconv.FormatBool(*o.Sparse)
+	}
+	setString("journal", o.Journal)
+	setString("pre-hook", o.PreHook)
+	setString("post-hook", o.PostHook)
+	setString("connect", o.Connect)
+	setString("rsh", o.RemoteShell)
+	setString("remote-path", o.RemoteCommand)
+	setString("tls-cert", o.TLSCert)
+	setString("tls-key", o.TLSKey)
+	setString("tls-ca", o.TLSCA)
+	setString("tls-pin", o.TLSPin)
+	return values
+}
@@ -1,86 +1,236 @@
 package controller
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"github.com/ftarlao/goblocksync/controller/routines"
 	"github.com/ftarlao/goblocksync/data/configuration"
 	"github.com/ftarlao/goblocksync/data/messages"
+	"github.com/ftarlao/goblocksync/utils"
+	"github.com/ftarlao/goblocksync/utils/hashing"
 	"io"
 	"os"
+	"sync"
 )
 
+// Protocol V1, the destination hashes its blocks and sends the HashGroupMessages to the source. The source hashes
+// its own blocks and compares them position-by-position, it replies with a DataBlockMessage for each mismatching
+// block. When the destination hash stream ends (EndMessage) the source sends the blocks the destination is missing,
+// followed by an EndMessage. The destination applies the blocks and acknowledges the EndMessage with its own
+// EndMessage; an ErrorMessage from any peer aborts the session.
+
 //DESTINATION
 
 type Destination interface {
 	GetConfig() configuration.Configuration
 	Start() error
+	GetProgress() *routines.Progress
 }
 
 type destinationV1 struct {
-	Config        configuration.Configuration
-	startPosition int64
-	in            io.Reader
-	out           io.Writer
+	Config     configuration.Configuration
+	netManager *routines.NetworkManager
+	progress   *routines.Progress
+	// Whole-file digest of the source, checked after the writes before reconciling the size
+	sourceDigest *messages.DigestMessage
 }
 
-func (s destinationV1) GetConfig() configuration.Configuration {
-	return s.Config
+func (d *destinationV1) GetConfig() configuration.Configuration {
+	return d.Config
 }
 
-func (d destinationV1) Start() error {
+func (d *destinationV1) GetProgress() *routines.Progress {
+	return d.progress
+}
 
-	f, err := os.Open(d.Config.DestinationFile.FileName)
-	if err != nil {
-		fmt.Println(err)
+func (d *destinationV1) Start() error {
+	if d.Config.DryRun {
+		err := d.diff()
+		if err != nil {
+			d.netManager.Send(messages.NewErrorMessage(err))
+		}
 		return err
 	}
 
-	//Prepare data Pipes
-	_, outEncoder := routines.EncoderInOut(d.in, d.out)
+	f, err := routines.OpenWritable(d.Config.DestinationFile.FileName)
+	if err != nil {
+		d.netManager.Send(messages.NewErrorMessage(err))
+		return err
+	}
+	defer f.Close()
+	//size before the sync, for the size policy
+	err = d.Config.DestinationFile.UpdateFile(f)
+	if err != nil {
+		d.netManager.Send(messages.NewErrorMessage(err))
+		return err
+	}
 
 	// Start hasher
-	hasher := routines.NewHasherImpl(d.Config.BlockSize, f, d.Config.StartLoc, routines.DummyHash)
+	algorithm, err := hashAlgorithm(d.Config)
+	if err != nil {
+		d.netManager.Send(messages.NewErrorMessage(err))
+		return err
+	}
+	hasher := routines.NewHasherImplAlgorithm(d.Config.BlockSize, f, d.Config.StartLoc, algorithm, d.Config.HashWorkers)
 	err = hasher.Start()
 	if err != nil {
-		fmt.Println(err)
+		d.netManager.Send(messages.NewErrorMessage(err))
+		return err
+	}
+	defer hasher.Stop()
+	d.progress.SetHasher(hasher, d.Config.StartLoc)
+
+	// Start writer, blocks are applied by a dedicated goroutine
+	writer, err := newDestinationWriter(d.Config, f)
+	if err != nil {
+		d.netManager.Send(messages.NewErrorMessage(err))
+		return err
+	}
+	err = writer.Start()
+	if err != nil {
+		d.netManager.Send(messages.NewErrorMessage(err))
+		return err
 	}
+	defer writer.Stop()
+	d.progress.SetWriter(writer)
 
-	//Network flow Handler, single point (and thread) to send and receive messages
-	//Should be split in two goroutines or we should add bigger buffers for Pipe Writer/Reader
-	hashChan := hasher.GetOutMsgChannel()
-	count := 0
-	//Separate in different goroutines.. gosh
-_:
+	// hashes and checkpoints are sent by a dedicated goroutine, the source may be busy sending blocks and the main loop
+	// should always receive them
+	checkpoints := make(chan messages.Message, 3)
+	sender := startSender(func(done chan bool) error {
+		return forwardToSource(d.netManager, hasher.GetOutMsgChannel(), checkpoints, done)
+	})
+	defer sender.stop()
+
+	inChan := d.netManager.GetInMsgChannel()
+	writerIn := writer.GetInMsgChannel()
+	writerOut := writer.GetOutMsgChannel()
 	for {
-		//send
 		select {
-		case hashMsg := <-hashChan:
-			messages.EncodeMessage(outEncoder, hashMsg)
-			//utils.DoNothing(hashMsg)
-			count++
-		default:
-
+		case err = <-sender.err:
+			return err
+		case writerMsg := <-writerOut:
+			switch writerMsg.GetMessageID() {
+			case messages.EndMessageID:
+				//all the blocks have been written and synced
+				summary, err := completeDestination(d.Config, f, d.sourceDigest)
+				if err != nil {
+					d.netManager.Send(messages.NewErrorMessage(err))
+					return err
+				}
+				reportSize(d.Config, d.progress, summary)
+				//no checkpoint follows the acknowledge, the streams may carry the next session
+				sender.stop()
+				return d.netManager.Send(writerMsg)
+			case messages.CheckpointMessageID:
+				if d.Config.IsMaster {
+					err = saveCheckpoint(d.Config, writerMsg.(*messages.CheckpointMessage).Loc)
+					if err != nil {
+						d.netManager.Send(messages.NewErrorMessage(err))
+						return err
+					}
+					continue
+				}
+				select {
+				case checkpoints <- writerMsg:
+				default:
+					//the sender is late, a later checkpoint supersedes this one
+				}
+				continue
+			}
+			//write errors are reported to the source
+			err = errors.New(writerMsg.(*messages.ErrorMessage).Err)
+			d.netManager.Send(writerMsg)
+			return err
+		case msg, ok := <-inChan:
+			if !ok {
+				return closedError(d.netManager, "connection closed by the source before the end of the sync")
+			}
+			switch msg.GetMessageID() {
+			case messages.DataBlockMessageID, messages.ZeroBlockMessageID, messages.CheckpointMessageID, messages.EndMessageID:
+				if dataMsg, ok := msg.(*messages.DataBlockMessage); ok {
+					d.progress.AddTransferred(int64(len(dataMsg.Data)))
+				}
+				//the writer never blocks on output, it consumes the whole input even after a failure
+				writerIn <- msg
+			case messages.DigestMessageID:
+				d.sourceDigest = msg.(*messages.DigestMessage)
+			case messages.ErrorMessageID:
+				return d.netManager.MessageError(msg.(*messages.ErrorMessage))
+			default:
+				err = fmt.Errorf("unexpected message type %d received by the destination", msg.GetMessageID())
+				d.netManager.Send(messages.NewErrorMessage(err))
+				return err
+			}
 		}
+	}
+}
 
-		//receive
+// Sends the hasher output and the checkpoints to the source till done, hasher errors are reported to the source too
+func forwardToSource(netManager *routines.NetworkManager, hashChan chan messages.Message, checkpoints chan messages.Message, done chan bool) error {
+	for {
+		var msg messages.Message
 		select {
-		default:
-
+		case msg = <-hashChan:
+		case msg = <-checkpoints:
+		case <-done:
+			return nil
 		}
-
-		if d.Config.IsMaster {
-			fmt.Println("Blocks: ", count)
+		err := netManager.SendUntil(msg, done)
+		if err != nil {
+			return err
+		}
+		switch msg.GetMessageID() {
+		case messages.EndMessageID:
+			//no more hashes, only checkpoints from now on
+			hashChan = nil
+		case messages.ErrorMessageID:
+			return errors.New(msg.(*messages.ErrorMessage).Err)
 		}
 	}
+}
 
-	return err
+// Goroutine sending messages to the peer for a role, the role stops it and waits its exit before returning
+type sender struct {
+	done    chan bool
+	once    sync.Once
+	stopped chan bool
+	// Result of the send function
+	err chan error
 }
 
-func NewDestination(config configuration.Configuration, protocolVersion int, in io.Reader, out io.Writer) (d Destination, err error) {
+// Runs send in a dedicated goroutine, send returns soon after done is closed
+func startSender(send func(done chan bool) error) *sender {
+	s := &sender{done: make(chan bool), stopped: make(chan bool), err: make(chan error, 1)}
+	go func() {
+		defer close(s.stopped)
+		s.err <- send(s.done)
+	}()
+	return s
+}
+
+// Stops the sender and waits its exit, once stopped the next calls return at once
+func (s *sender) stop() {
+	s.once.Do(func() {
+		close(s.done)
+	})
+	<-s.stopped
+}
+
+func NewDestination(config configuration.Configuration, protocolVersion int, netManager *routines.NetworkManager) (d Destination, err error) {
 	switch protocolVersion {
-	case 1:
-		d = destinationV1{Config: config, in: in, out: out}
+	case configuration.ProtocolGob, configuration.ProtocolBinary:
+		if config.Verify {
+			return &verifier{Config: config, netManager: netManager, progress: routines.NewProgress(false)}, nil
+		}
+		switch config.Mode {
+		case configuration.ModeMerkle:
+			return &destinationMerkle{Config: config, netManager: netManager, progress: routines.NewProgress(false)}, nil
+		case configuration.ModeRolling:
+			return &destinationRolling{Config: config, netManager: netManager, progress: routines.NewProgress(false)}, nil
+		}
+		d = &destinationV1{Config: config, netManager: netManager, progress: routines.NewProgress(false)}
 	default:
 		return nil, errors.New("protocol version not supported (mismatch between declared versions and available versions)")
 	}
@@ -92,63 +242,348 @@ func NewDestination(config configuration.Configuration, protocolVersion int, in
 type Source interface {
 	GetConfig() configuration.Configuration
 	Start() error
+	GetProgress() *routines.Progress
 }
 
 type sourceV1 struct {
 	Config     configuration.Configuration
 	sourceFile *os.File
-	in         io.Reader
-	out        io.Writer
+	netManager *routines.NetworkManager
+	progress   *routines.Progress
+	// Output channel of the local hasher, nil when the local hashes are over
+	localChan chan messages.Message
+	// Size of the hashes of the negotiated algorithm [bytes]
+	hashSize int
+	// Number of blocks with matching hashes
+	matchedBlocks int64
+	// Number of blocks (and bytes) sent to the destination
+	sentBlocks int64
+	sentBytes  int64
+	// Number of zero blocks sent as ZeroBlockMessages, and the pending zero region
+	zeroBlocks int64
+	zeros      zeroRange
+	// Location of the last checkpoint sent to the destination
+	lastCheckpoint int64
+	// Differing blocks of the dry run, nil when syncing
+	report     *DiffReport
+	sourceSize int64
+	// Whole-file digest of the source, computed by the hasher reads (nil in a dry run)
+	digest *routines.DigestReader
 }
 
-func (s sourceV1) GetConfig() configuration.Configuration {
+func (s *sourceV1) GetConfig() configuration.Configuration {
 	return s.Config
 }
 
-func (s sourceV1) Start() error {
+func (s *sourceV1) GetProgress() *routines.Progress {
+	return s.progress
+}
 
-	f, err := os.Open(s.Config.SourceFile.FileName)
+func (s *sourceV1) Start() error {
+	err := s.sync()
 	if err != nil {
+		s.netManager.Send(messages.NewErrorMessage(err))
 		return err
 	}
+	s.progress.Finish()
+	if s.Config.IsMaster && s.report != nil {
+		return s.report.Write(os.Stdout, s.Config.ReportFormat)
+	}
+	if s.Config.IsMaster && !s.Config.NoSummary {
+		fmt.Println("Matching blocks:\t", s.matchedBlocks)
+		fmt.Println("Transferred blocks:\t", s.sentBlocks, "(", s.sentBytes, "bytes )")
+		fmt.Println("Zero blocks:\t\t", s.zeroBlocks)
+		fmt.Println("Destination size:\t", describeSize(s.Config, s.sourceSize))
+		fmt.Println("Verified bytes:\t\t", s.sourceSize, "(", configuration.DigestAlgorithm, ")")
+	}
+	return nil
+}
 
-	//Prepare data Pipes
-	inDecoder, _ := routines.EncoderInOut(s.in, s.out)
+func (s *sourceV1) sync() error {
+
+	f, err := os.Open(s.Config.SourceFile.FileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s.sourceFile = f
+	err = s.Config.SourceFile.UpdateFile(f)
+	if err != nil {
+		return err
+	}
+	s.sourceSize = s.Config.SourceFile.Size
+	s.progress.SetTotal(s.sourceSize - s.Config.StartLoc)
+	if s.Config.DryRun {
+		s.report = NewDiffReport(s.Config)
+	}
 
 	// Start hasher
-	hasher := routines.NewHasherImpl(s.Config.BlockSize, f, s.Config.StartLoc, routines.DummyHash)
+	algorithm, err := hashAlgorithm(s.Config)
+	if err != nil {
+		return err
+	}
+	s.hashSize = algorithm.Size
+	s.lastCheckpoint = s.Config.StartLoc
+	var hasherFile io.ReadSeeker = f
+	if s.report == nil {
+		digest, err := digestAlgorithm()
+		if err != nil {
+			return err
+		}
+		s.digest = routines.NewDigestReader(f, digest)
+		hasherFile = s.digest
+	}
+	hasher := routines.NewHasherImplAlgorithm(s.Config.BlockSize, hasherFile, s.Config.StartLoc, algorithm, s.Config.HashWorkers)
 	err = hasher.Start()
 	if err != nil {
-		fmt.Println(err)
+		return err
 	}
+	defer hasher.Stop()
+	s.progress.SetHasher(hasher, s.Config.StartLoc)
+	s.localChan = hasher.GetOutMsgChannel()
 
-	//Network flow Handler, single point (and thread) to send and receive messages
-	//Should be split in two goroutines or we should add bigger buffers for Pipe Writer/Reader
-	//hashChan := hasher.GetOutMsgChannel()
+	inChan := s.netManager.GetInMsgChannel()
+	var local *messages.HashGroupMessage
+	for remoteEnded := false; !remoteEnded; {
+		msg, ok := <-inChan
+		if !ok {
+			return closedError(s.netManager, "connection closed by the destination before the end of the sync")
+		}
+		switch msg.GetMessageID() {
+		case messages.HashGroupMessageID:
+			remote := msg.(*messages.HashGroupMessage)
+			err = s.checkHashGroup(remote)
+			if err != nil {
+				return err
+			}
+			s.progress.SetHashedRemote(remote.StartLoc + int64(remote.NumHash)*s.Config.BlockSize - s.Config.StartLoc)
+			//groups are aligned on both sides, skipped local groups (defensive) are missing on the destination
+			for {
+				if local == nil {
+					local, err = s.nextLocalGroup()
+					if err != nil {
+						return err
+					}
+				}
+				if local == nil || local.StartLoc >= remote.StartLoc {
+					break
+				}
+				err = s.sendMismatching(local, nil)
+				if err != nil {
+					return err
+				}
+				local = nil
+			}
+			if local != nil && local.StartLoc == remote.StartLoc {
+				err = s.sendMismatching(local, remote)
+				if err != nil {
+					return err
+				}
+				err = s.checkpoint(local.StartLoc + int64(local.NumHash)*s.Config.BlockSize)
+				if err != nil {
+					return err
+				}
+				local = nil
+			}
+		case messages.CheckpointMessageID:
+			err = s.confirmCheckpoint(msg.(*messages.CheckpointMessage))
+			if err != nil {
+				return err
+			}
+		case messages.EndMessageID:
+			remoteEnded = true
+		case messages.ErrorMessageID:
+			return s.netManager.MessageError(msg.(*messages.ErrorMessage))
+		default:
+			return fmt.Errorf("unexpected message type %d received by the source", msg.GetMessageID())
+		}
+	}
 
-	count := 0
-_:
+	//the destination is shorter, all the remaining blocks are sent
 	for {
-		//send
-		m, err := messages.DecodeMessage(inDecoder)
+		if local == nil {
+			local, err = s.nextLocalGroup()
+			if err != nil {
+				return err
+			}
+			if local == nil {
+				break
+			}
+		}
+		err = s.sendMismatching(local, nil)
+		if err != nil {
+			return err
+		}
+		err = s.checkpoint(local.StartLoc + int64(local.NumHash)*s.Config.BlockSize)
+		if err != nil {
+			return err
+		}
+		local = nil
+	}
+
+	//the master destination reports the dry run
+	if s.report != nil && !s.Config.IsMaster {
+		for _, e := range s.report.Extents {
+			err = s.netManager.Send(messages.NewExtentMessage(e.Start, e.Length))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	//the hasher has read the whole file
+	if s.digest != nil {
+		size, digest := s.digest.Sum()
+		s.sourceSize = size
+		err = s.netManager.Send(messages.NewDigestMessage(configuration.DigestAlgorithm, size, digest))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = s.netManager.Send(messages.NewEndMessage())
+	if err != nil {
+		return err
+	}
+	//wait the acknowledge from the destination
+	for msg := range inChan {
+		switch msg.GetMessageID() {
+		case messages.CheckpointMessageID:
+			err = s.confirmCheckpoint(msg.(*messages.CheckpointMessage))
+			if err != nil {
+				return err
+			}
+		case messages.EndMessageID:
+			return nil
+		case messages.ErrorMessageID:
+			return s.netManager.MessageError(msg.(*messages.ErrorMessage))
+		default:
+			return fmt.Errorf("unexpected message type %d received by the source", msg.GetMessageID())
+		}
+	}
+	return closedError(s.netManager, "connection closed before the destination acknowledged the end of the sync")
+}
+
+// Sends a checkpoint when the journal is enabled and the blocks before loc are far enough from the last checkpoint
+func (s *sourceV1) checkpoint(loc int64) error {
+	if s.Config.JournalFile == "" || loc-s.lastCheckpoint < configuration.CheckpointInterval {
+		return nil
+	}
+	s.lastCheckpoint = loc
+	return s.netManager.Send(messages.NewCheckpointMessage(loc))
+}
+
+// Checkpoints confirmed by the destination are recorded in the journal by the master
+func (s *sourceV1) confirmCheckpoint(checkpoint *messages.CheckpointMessage) error {
+	if !s.Config.IsMaster {
+		return nil
+	}
+	return saveCheckpoint(s.Config, checkpoint.Loc)
+}
+
+// Hashes provided by the destination should have the size of the negotiated algorithm
+func (s *sourceV1) checkHashGroup(remote *messages.HashGroupMessage) error {
+	if int(remote.NumHash) > len(remote.HashGroup) {
+		return errors.New("malformed hash group received from the destination")
+	}
+	for _, h := range remote.HashGroup[:remote.NumHash] {
+		if len(h) != s.hashSize {
+			return fmt.Errorf("hash size mismatch, received %d bytes, expected %d bytes", len(h), s.hashSize)
+		}
+	}
+	return nil
+}
+
+// Returns the next HashGroupMessage of the local hasher, nil when the local hashes are over
+func (s *sourceV1) nextLocalGroup() (*messages.HashGroupMessage, error) {
+	if s.localChan == nil {
+		return nil, nil
+	}
+	msg := <-s.localChan
+	switch msg.GetMessageID() {
+	case messages.HashGroupMessageID:
+		return msg.(*messages.HashGroupMessage), nil
+	case messages.EndMessageID:
+		s.localChan = nil
+		return nil, nil
+	case messages.ErrorMessageID:
+		return nil, errors.New(msg.(*messages.ErrorMessage).Err)
+	default:
+		return nil, fmt.Errorf("unexpected message type %d provided by the hasher", msg.GetMessageID())
+	}
+}
+
+// Compares the local hash group with the remote one (same StartLoc), the local blocks without a matching remote hash
+// are sent to the destination (added to the report in a dry run). A nil remote group means all the blocks are sent
+func (s *sourceV1) sendMismatching(local *messages.HashGroupMessage, remote *messages.HashGroupMessage) error {
+	for i := 0; i < int(local.NumHash); i++ {
+		startLoc := local.StartLoc + int64(i)*s.Config.BlockSize
+		size := utils.IntMin(s.Config.BlockSize, s.sourceSize-startLoc)
+		s.progress.AddCompared(size)
+		if remote != nil && i < int(remote.NumHash) && bytes.Equal(local.HashGroup[i], remote.HashGroup[i]) {
+			s.matchedBlocks++
+			s.progress.AddMatched(size)
+			continue
+		}
+		if s.report != nil {
+			s.report.Add(startLoc, size)
+			continue
+		}
+		data := make([]byte, s.Config.BlockSize)
+		n, err := s.sourceFile.ReadAt(data, startLoc)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if n == 0 {
+			continue
+		}
+		if utils.IsZero(data[:n]) {
+			s.zeroBlocks++
+			err = s.zeros.add(s.netManager, startLoc, int64(n))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		err = s.zeros.flush(s.netManager)
 		if err != nil {
 			return err
 		}
-		hashMsg := m.(*messages.HashGroupMessage)
-		hashMsg.StartLoc = 1
-		count++
-		if s.Config.IsMaster {
-			fmt.Println("Blocks: ", count)
+		err = s.netManager.Send(messages.NewDataBlockMessage(startLoc, data[:n]))
+		if err != nil {
+			return err
 		}
+		s.sentBlocks++
+		s.sentBytes += int64(n)
+		s.progress.AddTransferred(int64(n))
 	}
+	return s.zeros.flush(s.netManager)
+}
 
-	return err
+// Hash algorithm negotiated during the handshake
+func hashAlgorithm(config configuration.Configuration) (hashing.HashAlgorithm, error) {
+	algorithm, ok := hashing.Get(config.HashAlgorithm)
+	if !ok {
+		return algorithm, errors.New("no valid negotiated hash algorithm in the configuration")
+	}
+	return algorithm, nil
 }
 
-func NewSource(config configuration.Configuration, protocolVersion int, in io.Reader, out io.Writer) (s Source, err error) {
+func NewSource(config configuration.Configuration, protocolVersion int, netManager *routines.NetworkManager) (s Source, err error) {
+	progress := routines.NewProgress(true)
+	progress.SetNetworkManager(netManager)
 	switch protocolVersion {
-	case 1:
-		s = sourceV1{Config: config, in: in, out: out}
+	case configuration.ProtocolGob, configuration.ProtocolBinary:
+		if config.Verify {
+			return &verifier{Config: config, netManager: netManager, progress: routines.NewProgress(true)}, nil
+		}
+		switch config.Mode {
+		case configuration.ModeMerkle:
+			return &sourceMerkle{Config: config, netManager: netManager, progress: progress}, nil
+		case configuration.ModeRolling:
+			return &sourceRolling{Config: config, netManager: netManager, progress: progress}, nil
+		}
+		s = &sourceV1{Config: config, netManager: netManager, progress: progress}
 	default:
 		return nil, errors.New("protocol version not supported (mismatch between declared versions and available versions)")
 	}
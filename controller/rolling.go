@@ -0,0 +1,355 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ftarlao/goblocksync/controller/routines"
+	"github.com/ftarlao/goblocksync/data/configuration"
+	"github.com/ftarlao/goblocksync/data/messages"
+	"github.com/ftarlao/goblocksync/utils/hashing"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Rolling checksum mode (protocol V1), for regular files whose content may shift. The destination sends the
+// signatures of its blocks (weak rolling checksum followed by the strong hash) as HashGroupMessages, followed by an
+// EndMessage. The source scans its file with a rolling window and sends DeltaMessages, copy instructions for the
+// windows found in the destination and literal data for the other bytes, followed by an EndMessage. The destination
+// builds the new file in a temporary file next to the old one, then replaces the old file and acknowledges the
+// EndMessage.
+
+//DESTINATION
+
+type destinationRolling struct {
+	Config     configuration.Configuration
+	netManager *routines.NetworkManager
+	progress   *routines.Progress
+	// Whole-file digest of the source, checked on the new file before replacing the old one
+	sourceDigest *messages.DigestMessage
+}
+
+func (d *destinationRolling) GetConfig() configuration.Configuration {
+	return d.Config
+}
+
+func (d *destinationRolling) GetProgress() *routines.Progress {
+	return d.progress
+}
+
+func (d *destinationRolling) Start() error {
+	err := d.sync()
+	if err != nil {
+		d.netManager.Send(messages.NewErrorMessage(err))
+	}
+	return err
+}
+
+func (d *destinationRolling) sync() error {
+	algorithm, err := hashAlgorithm(d.Config)
+	if err != nil {
+		return err
+	}
+	fileName := d.Config.DestinationFile.FileName
+	fileMode := os.FileMode(0644)
+	old, err := os.Open(fileName)
+	if err == nil {
+		defer old.Close()
+		fileInfo, err := old.Stat()
+		if err != nil {
+			return err
+		}
+		if !fileInfo.Mode().IsRegular() {
+			return errors.New("rolling mode requires a regular destination file")
+		}
+		fileMode = fileInfo.Mode().Perm()
+		d.Config.DestinationFile.Size = fileInfo.Size()
+	} else if os.IsNotExist(err) {
+		old = nil
+	} else {
+		return err
+	}
+
+	// the old file signatures, the source does not send deltas before the EndMessage
+	sender := startSender(func(done chan bool) error {
+		return d.sendSignatures(old, algorithm, done)
+	})
+	defer sender.stop()
+	signaturesErr := sender.err
+
+	tmp, err := os.CreateTemp(filepath.Dir(fileName), "."+filepath.Base(fileName)+".goblocksync-")
+	if err != nil {
+		return err
+	}
+	replaced := false
+	defer func() {
+		tmp.Close()
+		if !replaced {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	writer := routines.NewWriterImpl(tmp, int(configuration.WriteMaxBytes/d.Config.BlockSize), configuration.WriteCoalesceMaxBytes)
+	err = writer.Start()
+	if err != nil {
+		return err
+	}
+	defer writer.Stop()
+	d.progress.SetWriter(writer)
+
+	inChan := d.netManager.GetInMsgChannel()
+	writerIn := writer.GetInMsgChannel()
+	writerOut := writer.GetOutMsgChannel()
+	for {
+		select {
+		case err = <-signaturesErr:
+			if err != nil {
+				return err
+			}
+			signaturesErr = nil
+		case writerMsg := <-writerOut:
+			if writerMsg.GetMessageID() != messages.EndMessageID {
+				return errors.New(writerMsg.(*messages.ErrorMessage).Err)
+			}
+			//the new file is complete and synced
+			if d.sourceDigest != nil {
+				err = checkDigest(tmp, d.sourceDigest)
+				if err != nil {
+					return err
+				}
+			}
+			err = tmp.Chmod(fileMode)
+			if err != nil {
+				return err
+			}
+			err = tmp.Close()
+			if err != nil {
+				return err
+			}
+			err = os.Rename(tmp.Name(), fileName)
+			if err != nil {
+				return err
+			}
+			replaced = true
+			if d.sourceDigest != nil {
+				reportSize(d.Config, d.progress, describeSize(d.Config, d.sourceDigest.Size))
+			}
+			return d.netManager.Send(writerMsg)
+		case msg, ok := <-inChan:
+			if !ok {
+				return closedError(d.netManager, "connection closed by the source before the end of the sync")
+			}
+			switch msg.GetMessageID() {
+			case messages.DeltaMessageID:
+				delta := msg.(*messages.DeltaMessage)
+				if delta.IsLiteral() {
+					d.progress.AddTransferred(delta.Length)
+					writerIn <- messages.NewDataBlockMessage(delta.StartLoc, delta.Data)
+					continue
+				}
+				err = d.copyBlocks(old, delta, writerIn)
+				if err != nil {
+					return err
+				}
+			case messages.EndMessageID:
+				writerIn <- msg
+			case messages.DigestMessageID:
+				d.sourceDigest = msg.(*messages.DigestMessage)
+			case messages.ErrorMessageID:
+				return d.netManager.MessageError(msg.(*messages.ErrorMessage))
+			default:
+				return fmt.Errorf("unexpected message type %d received by the destination", msg.GetMessageID())
+			}
+		}
+	}
+}
+
+// Sends the signatures of the old file blocks followed by an EndMessage, only the EndMessage when there is no old file.
+// The sending gives up when done is closed
+func (d *destinationRolling) sendSignatures(old *os.File, algorithm hashing.HashAlgorithm, done chan bool) error {
+	if old == nil {
+		return d.netManager.SendUntil(messages.NewEndMessage(), done)
+	}
+	hasher := routines.NewHasherImplWorkers(d.Config.BlockSize, old, 0, func(data []byte, _ int) []byte {
+		return routines.BlockSignature(data, algorithm)
+	}, d.Config.HashWorkers)
+	err := hasher.Start()
+	if err != nil {
+		return err
+	}
+	defer hasher.Stop()
+	d.progress.SetHasher(hasher, 0)
+	hashChan := hasher.GetOutMsgChannel()
+	for {
+		var msg messages.Message
+		var ok bool
+		select {
+		case msg, ok = <-hashChan:
+			if !ok {
+				return errors.New("hasher stopped before the end of the file")
+			}
+		case <-done:
+			return nil
+		}
+		switch msg.GetMessageID() {
+		case messages.ErrorMessageID:
+			return errors.New(msg.(*messages.ErrorMessage).Err)
+		case messages.EndMessageID:
+			return d.netManager.SendUntil(msg, done)
+		}
+		err = d.netManager.SendUntil(msg, done)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Copies the delta region of the old file into the new one, block by block
+func (d *destinationRolling) copyBlocks(old *os.File, delta *messages.DeltaMessage, writerIn chan messages.Message) error {
+	if old == nil || delta.CopyLoc < 0 || delta.Length <= 0 {
+		return errors.New("invalid copy instruction received from the source")
+	}
+	for done := int64(0); done < delta.Length; done += d.Config.BlockSize {
+		size := d.Config.BlockSize
+		if delta.Length-done < size {
+			size = delta.Length - done
+		}
+		data := make([]byte, size)
+		_, err := old.ReadAt(data, delta.CopyLoc+done)
+		if err == io.EOF {
+			return errors.New("copy instruction beyond the end of the destination file")
+		} else if err != nil {
+			return err
+		}
+		writerIn <- messages.NewDataBlockMessage(delta.StartLoc+done, data)
+	}
+	return nil
+}
+
+//SOURCE
+
+type sourceRolling struct {
+	Config     configuration.Configuration
+	netManager *routines.NetworkManager
+	progress   *routines.Progress
+	// Bytes copied from the destination file
+	copiedBytes int64
+	// Literal bytes sent to the destination
+	sentBytes int64
+	// Size of the source file, digested by the delta scan
+	sourceSize int64
+}
+
+func (s *sourceRolling) GetConfig() configuration.Configuration {
+	return s.Config
+}
+
+func (s *sourceRolling) GetProgress() *routines.Progress {
+	return s.progress
+}
+
+func (s *sourceRolling) Start() error {
+	err := s.sync()
+	if err != nil {
+		s.netManager.Send(messages.NewErrorMessage(err))
+		return err
+	}
+	s.progress.Finish()
+	if s.Config.IsMaster && !s.Config.NoSummary {
+		fmt.Println("Copied bytes:\t\t", s.copiedBytes)
+		fmt.Println("Transferred bytes:\t", s.sentBytes)
+		fmt.Println("Destination size:\t", describeSize(s.Config, s.sourceSize))
+		fmt.Println("Verified bytes:\t\t", s.sourceSize, "(", configuration.DigestAlgorithm, ")")
+	}
+	return nil
+}
+
+func (s *sourceRolling) sync() error {
+	algorithm, err := hashAlgorithm(s.Config)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(s.Config.SourceFile.FileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = s.Config.SourceFile.UpdateFile(f)
+	if err != nil {
+		return err
+	}
+	s.progress.SetTotal(s.Config.SourceFile.Size)
+
+	// destination signatures
+	index := routines.NewSignatureIndex(s.Config.BlockSize, algorithm)
+	inChan := s.netManager.GetInMsgChannel()
+	for remoteEnded := false; !remoteEnded; {
+		msg, ok := <-inChan
+		if !ok {
+			return closedError(s.netManager, "connection closed by the destination before the end of the sync")
+		}
+		switch msg.GetMessageID() {
+		case messages.HashGroupMessageID:
+			remote := msg.(*messages.HashGroupMessage)
+			if int(remote.NumHash) > len(remote.HashGroup) {
+				return errors.New("malformed hash group received from the destination")
+			}
+			for i := 0; i < int(remote.NumHash); i++ {
+				err = index.Add(remote.StartLoc+int64(i)*s.Config.BlockSize, remote.HashGroup[i])
+				if err != nil {
+					return err
+				}
+			}
+		case messages.EndMessageID:
+			remoteEnded = true
+		case messages.ErrorMessageID:
+			return s.netManager.MessageError(msg.(*messages.ErrorMessage))
+		default:
+			return fmt.Errorf("unexpected message type %d received by the source", msg.GetMessageID())
+		}
+	}
+
+	digest, err := digestAlgorithm()
+	if err != nil {
+		return err
+	}
+	digestReader := routines.NewDigestReader(f, digest)
+	err = routines.DeltaScan(digestReader, index, s.Config.BlockSize, func(delta *messages.DeltaMessage) error {
+		if delta.IsLiteral() {
+			s.sentBytes += delta.Length
+			s.progress.AddTransferred(delta.Length)
+		} else {
+			s.copiedBytes += delta.Length
+			s.progress.AddMatched(delta.Length)
+		}
+		s.progress.AddCompared(delta.Length)
+		return s.netManager.Send(delta)
+	})
+	if err != nil {
+		return err
+	}
+
+	size, sum := digestReader.Sum()
+	s.sourceSize = size
+	err = s.netManager.Send(messages.NewDigestMessage(configuration.DigestAlgorithm, size, sum))
+	if err != nil {
+		return err
+	}
+
+	err = s.netManager.Send(messages.NewEndMessage())
+	if err != nil {
+		return err
+	}
+	//wait the acknowledge from the destination
+	for msg := range inChan {
+		switch msg.GetMessageID() {
+		case messages.EndMessageID:
+			return nil
+		case messages.ErrorMessageID:
+			return s.netManager.MessageError(msg.(*messages.ErrorMessage))
+		default:
+			return fmt.Errorf("unexpected message type %d received by the source", msg.GetMessageID())
+		}
+	}
+	return closedError(s.netManager, "connection closed before the destination acknowledged the end of the sync")
+}
@@ -0,0 +1,121 @@
+package routines
+
+import (
+	"errors"
+	"github.com/ftarlao/goblocksync/data/configuration"
+	"io"
+	"sync"
+	"time"
+)
+
+// Token bucket of the bytes written to the network. Tokens are added at Rate [bytes/s] up to Burst bytes, a write
+// takes one token for each byte. A Rate of zero (or negative) removes the limit
+type TokenBucket struct {
+	lock   sync.Mutex
+	rate   int64
+	burst  int64
+	tokens float64
+	last   time.Time
+	// closed when the limit changes, wakes up the waiting writers
+	changed chan bool
+}
+
+func NewTokenBucket(rate int64, burst int64) *TokenBucket {
+	b := &TokenBucket{changed: make(chan bool)}
+	b.SetLimit(rate, burst)
+	return b
+}
+
+// Changes the limit, the bucket is full after the change. When burst is zero (or negative) the default burst of the
+// rate is used
+func (b *TokenBucket) SetLimit(rate int64, burst int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if burst <= 0 {
+		burst = DefaultBurst(rate)
+	}
+	b.rate = rate
+	b.burst = burst
+	b.tokens = float64(burst)
+	b.last = time.Now()
+	close(b.changed)
+	b.changed = make(chan bool)
+}
+
+// Current rate [bytes/s] and burst [bytes]
+func (b *TokenBucket) Limit() (rate int64, burst int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.rate, b.burst
+}
+
+// Default burst of a rate, a tenth of a second of traffic and at least configuration.MinBandwidthBurst bytes
+func DefaultBurst(rate int64) int64 {
+	burst := rate / 10
+	if burst < configuration.MinBandwidthBurst {
+		burst = configuration.MinBandwidthBurst
+	}
+	return burst
+}
+
+// Waits for the tokens of a write of n bytes, at most a burst of tokens is taken. Returns the number of bytes that can
+// be written, zero when done is closed
+func (b *TokenBucket) Take(n int, done chan bool) int {
+	for {
+		b.lock.Lock()
+		if b.rate <= 0 {
+			b.lock.Unlock()
+			return n
+		}
+		if int64(n) > b.burst {
+			n = int(b.burst)
+		}
+		now := time.Now()
+		b.tokens += now.Sub(b.last).Seconds() * float64(b.rate)
+		if b.tokens > float64(b.burst) {
+			b.tokens = float64(b.burst)
+		}
+		b.last = now
+		if b.tokens >= float64(n) {
+			b.tokens -= float64(n)
+			b.lock.Unlock()
+			return n
+		}
+		wait := time.Duration((float64(n) - b.tokens) / float64(b.rate) * float64(time.Second))
+		changed := b.changed
+		b.lock.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-changed:
+			timer.Stop()
+		case <-done:
+			timer.Stop()
+			return 0
+		}
+	}
+}
+
+// Writer throttled by a token bucket, the writes are split in bursts
+type limitedWriter struct {
+	out    io.Writer
+	bucket *TokenBucket
+	// closed on stop, unblocks the waiting writes
+	done chan bool
+}
+
+func (w *limitedWriter) Write(p []byte) (written int, err error) {
+	for written < len(p) {
+		n := w.bucket.Take(len(p)-written, w.done)
+		if n == 0 {
+			return written, errors.New("network manager stopped while waiting for the bandwidth")
+		}
+		n, err = w.out.Write(p[written : written+n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,129 @@
+package routines
+
+import (
+	"errors"
+	"github.com/ftarlao/goblocksync/utils"
+	"github.com/ftarlao/goblocksync/utils/hashing"
+	"hash"
+	"io"
+	"sync"
+)
+
+// Reader of a file that computes the whole-file digest while the file is read, e.g. by the Hasher. The digest covers
+// the file from location 0: the regions skipped by the reads (e.g. before the start location of a resumed sync) are
+// read again for the digest, the regions read twice are digested once. The reads should move forward for a single
+// pass over the file
+type DigestReader struct {
+	file   io.ReaderAt
+	digest hash.Hash
+	lock   sync.Mutex
+	// the digest covers [0, digestLoc)
+	digestLoc int64
+	// location of the next Read
+	readLoc int64
+}
+
+func NewDigestReader(file io.ReaderAt, algorithm hashing.HashAlgorithm) *DigestReader {
+	return &DigestReader{file: file, digest: algorithm.New()}
+}
+
+func (r *DigestReader) ReadAt(p []byte, off int64) (n int, err error) {
+	n, err = r.file.ReadAt(p, off)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if off > r.digestLoc {
+		//skipped region
+		if catchUpErr := r.digestTo(off); catchUpErr != nil {
+			return n, catchUpErr
+		}
+	}
+	if end := off + int64(n); end > r.digestLoc {
+		r.digest.Write(p[r.digestLoc-off : n])
+		r.digestLoc = end
+	}
+	return n, err
+}
+
+func (r *DigestReader) Read(p []byte) (n int, err error) {
+	n, err = r.ReadAt(p, r.readLoc)
+	r.readLoc += int64(n)
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Only io.SeekStart and io.SeekCurrent are supported, the size of the file is not known
+func (r *DigestReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.readLoc
+	default:
+		return r.readLoc, errors.New("unsupported seek")
+	}
+	if offset < 0 {
+		return r.readLoc, errors.New("negative seek location")
+	}
+	r.readLoc = offset
+	return offset, nil
+}
+
+// Digest of the file till the end of the reads, the region not read yet is not included. Returns the size of the
+// digested region too
+func (r *DigestReader) Sum() (size int64, digest []byte) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.digestLoc, r.digest.Sum(nil)
+}
+
+// Adds the file region [digestLoc, loc) to the digest
+func (r *DigestReader) digestTo(loc int64) error {
+	n, err := copyRegion(r.digest, r.file, r.digestLoc, loc-r.digestLoc, nil)
+	r.digestLoc += n
+	if err == io.EOF {
+		return errors.New("file shorter than the read location")
+	}
+	return err
+}
+
+// Digest of the first size bytes of the file, of the whole file when size is negative. The digested bytes are
+// counted as compared by the progress (when not nil). Returns the size of the digested region, shorter than size
+// when the file is shorter
+func FileDigest(file io.ReaderAt, size int64, algorithm hashing.HashAlgorithm, progress *Progress) (int64, []byte, error) {
+	digest := algorithm.New()
+	n, err := copyRegion(digest, file, 0, size, progress)
+	if err != nil && err != io.EOF {
+		return n, nil, err
+	}
+	return n, digest.Sum(nil), nil
+}
+
+// Copies the file region [start, start+length) to w, till EOF when length is negative. io.EOF is returned when the
+// file ends before the region
+func copyRegion(w io.Writer, file io.ReaderAt, start int64, length int64, progress *Progress) (int64, error) {
+	chunk := make([]byte, utils.MB)
+	var copied int64
+	for length < 0 || copied < length {
+		toRead := int64(len(chunk))
+		if length >= 0 && length-copied < toRead {
+			toRead = length - copied
+		}
+		n, err := file.ReadAt(chunk[:toRead], start+copied)
+		w.Write(chunk[:n])
+		copied += int64(n)
+		if progress != nil {
+			progress.AddCompared(int64(n))
+		}
+		if utils.IsEOF(err) || (err == nil && n == 0) {
+			if length < 0 {
+				return copied, nil
+			}
+			return copied, io.EOF
+		}
+		if err != nil {
+			return copied, err
+		}
+	}
+	return copied, nil
+}
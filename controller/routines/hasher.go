@@ -3,11 +3,15 @@ package routines
 import (
 	"bufio"
 	"errors"
+	"fmt"
 	"github.com/ftarlao/goblocksync/data/configuration"
 	"github.com/ftarlao/goblocksync/data/messages"
 	"github.com/ftarlao/goblocksync/utils"
+	"github.com/ftarlao/goblocksync/utils/hashing"
 	"io"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 	"strconv"
 )
@@ -32,19 +36,26 @@ type hasherImpl struct {
 	// File descriptor
 	fileDesc io.ReadSeeker
 	// Current position of hashing operator in bytes; the next hash is for the [currentLoc,currentLoc+blockSize) portion
+	// (atomic)
 	currentLoc int64
 	// Output chan for the obtained hashes
 	outMsgChannel chan messages.Message
 	// Internal data channel
 	readDataChannel chan messages.Message
-	// Current running status
-	running int
+	// Current running status, read by the hasher goroutines (atomic)
+	running int32
 	// lockHasher on Start
 	lockHasher sync.Mutex
 	// current hashing function
 	hashingFunc func([]byte, int) []byte
+	// size of the hashes [bytes]
+	hashSize int
+	// number of hashing goroutines
+	workers int
 	// channel for stop signals
 	stopChannel chan bool
+	// closed by Stop, the goroutines never block on a send once closed
+	done chan bool
 }
 
 func (h *hasherImpl) GetOutMsgChannel() chan messages.Message {
@@ -53,23 +64,29 @@ func (h *hasherImpl) GetOutMsgChannel() chan messages.Message {
 
 func (h *hasherImpl) Start() error {
 	h.lockHasher.Lock()
-	if h.running != STOPPED {
+	if atomic.LoadInt32(&h.running) != STOPPED {
+		h.lockHasher.Unlock()
 		return errors.New("the 'hasher' is already running")
 	}
-	h.running = RUNNING
+	atomic.StoreInt32(&h.running, RUNNING)
+	done := make(chan bool)
+	h.done = done
 	h.lockHasher.Unlock()
 
-	go dataReader(h)
+	//the start location is read before the data reader moves it forward
+	startLoc := h.currentLoc
 
-	go hasherRoutine(h)
+	go dataReader(h, done)
+
+	go hasherRoutine(h, startLoc, done)
 
 	return nil
 }
 
-func dataReader(n *hasherImpl) {
+func dataReader(n *hasherImpl, done chan bool) {
 	defer func() {
 		if r := recover(); r != nil { //this is very unlikely to happen, defensive
-			n.readDataChannel <- messages.NewErrorMessage(r.(error))
+			sendUnlessDone(n.readDataChannel, messages.NewErrorMessage(r.(error)), done)
 		}
 	}()
 	defer func() {
@@ -79,7 +96,7 @@ func dataReader(n *hasherImpl) {
 	//seek to the start position
 	_, err := n.fileDesc.Seek(n.currentLoc, 0)
 	if err != nil {
-		n.readDataChannel <- messages.NewErrorMessage(err)
+		sendUnlessDone(n.readDataChannel, messages.NewErrorMessage(err), done)
 		return
 	}
 	//..better to put a read buffer
@@ -87,109 +104,228 @@ func dataReader(n *hasherImpl) {
 
 	var n1 = 0
 
-	for err == nil && n.running == RUNNING {
+	for err == nil && atomic.LoadInt32(&n.running) == RUNNING {
 		//fmt.Println("Block ", numHashes, "Start position [byte] ", h.currentLoc)
 		dataBlock := make([]byte, n.blockSize)
 		n1, err = io.ReadFull(fBuffered, dataBlock)
 		//An error is sent to the hashing part..
-		if err != nil && !utils.IsEOF(err) {
-			n.readDataChannel <- messages.NewErrorMessage(err)
+		if err != nil && !utils.IsEOF(err) && !sendUnlessDone(n.readDataChannel, messages.NewErrorMessage(err), done) {
+			return
 		}
 		if n1 > 0 {
-			//allocating a struct and array is inefficient but may be the right thing to parallelize the Hashing part later
-			n.readDataChannel <- messages.NewDataBlockMessage(n.currentLoc, dataBlock[:n1])
-			n.currentLoc += int64(n1)
+			//a struct and an array for each block, the blocks are hashed in parallel by the workers
+			if !sendUnlessDone(n.readDataChannel, messages.NewDataBlockMessage(n.currentLoc, dataBlock[:n1]), done) {
+				return
+			}
+			atomic.AddInt64(&n.currentLoc, int64(n1))
 		}
 		if utils.IsEOF(err) {
-			n.readDataChannel <- messages.NewEndMessage()
+			sendUnlessDone(n.readDataChannel, messages.NewEndMessage(), done)
 			return
 		}
 	}
 }
 
-func hasherRoutine(n *hasherImpl) {
+// Sends msg on c, returns false without sending when the hasher is stopped first
+func sendUnlessDone(c chan messages.Message, msg messages.Message, done chan bool) bool {
+	select {
+	case c <- msg:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// Block to hash, the hash is provided by a worker on the result channel
+type hashJob struct {
+	// DataBlockMessage to hash, or the EndMessage/ErrorMessage that ends the stream
+	msg    messages.Message
+	result chan hashResult
+}
+
+type hashResult struct {
+	hash []byte
+	err  error
+}
+
+// Hashes the blocks on the worker pool, the jobs are queued in read order and collected in the same order
+func hasherRoutine(n *hasherImpl, startLoc int64, done chan bool) {
 	defer func() {
 		if r := recover(); r != nil {
-			n.outMsgChannel <- messages.NewErrorMessage(r.(error))
+			sendUnlessDone(n.outMsgChannel, messages.NewErrorMessage(r.(error)), done)
 		}
 	}()
 	defer func() {
-		n.running = SHUTDOWN
+		atomic.StoreInt32(&n.running, SHUTDOWN)
 		n.stopChannel <- true
 	}()
 
-	var err error
-	var msg messages.Message
-	currentMessage := messages.NewHashGroupMessage(n.currentLoc)
-	for err == nil && n.running == RUNNING {
-		// Create new HashGroupMessage
-		msg = <-n.readDataChannel
+	jobs := make(chan *hashJob, 2*n.workers)
+	ordered := make(chan *hashJob, 4*n.workers)
+	collected := make(chan bool)
+	defer close(collected)
+	for i := 0; i < n.workers; i++ {
+		go hashWorker(n, jobs)
+	}
+	go dispatcher(n, jobs, ordered, collected, done)
 
-		switch msg.GetMessageID() {
+	currentMessage := messages.NewHashGroupMessage(startLoc)
+	for job := range ordered {
+		switch job.msg.GetMessageID() {
 		case messages.DataBlockMessageID:
-			msgDataBlock := msg.(*messages.DataBlockMessage)
+			result := <-job.result
+			if result.err != nil {
+				sendUnlessDone(n.outMsgChannel, messages.NewErrorMessage(result.err), done)
+				return
+			}
 			if currentMessage.IsFull() {
-				n.outMsgChannel <- currentMessage
+				if !sendUnlessDone(n.outMsgChannel, currentMessage, done) {
+					return
+				}
 				// Create new HashGroupMessage
-				currentMessage = messages.NewHashGroupMessage(msgDataBlock.StartLoc)
+				currentMessage = messages.NewHashGroupMessage(job.msg.(*messages.DataBlockMessage).StartLoc)
 			}
-
-			hash := n.hashingFunc(msgDataBlock.Data, configuration.HashSize)
-			currentMessage.AddHash(hash)
+			currentMessage.AddHash(result.hash)
 		case messages.EndMessageID:
 			if !currentMessage.IsEmpty() {
 				currentMessage.TruncHashGroup()
-				n.outMsgChannel <- currentMessage
+				if !sendUnlessDone(n.outMsgChannel, currentMessage, done) {
+					return
+				}
 			}
-			n.outMsgChannel <- msg
+			sendUnlessDone(n.outMsgChannel, job.msg, done)
 			return
 		case messages.ErrorMessageID:
-			n.outMsgChannel <- msg
+			sendUnlessDone(n.outMsgChannel, job.msg, done)
 			return
 		default:
-			unexpectedTypeStr := strconv.Itoa(int(msg.GetMessageID()))
-			n.outMsgChannel <- messages.NewErrorMessage(errors.New("unexpected msg type" + unexpectedTypeStr + " provided from data reader goroutine to the hashing goroutine"))
+			unexpectedTypeStr := strconv.Itoa(int(job.msg.GetMessageID()))
+			sendUnlessDone(n.outMsgChannel, messages.NewErrorMessage(errors.New("unexpected msg type" + unexpectedTypeStr + " provided from data reader goroutine to the hashing goroutine")), done)
 			return
 		}
 	}
 }
 
+// Moves the blocks from the data reader to the workers, the order of the blocks is kept in ordered. Returns when the
+// collection ends or the hasher is stopped
+func dispatcher(n *hasherImpl, jobs chan *hashJob, ordered chan *hashJob, collected chan bool, done chan bool) {
+	defer close(jobs)
+	//a stopped hasher ends the collection too
+	defer close(ordered)
+	for atomic.LoadInt32(&n.running) == RUNNING {
+		var msg messages.Message
+		select {
+		case msg = <-n.readDataChannel:
+		case <-collected:
+			return
+		case <-done:
+			return
+		}
+		job := &hashJob{msg: msg}
+		if msg.GetMessageID() == messages.DataBlockMessageID {
+			job.result = make(chan hashResult, 1)
+			select {
+			case jobs <- job:
+			case <-collected:
+				return
+			case <-done:
+				return
+			}
+		}
+		select {
+		case ordered <- job:
+		case <-collected:
+			return
+		case <-done:
+			return
+		}
+		if msg.GetMessageID() != messages.DataBlockMessageID {
+			return
+		}
+	}
+}
+
+func hashWorker(n *hasherImpl, jobs chan *hashJob) {
+	for job := range jobs {
+		job.result <- hashBlock(n, job.msg.(*messages.DataBlockMessage).Data)
+	}
+}
+
+// Hashes a block, panics of the hashing function are errors
+func hashBlock(n *hasherImpl, data []byte) (result hashResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			result.err = fmt.Errorf("hashing failure: %v", r)
+		}
+	}()
+	return hashResult{hash: n.hashingFunc(data, n.hashSize)}
+}
+
 func (n *hasherImpl) Stop() error {
 	n.lockHasher.Lock()
-	n.running = STOPPED
+	atomic.StoreInt32(&n.running, STOPPED)
+	if n.done != nil {
+		close(n.done)
+		n.done = nil
+	}
 	for i := 0; i < 2; i++ {
 		select {
 		case <-n.stopChannel:
 		case <-time.After(stopTimeout):
+			n.lockHasher.Unlock()
 			return errors.New("stop timeout")
 		}
 	}
+	//the hashing goroutine marks its own shutdown
+	atomic.StoreInt32(&n.running, STOPPED)
 	n.lockHasher.Unlock()
 	return nil
 }
 
+// Location reached by the data reader, read atomically (e.g. by the progress reporter)
 func (n *hasherImpl) GetCurrentPosition() int64 {
-	return n.currentLoc
+	return atomic.LoadInt64(&n.currentLoc)
 }
 
 func (n *hasherImpl) IsRunning() bool {
-	return !(n.running == STOPPED)
+	return !(atomic.LoadInt32(&n.running) == STOPPED)
 }
 
+// Hasher with a hashing goroutine for each CPU
 func NewHasherImpl(blockSize int64, fileDesc io.ReadSeeker, startLoc int64, hashingFunc func([]byte, int) []byte) Hasher {
+	return NewHasherImplWorkers(blockSize, fileDesc, startLoc, hashingFunc, 0)
+}
+
+// Hasher with the provided number of hashing goroutines, one for each CPU when workers is not positive. The
+// HashGroupMessages are in block order whatever the number of workers
+func NewHasherImplWorkers(blockSize int64, fileDesc io.ReadSeeker, startLoc int64, hashingFunc func([]byte, int) []byte, workers int) Hasher {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
 	instance := hasherImpl{
 		blockSize:  blockSize,
 		fileDesc:   fileDesc,
 		currentLoc: startLoc,
+		workers:    workers,
 		running:    STOPPED}
 
 	instance.outMsgChannel = make(chan messages.Message, configuration.HashGroupChannelSize)
 	instance.readDataChannel = make(chan messages.Message, configuration.DataMaxBytes/blockSize)
 	instance.stopChannel = make(chan bool, 3)
 	instance.hashingFunc = hashingFunc
+	instance.hashSize = configuration.HashSize
 	return &instance
 }
 
+// Hasher for a registered hash algorithm, the hashes have the size declared by the algorithm
+func NewHasherImplAlgorithm(blockSize int64, fileDesc io.ReadSeeker, startLoc int64, algorithm hashing.HashAlgorithm, workers int) Hasher {
+	h := NewHasherImplWorkers(blockSize, fileDesc, startLoc, func(data []byte, _ int) []byte {
+		return algorithm.Sum(data)
+	}, workers)
+	h.(*hasherImpl).hashSize = algorithm.Size
+	return h
+}
+
 // very dumb 'size' bit hash, ...for tests only
 func DummyHash(data []byte, size int) (hash []byte) {
 	hash = make([]byte, size)
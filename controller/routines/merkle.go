@@ -0,0 +1,101 @@
+package routines
+
+import (
+	"github.com/ftarlao/goblocksync/utils"
+	"github.com/ftarlao/goblocksync/utils/hashing"
+	"io"
+)
+
+// Merkle tree over the file blocks. Level 0 nodes are the block hashes, a level k node is the hash of the concatenated
+// hashes of its (up to) Fanout level k-1 children. The node of level k starting at loc covers
+// [loc, loc+NodeSize(k)); nodes are aligned to the tree start location.
+type MerkleTree struct {
+	// Block size [bytes]
+	BlockSize int64
+	// Number of children of each node
+	Fanout int
+	// Hash algorithm for blocks and nodes
+	Algorithm hashing.HashAlgorithm
+}
+
+// Size of the region covered by a node of the level [bytes]
+func (t MerkleTree) NodeSize(level int) int64 {
+	size := t.BlockSize
+	for i := 0; i < level; i++ {
+		size *= int64(t.Fanout)
+	}
+	return size
+}
+
+// Computes the hashes of the level nodes covering [start, end), the nodes are provided in order to emit. The region
+// ends at EOF when end is negative. start should be aligned to a node of the level, the last node may be partial.
+// Errors returned by emit stop the computation
+func (t MerkleTree) NodeHashes(f io.ReaderAt, start int64, end int64, level int, emit func(startLoc int64, hash []byte) error) error {
+	nodeStart := start
+	nodeSize := t.NodeSize(level)
+	// concatenated children hashes of the nodes under construction, one for each level below 'level'
+	acc := make([][]byte, level)
+	count := make([]int, level)
+
+	push := func(k int, h []byte) error {
+		for {
+			if k == level {
+				err := emit(nodeStart, h)
+				nodeStart += nodeSize
+				return err
+			}
+			acc[k] = append(acc[k], h...)
+			count[k]++
+			if count[k] < t.Fanout {
+				return nil
+			}
+			h = t.Algorithm.Sum(acc[k])
+			acc[k] = acc[k][:0]
+			count[k] = 0
+			k++
+		}
+	}
+
+	// read many blocks at once, the blocks are hashed one by one
+	chunkSize := utils.IntMax(t.BlockSize, (utils.MB/t.BlockSize)*t.BlockSize)
+	chunk := make([]byte, chunkSize)
+	loc := start
+	for end < 0 || loc < end {
+		toRead := chunkSize
+		if end >= 0 && end-loc < toRead {
+			toRead = end - loc
+		}
+		n, err := f.ReadAt(chunk[:toRead], loc)
+		if err != nil && !utils.IsEOF(err) {
+			return err
+		}
+		for i := int64(0); i < int64(n); i += t.BlockSize {
+			blockEnd := i + t.BlockSize
+			if blockEnd > int64(n) {
+				blockEnd = int64(n)
+			}
+			err := push(0, t.Algorithm.Sum(chunk[i:blockEnd]))
+			if err != nil {
+				return err
+			}
+		}
+		loc += int64(n)
+		if int64(n) < toRead {
+			break
+		}
+	}
+
+	// partial nodes at the end of the region
+	for k := 0; k < level; k++ {
+		if count[k] > 0 {
+			h := t.Algorithm.Sum(acc[k])
+			acc[k] = acc[k][:0]
+			count[k] = 0
+			err := push(k+1, h)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -3,10 +3,14 @@ package routines
 import (
 	"encoding/gob"
 	"errors"
+	"github.com/ftarlao/goblocksync/data/configuration"
 	"github.com/ftarlao/goblocksync/data/messages"
 	"github.com/ftarlao/goblocksync/utils"
+	"github.com/ftarlao/goblocksync/utils/compression"
 	"io"
+	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,41 +19,107 @@ type NetworkManager struct {
 	InStream io.Reader
 	//Output stream
 	OutStream io.Writer
+	//Buffered input stream, the gob decoder reads exactly its messages and the binary frames follow them. It checks the
+	//CRC32C trailers
+	inReader *messages.ChecksumReader
+	//Input of the gob decoder, refuses the messages beyond the limits before their allocation
+	inGob *messages.GobLimitReader
+	//Throttled output stream, it computes the CRC32C trailers
+	outWriter *messages.ChecksumWriter
 	//Gob input decoder
 	inDecoder *gob.Decoder
 	//Gob output encoder
 	outEncoder *gob.Encoder
+	// protocol versions advertised in the hello message
+	protocols []int
+	// CRC32C trailers advertised in the hello message
+	checksums bool
+	// maximums of the received messages
+	limits messages.Limits
 	//Input channel for decoded messages
 	inMsgChannel chan messages.Message
-	//Output channel for encoded messages
+	//Output channel for encoded messages, never closed
 	outMsgChannel chan messages.Message
 	//locks to ensure complete stop and avoid double start
 	lockNetManager sync.Mutex
 	// Current running status
 	running       bool
 	startDisabled bool
-	stopChannel   chan bool
+	// true when the input message channel has been closed, and once Stop has begun
+	inClosed bool
+	stopping bool
+	// closed when Stop begins, the Send callers give up
+	stoppingChannel chan bool
+	// held by the Send callers while queueing, Stop waits them before the writer drains the output channel
+	sendLock sync.RWMutex
+	// closed once no Send caller is queueing, the writer sends the queued messages and exits
+	drainChannel chan bool
+	// closed on stop, unblocks the routines and the Send callers
+	doneChannel chan bool
+	// failure that stopped the manager and the ErrorMessage reporting it on the input channel
+	failure        error
+	failureMessage *messages.ErrorMessage
+	// stop notifications of the writer and the reader routines
+	writerStopChannel chan bool
+	readerStopChannel chan bool
+	// data block compression, set after the handshake, and maximum size of a decompressed block [bytes]
+	compression  compression.Algorithm
+	maxBlockSize int64
+	// limit of the bytes written to OutStream
+	bandwidth *TokenBucket
+	// data bytes of the DataBlockMessages and DeltaMessages written to OutStream (atomic)
+	sentDataBytes int64
 }
 
 const channelWaitTime = time.Second
 const stopTimeout = 4 * time.Second
 
-func NewNetworkManager(channelSize int, in io.Reader, out io.Writer) (n NetworkManager) {
-
-	inDecoder, outEncoder := EncoderInOut(in, out)
-	n = NetworkManager{
-		InStream:      in,
-		OutStream:     out,
-		inDecoder:     inDecoder,
-		outEncoder:    outEncoder,
-		inMsgChannel:  make(chan messages.Message, channelSize),
-		outMsgChannel: make(chan messages.Message, channelSize),
-		running:       false,
-		startDisabled: false,
-		stopChannel:   make(chan bool, 3)}
+func NewNetworkManager(channelSize int, in io.Reader, out io.Writer) (n *NetworkManager) {
+
+	n = &NetworkManager{
+		InStream:          in,
+		OutStream:         out,
+		inMsgChannel:      make(chan messages.Message, channelSize),
+		outMsgChannel:     make(chan messages.Message, channelSize),
+		running:           false,
+		startDisabled:     false,
+		stoppingChannel:   make(chan bool),
+		drainChannel:      make(chan bool),
+		doneChannel:       make(chan bool),
+		writerStopChannel: make(chan bool, 1),
+		readerStopChannel: make(chan bool, 1),
+		bandwidth:         NewTokenBucket(0, 0),
+		protocols:         configuration.SupportedProtocols,
+		checksums:         true,
+		limits:            messages.DefaultLimits()}
+	//the encoded messages are throttled, no limit till SetBandwidthLimit
+	n.inReader = messages.NewChecksumReader(in)
+	n.inGob = messages.NewGobLimitReader(n.inReader, n.limits.MaxMessageSize())
+	n.outWriter = messages.NewChecksumWriter(&limitedWriter{out, n.bandwidth, n.doneChannel})
+	n.inDecoder, n.outEncoder = EncoderInOut(n.inGob, n.outWriter)
 	return
 }
 
+// Switch of the encoding of the sent messages, queued with the messages
+type protocolSwitch struct {
+	version   int
+	checksums bool
+}
+
+// Not a peer message, never encoded
+func (*protocolSwitch) GetMessageID() byte {
+	return math.MaxUint8
+}
+
+// Best protocol version supported by both the peers
+func BestProtocol(local []int, remote []int) (int, error) {
+	inter := utils.SliceIntersection(local, remote)
+	if len(inter) == 0 {
+		return 0, errors.New("master and slave protocols versions are no compatible")
+	}
+	return *utils.SliceMax(inter), nil
+}
+
 func (n *NetworkManager) GetInMsgChannel() chan messages.Message {
 	return n.inMsgChannel
 }
@@ -61,6 +131,7 @@ func (n *NetworkManager) GetOutMsgChannel() chan messages.Message {
 func (n *NetworkManager) Start() (err error) {
 	//Synchronized method
 	n.lockNetManager.Lock()
+	defer n.lockNetManager.Unlock()
 	if n.running {
 		return errors.New("already running")
 	}
@@ -69,43 +140,92 @@ func (n *NetworkManager) Start() (err error) {
 	}
 	n.running = true
 	n.startDisabled = true
-	n.lockNetManager.Unlock()
-	//Write messages routine
+	//Write messages routine, exits when the output channel is drained after the stop request
 	go func() {
 		defer func() {
 			r := recover()
 			n.stopOn(r)
-			n.stopChannel <- true
+			n.writerStopChannel <- true
 		}()
 
-		var errGo error
-		for n.running {
+		//gob without trailers till the switch requested by the handshake
+		protocol := configuration.ProtocolGob
+		checksums := false
+		for {
+			var msg messages.Message
 			select {
-			case msg := <-n.outMsgChannel:
+			case msg = <-n.outMsgChannel:
+			case <-n.drainChannel:
+				//no more senders, the queued messages are sent before the exit
+				select {
+				case msg = <-n.outMsgChannel:
+				default:
+					return
+				}
+			case <-n.doneChannel:
+				return
+			}
+			if s, ok := msg.(*protocolSwitch); ok {
+				protocol, checksums = s.version, s.checksums
+				continue
+			}
+			dataBytes := dataSize(msg)
+			msg, errGo := n.compress(msg)
+			utils.Check(errGo)
+			n.outWriter.Begin()
+			if protocol == configuration.ProtocolBinary {
+				errGo = messages.EncodeFrame(n.outWriter, msg)
+			} else {
 				errGo = messages.EncodeMessage(n.outEncoder, msg)
-				utils.Check(errGo)
-			case <-time.After(channelWaitTime):
 			}
+			if errGo == nil && checksums {
+				errGo = n.outWriter.WriteTrailer()
+			}
+			utils.Check(errGo)
+			atomic.AddInt64(&n.sentDataBytes, dataBytes)
 		}
-
-		//errGo = messages.EncodeMessage(n.outEncoder, messages.NewEndMessage())
-		//utils.Check(errGo)
 	}()
 
-	//Read messages routine
+	//Read messages routine, the input channel is closed on exit
 	go func() {
 		defer func() {
 			r := recover()
 			n.stopOn(r)
-			n.stopChannel <- true
+			n.lockNetManager.Lock()
+			n.inClosed = true
+			close(n.inMsgChannel)
+			n.lockNetManager.Unlock()
+			n.readerStopChannel <- true
 		}()
 
-		for n.running {
-			m, errGo := messages.DecodeMessage(n.inDecoder)
+		//gob till the hello of the peer, then the best common protocol, with trailers when both the peers want them
+		protocol := configuration.ProtocolGob
+		checksums := false
+		for {
+			m, errGo := n.decode(protocol, checksums)
+			if errGo != nil && !n.IsRunning() {
+				//the streams have been closed by Stop, this is not an error
+				return
+			}
+			utils.Check(errGo)
+			//the peer switches after sending its hello, as this side does
+			if hello, ok := m.(*messages.HelloInfoMessage); ok && protocol == configuration.ProtocolGob {
+				if best, err := BestProtocol(n.GetSupportedProtocols(), hello.SupportedProtocols); err == nil {
+					protocol = best
+				}
+				checksums = hello.Checksums && n.GetChecksums()
+			}
+			//bandwidth changes requested by the peer are applied here
+			if limit, ok := m.(*messages.BandwidthMessage); ok {
+				n.SetBandwidthLimit(limit.Rate, limit.Burst)
+				continue
+			}
+			m, errGo = n.decompress(m)
 			utils.Check(errGo)
 			select {
 			case n.inMsgChannel <- m:
-			case <-time.After(channelWaitTime):
+			case <-n.doneChannel:
+				return
 			}
 		}
 	}()
@@ -113,20 +233,216 @@ func (n *NetworkManager) Start() (err error) {
 	return
 }
 
+// Sends a message to the peer, blocks until the message is queued or the manager is stopping
+func (n *NetworkManager) Send(m messages.Message) error {
+	return n.SendUntil(m, nil)
+}
+
+// Sends a message to the peer as Send, the caller gives up when cancel is closed
+func (n *NetworkManager) SendUntil(m messages.Message, cancel <-chan bool) error {
+	n.sendLock.RLock()
+	defer n.sendLock.RUnlock()
+	select {
+	case <-n.stoppingChannel:
+		return errStopped
+	default:
+	}
+	select {
+	case n.outMsgChannel <- m:
+		return nil
+	case <-n.stoppingChannel:
+		return errStopped
+	case <-n.doneChannel:
+		return errStopped
+	case <-cancel:
+		return errors.New("message not sent, canceled")
+	}
+}
+
+var errStopped = errors.New("network manager stopped, cannot send the message")
+
+// Sets the protocol versions advertised in the hello message, before the handshake
+func (n *NetworkManager) SetSupportedProtocols(protocols []int) {
+	n.lockNetManager.Lock()
+	n.protocols = protocols
+	n.lockNetManager.Unlock()
+}
+
+func (n *NetworkManager) GetSupportedProtocols() []int {
+	n.lockNetManager.Lock()
+	defer n.lockNetManager.Unlock()
+	return n.protocols
+}
+
+// Sets the CRC32C trailers advertised in the hello message, before the handshake
+func (n *NetworkManager) SetChecksums(enabled bool) {
+	n.lockNetManager.Lock()
+	n.checksums = enabled
+	n.lockNetManager.Unlock()
+}
+
+func (n *NetworkManager) GetChecksums() bool {
+	n.lockNetManager.Lock()
+	defer n.lockNetManager.Unlock()
+	return n.checksums
+}
+
+// Encodes the messages sent after this call with the protocol version chosen in the handshake, followed by their
+// CRC32C trailers when checksums is set. The peer decodes with the same choices the messages following the hello
+func (n *NetworkManager) SwitchProtocol(version int, checksums bool) error {
+	return n.Send(&protocolSwitch{version: version, checksums: checksums})
+}
+
+// Sets the maximums of the received messages, agreed with the peer. The messages decoded before this call are checked
+// against the previous limits
+func (n *NetworkManager) SetLimits(limits messages.Limits) {
+	n.lockNetManager.Lock()
+	n.limits = limits
+	n.lockNetManager.Unlock()
+}
+
+func (n *NetworkManager) getLimits() messages.Limits {
+	n.lockNetManager.Lock()
+	defer n.lockNetManager.Unlock()
+	return n.limits
+}
+
+// Enables the compression of the sent DataBlockMessages, the received blocks are decompressed up to maxBlockSize bytes.
+// Both the peers set the algorithm chosen in the handshake before the first data block is exchanged
+func (n *NetworkManager) SetCompression(algorithm compression.Algorithm, maxBlockSize int64) {
+	n.lockNetManager.Lock()
+	n.compression = algorithm
+	n.maxBlockSize = maxBlockSize
+	n.lockNetManager.Unlock()
+}
+
+// Limits the bytes written to OutStream to rate [bytes/s] with bursts of burst bytes, a rate of zero removes the limit
+// and a burst of zero is the default burst of the rate. The limit can be changed while running
+func (n *NetworkManager) SetBandwidthLimit(rate int64, burst int64) {
+	n.bandwidth.SetLimit(rate, burst)
+}
+
+// Data bytes of the DataBlockMessages and DeltaMessages already written to the peer, before compression
+func (n *NetworkManager) GetSentDataBytes() int64 {
+	return atomic.LoadInt64(&n.sentDataBytes)
+}
+
+// Decodes the next message, a CRC32C mismatch is a *messages.CorruptionError and a message beyond the limits is
+// refused. The trailer of a binary frame is checked before its payload is decoded
+func (n *NetworkManager) decode(protocol int, checksums bool) (m messages.Message, err error) {
+	limits := n.getLimits()
+	n.inReader.Begin()
+	if protocol == configuration.ProtocolBinary {
+		var msgID byte
+		var payload []byte
+		msgID, payload, err = messages.ReadFrame(n.inReader, limits.MaxMessageSize())
+		if err == nil && checksums {
+			err = n.inReader.CheckTrailer()
+		}
+		if err == nil {
+			m, err = messages.DecodePayload(msgID, payload)
+		}
+	} else {
+		n.inGob.Max = limits.MaxMessageSize()
+		m, err = messages.DecodeMessage(n.inDecoder)
+		if err == nil && checksums {
+			err = n.inReader.CheckTrailer()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, limits.Check(m)
+}
+
+func dataSize(m messages.Message) int64 {
+	switch msg := m.(type) {
+	case *messages.DataBlockMessage:
+		return int64(len(msg.Data))
+	case *messages.DeltaMessage:
+		return int64(len(msg.Data))
+	}
+	return 0
+}
+
+// Current bandwidth limit, rate [bytes/s] and burst [bytes]
+func (n *NetworkManager) GetBandwidthLimit() (rate int64, burst int64) {
+	return n.bandwidth.Limit()
+}
+
+func (n *NetworkManager) getCompression() (compression.Algorithm, int64) {
+	n.lockNetManager.Lock()
+	defer n.lockNetManager.Unlock()
+	return n.compression, n.maxBlockSize
+}
+
+// Compressed copy of a DataBlockMessage, the block is sent raw when it does not shrink
+func (n *NetworkManager) compress(m messages.Message) (messages.Message, error) {
+	dataMsg, ok := m.(*messages.DataBlockMessage)
+	if !ok || dataMsg.Compressed {
+		return m, nil
+	}
+	algorithm, _ := n.getCompression()
+	if !algorithm.Enabled() {
+		return m, nil
+	}
+	data, err := algorithm.Compress(dataMsg.Data)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) >= len(dataMsg.Data) {
+		return m, nil
+	}
+	compressed := *dataMsg
+	compressed.Data = data
+	compressed.Compressed = true
+	return &compressed, nil
+}
+
+// Decompresses a compressed DataBlockMessage in place, the decompressed block is checked against the limits
+func (n *NetworkManager) decompress(m messages.Message) (messages.Message, error) {
+	dataMsg, ok := m.(*messages.DataBlockMessage)
+	if !ok || !dataMsg.Compressed {
+		return m, nil
+	}
+	algorithm, maxBlockSize := n.getCompression()
+	if !algorithm.Enabled() {
+		return nil, errors.New("compressed data block received, but compression is not enabled")
+	}
+	data, err := algorithm.Decompress(dataMsg.Data, maxBlockSize)
+	if err != nil {
+		return nil, err
+	}
+	dataMsg.Data = data
+	dataMsg.Compressed = false
+	//the region was checked on the compressed length
+	return dataMsg, n.getLimits().Check(dataMsg)
+}
+
 func (n *NetworkManager) stopOn(err interface{}) {
 
 	//Only the first stopOn acts properly and notifies errors
 	n.lockNetManager.Lock()
 	if n.running {
 		n.running = false
-		if err != nil {
-			eMsg := messages.NewErrorMessage(err.(error))
-			n.inMsgChannel <- eMsg
+		if err != nil && !n.inClosed {
+			var e error
+			switch v := err.(type) {
+			case error:
+				e = v
+			default:
+				e = errors.New("network manager failure")
+			}
+			n.failure = e
+			n.failureMessage = messages.NewErrorMessage(e)
+			select {
+			case n.inMsgChannel <- n.failureMessage:
+			default:
+			}
 		}
 
-		//Force close of all the channels, readers and writers
-		close(n.inMsgChannel)
-		close(n.outMsgChannel)
+		//Unblock the routines and force close of readers and writers
+		close(n.doneChannel)
 		//Perform close of in/out only when Closer
 		cReader, cSuccess := n.InStream.(io.ReadCloser)
 		if cSuccess {
@@ -141,20 +457,61 @@ func (n *NetworkManager) stopOn(err interface{}) {
 	n.lockNetManager.Unlock()
 }
 
+// Stops the manager, the messages already queued in the output channel are sent before closing the streams. The Send
+// calls fail once Stop has begun
 func (n *NetworkManager) Stop() (err error) {
+	n.lockNetManager.Lock()
+	started := n.startDisabled
+	first := !n.stopping
+	if first {
+		n.stopping = true
+		close(n.stoppingChannel)
+	}
+	n.lockNetManager.Unlock()
+	if !started || !first {
+		return nil
+	}
+	//the blocked Send callers give up, then nothing else is queued
+	n.sendLock.Lock()
+	close(n.drainChannel)
+	n.sendLock.Unlock()
+
+	//Wait the writer to drain the output channel, then close everything
+	select {
+	case <-n.writerStopChannel:
+	case <-time.After(stopTimeout):
+		err = errors.New("stop timeout")
+	}
 	n.stopOn(nil)
-	//Wait two stop signals
-	for i := 0; i < 2; i++ {
-		select {
-		case <-n.stopChannel:
-		case <-time.After(stopTimeout):
-			return errors.New("stop timeout")
-		}
+	select {
+	case <-n.readerStopChannel:
+	case <-time.After(stopTimeout):
+		err = errors.New("stop timeout")
+	}
+	return err
+}
+
+// Failure that stopped the manager, e.g. a *messages.CorruptionError; nil when stopped by Stop
+func (n *NetworkManager) Err() error {
+	n.lockNetManager.Lock()
+	defer n.lockNetManager.Unlock()
+	return n.failure
+}
+
+// Error reported by an ErrorMessage of the input channel, the failure of the manager when the message reports it and
+// the error of the peer otherwise
+func (n *NetworkManager) MessageError(m *messages.ErrorMessage) error {
+	n.lockNetManager.Lock()
+	defer n.lockNetManager.Unlock()
+	if m == n.failureMessage {
+		return n.failure
 	}
-	return nil
+	return errors.New(m.Err)
 }
 
 func (n *NetworkManager) IsRunning() bool {
+	n.lockNetManager.Lock()
+	defer n.lockNetManager.Unlock()
 	return n.running
 }
 
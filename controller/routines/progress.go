@@ -0,0 +1,258 @@
+package routines
+
+import (
+	"fmt"
+	"github.com/ftarlao/goblocksync/data/configuration"
+	"github.com/ftarlao/goblocksync/utils"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Progress of a sync. The controllers count the compared, matched and transferred bytes and the remote hashing
+// position; the local hashing position and the written bytes are sampled from the local Hasher and Writer, the bytes
+// actually sent by the source from its NetworkManager. The sync is done when the compared bytes reach the total
+// (source side only, the destination does not know the total)
+type Progress struct {
+	isSource bool
+	// Expected bytes to compare, zero when unknown
+	total        int64
+	compared     int64
+	matched      int64
+	transferred  int64
+	hashedRemote int64
+	lock         sync.Mutex
+	hasher       Hasher
+	hashStart    int64
+	writer       Writer
+	network      *NetworkManager
+	// called once by Finish
+	onFinish func()
+}
+
+// Values of the Progress counters, the values not known by the local side are negative
+type ProgressSnapshot struct {
+	Total        int64
+	Compared     int64
+	HashedLocal  int64
+	HashedRemote int64
+	Matched      int64
+	Transferred  int64
+	Written      int64
+}
+
+// Progress of the source or of the destination
+func NewProgress(isSource bool) *Progress {
+	return &Progress{isSource: isSource, hashedRemote: -1}
+}
+
+// Sets the number of bytes to compare
+func (p *Progress) SetTotal(total int64) {
+	atomic.StoreInt64(&p.total, total)
+}
+
+// Bytes compared by the source, matched or not
+func (p *Progress) AddCompared(n int64) {
+	atomic.AddInt64(&p.compared, n)
+}
+
+func (p *Progress) AddMatched(n int64) {
+	atomic.AddInt64(&p.matched, n)
+}
+
+// Bytes of data sent by the source (queued to the NetworkManager), or received by the destination
+func (p *Progress) AddTransferred(n int64) {
+	atomic.AddInt64(&p.transferred, n)
+}
+
+// Location reached by the hashes of the peer
+func (p *Progress) SetHashedRemote(loc int64) {
+	atomic.StoreInt64(&p.hashedRemote, loc)
+}
+
+// Local hasher, the hashed bytes are counted from startLoc
+func (p *Progress) SetHasher(h Hasher, startLoc int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.hasher = h
+	p.hashStart = startLoc
+}
+
+// NetworkManager of the source, the blocks still queued in the NetworkManager are neither transferred nor compared
+func (p *Progress) SetNetworkManager(n *NetworkManager) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.network = n
+}
+
+func (p *Progress) SetWriter(w Writer) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.writer = w
+}
+
+func (p *Progress) Snapshot() ProgressSnapshot {
+	s := ProgressSnapshot{
+		Total:        atomic.LoadInt64(&p.total),
+		Compared:     atomic.LoadInt64(&p.compared),
+		HashedLocal:  -1,
+		HashedRemote: atomic.LoadInt64(&p.hashedRemote),
+		Matched:      -1,
+		Transferred:  atomic.LoadInt64(&p.transferred),
+		Written:      -1}
+	if p.isSource {
+		s.Matched = atomic.LoadInt64(&p.matched)
+	} else {
+		s.Compared = -1
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.hasher != nil {
+		s.HashedLocal = p.hasher.GetCurrentPosition() - p.hashStart
+	}
+	if p.writer != nil {
+		s.Written = p.writer.GetWrittenBytes()
+	}
+	if p.network != nil && p.isSource {
+		sent := p.network.GetSentDataBytes()
+		if queued := s.Transferred - sent; queued > 0 {
+			s.Compared -= queued
+			s.Transferred = sent
+		}
+	}
+	return s
+}
+
+// The sync is over, a running reporter prints the final progress. Finish can be called more than once
+func (p *Progress) Finish() {
+	p.lock.Lock()
+	onFinish := p.onFinish
+	p.onFinish = nil
+	p.lock.Unlock()
+	if onFinish != nil {
+		onFinish()
+	}
+}
+
+// Sync progress measure: compared bytes on the source, written bytes on the destination
+func (s ProgressSnapshot) Done() int64 {
+	if s.Compared >= 0 {
+		return s.Compared
+	}
+	return utils.IntMax(s.Written, 0)
+}
+
+// Progress line with the throughput [bytes/s] and the ETA, the ETA is available only with a known total
+func FormatProgress(s ProgressSnapshot, rate float64) string {
+	var b strings.Builder
+	hashed := "hashed " + utils.FormatBytes(utils.IntMax(s.HashedLocal, 0))
+	if s.HashedRemote >= 0 {
+		hashed += "/" + utils.FormatBytes(s.HashedRemote)
+	}
+	b.WriteString(hashed)
+	if s.Matched >= 0 {
+		b.WriteString(" matched " + utils.FormatBytes(s.Matched))
+	}
+	b.WriteString(" transferred " + utils.FormatBytes(s.Transferred))
+	if s.Written >= 0 {
+		b.WriteString(" written " + utils.FormatBytes(s.Written))
+	}
+	fmt.Fprintf(&b, " | %s/s", utils.FormatBytes(int64(rate)))
+	if s.Total > 0 {
+		done := utils.IntMin(s.Done(), s.Total)
+		fmt.Fprintf(&b, " %d%%", done*100/s.Total)
+		if rate > 0 {
+			eta := time.Duration(float64(s.Total-done) / rate * float64(time.Second))
+			b.WriteString(" ETA " + utils.FormatDuration(eta))
+		}
+	}
+	return b.String()
+}
+
+// Renders the progress on out, a progress line updated in place on a terminal or periodic log records otherwise
+type ProgressReporter struct {
+	progress *Progress
+	out      io.Writer
+	// periodic log records when out is not a terminal, at the offset of the compared bytes
+	logger   *slog.Logger
+	tty      bool
+	interval time.Duration
+	done     chan bool
+	stopped  chan bool
+	// smoothed throughput [bytes/s]
+	rate     float64
+	lastDone int64
+	lastTime time.Time
+}
+
+func NewProgressReporter(progress *Progress, out *os.File, logger *slog.Logger) *ProgressReporter {
+	r := &ProgressReporter{
+		progress: progress,
+		out:      out,
+		logger:   logger,
+		interval: configuration.ProgressLogInterval,
+		done:     make(chan bool),
+		stopped:  make(chan bool)}
+	if info, err := out.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		r.tty = true
+		r.interval = configuration.ProgressRefreshInterval
+	}
+	return r
+}
+
+// Starts the periodic rendering, it is stopped by Progress.Finish
+func (r *ProgressReporter) Start() {
+	r.progress.lock.Lock()
+	r.progress.onFinish = r.stop
+	r.progress.lock.Unlock()
+	r.lastTime = time.Now()
+	r.lastDone = r.progress.Snapshot().Done()
+	go func() {
+		defer close(r.stopped)
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				r.render(false)
+			case <-r.done:
+				r.render(true)
+				return
+			}
+		}
+	}()
+}
+
+func (r *ProgressReporter) stop() {
+	close(r.done)
+	<-r.stopped
+}
+
+func (r *ProgressReporter) render(final bool) {
+	s := r.progress.Snapshot()
+	now := time.Now()
+	if elapsed := now.Sub(r.lastTime).Seconds(); elapsed > 0 {
+		current := float64(s.Done()-r.lastDone) / elapsed
+		if r.rate == 0 {
+			r.rate = current
+		} else {
+			r.rate = 0.7*r.rate + 0.3*current
+		}
+	}
+	r.lastDone = s.Done()
+	r.lastTime = now
+	line := FormatProgress(s, r.rate)
+	if !r.tty {
+		r.logger.Info("Progress", configuration.LogOffset, s.Done(), "progress", line)
+		return
+	}
+	//the line is redrawn in place, the final one is kept
+	fmt.Fprint(r.out, "\r\x1b[K", line)
+	if final {
+		fmt.Fprintln(r.out)
+	}
+}
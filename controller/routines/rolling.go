@@ -0,0 +1,210 @@
+package routines
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/ftarlao/goblocksync/data/messages"
+	"github.com/ftarlao/goblocksync/utils"
+	"github.com/ftarlao/goblocksync/utils/hashing"
+	"io"
+)
+
+// Rolling checksum mode, as in rsync. The destination block signatures are the weak rolling checksum (4 bytes, big
+// endian) followed by the strong hash of the block. The source slides a window over its file, windows with matching
+// signature become copy instructions, the other bytes literal instructions.
+
+// Weak rolling checksum (rsync), a is the sum of the window bytes, b the sum of the a partial sums; both mod 2^16
+type RollingChecksum struct {
+	a, b uint32
+	n    uint32
+}
+
+// Resets the checksum on the window
+func (r *RollingChecksum) Init(window []byte) {
+	r.a, r.b = 0, 0
+	r.n = uint32(len(window))
+	for i, x := range window {
+		r.a += uint32(x)
+		r.b += (r.n - uint32(i)) * uint32(x)
+	}
+}
+
+// Moves the window one byte forward, out leaves the window and in enters it
+func (r *RollingChecksum) Roll(out byte, in byte) {
+	r.a = r.a - uint32(out) + uint32(in)
+	r.b = r.b - r.n*uint32(out) + r.a
+}
+
+func (r *RollingChecksum) Sum() uint32 {
+	return (r.a & 0xffff) | (r.b&0xffff)<<16
+}
+
+// Signature of a block: weak checksum followed by the strong hash
+func BlockSignature(data []byte, algorithm hashing.HashAlgorithm) []byte {
+	var r RollingChecksum
+	r.Init(data)
+	signature := make([]byte, 4, 4+algorithm.Size)
+	binary.BigEndian.PutUint32(signature, r.Sum())
+	return append(signature, algorithm.Sum(data)...)
+}
+
+// Destination block signatures, indexed by weak checksum
+type SignatureIndex struct {
+	blockSize int64
+	algorithm hashing.HashAlgorithm
+	index     map[uint32][]blockSignature
+}
+
+type blockSignature struct {
+	loc    int64
+	strong []byte
+}
+
+func NewSignatureIndex(blockSize int64, algorithm hashing.HashAlgorithm) *SignatureIndex {
+	return &SignatureIndex{blockSize: blockSize, algorithm: algorithm, index: make(map[uint32][]blockSignature)}
+}
+
+// Adds the signature of the destination block at loc
+func (s *SignatureIndex) Add(loc int64, signature []byte) error {
+	if len(signature) != 4+s.algorithm.Size {
+		return errors.New("malformed block signature")
+	}
+	weak := binary.BigEndian.Uint32(signature)
+	s.index[weak] = append(s.index[weak], blockSignature{loc, signature[4:]})
+	return nil
+}
+
+// Location of a destination block equal to the window, the strong hash is computed only when the weak one matches
+func (s *SignatureIndex) Find(weak uint32, window []byte) (int64, bool) {
+	candidates, ok := s.index[weak]
+	if !ok {
+		return 0, false
+	}
+	strong := s.algorithm.Sum(window)
+	for _, c := range candidates {
+		if bytes.Equal(c.strong, strong) {
+			return c.loc, true
+		}
+	}
+	return 0, false
+}
+
+// Scans the source, the delta instructions that rebuild it from the destination blocks are provided in order to emit.
+// Adjacent copies are merged, literals are at most maxLiteral bytes
+func DeltaScan(r io.Reader, index *SignatureIndex, maxLiteral int64, emit func(*messages.DeltaMessage) error) error {
+	blockSize := int(index.blockSize)
+	bufSize := int(utils.IntMax(4*utils.MB, 4*(index.blockSize+maxLiteral)))
+	buf := make([]byte, 0, bufSize)
+	pos, litStart := 0, 0
+	var outLoc int64
+	eof := false
+	var pendingCopy *messages.DeltaMessage
+	var rolling RollingChecksum
+	rollingValid := false
+
+	flushCopy := func() error {
+		if pendingCopy == nil {
+			return nil
+		}
+		err := emit(pendingCopy)
+		pendingCopy = nil
+		return err
+	}
+	flushLiteral := func() error {
+		if pos == litStart {
+			return nil
+		}
+		err := flushCopy()
+		if err != nil {
+			return err
+		}
+		//the tail may be longer than maxLiteral
+		for litStart < pos {
+			end := pos
+			if int64(end-litStart) > maxLiteral {
+				end = litStart + int(maxLiteral)
+			}
+			data := append([]byte(nil), buf[litStart:end]...)
+			err = emit(messages.NewLiteralDeltaMessage(outLoc, data))
+			outLoc += int64(len(data))
+			litStart = end
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	// keeps at least a window and the next byte in the buffer, when available
+	fill := func() error {
+		for !eof && len(buf)-pos < blockSize+1 {
+			if len(buf) == cap(buf) {
+				n := copy(buf, buf[litStart:])
+				buf = buf[:n]
+				pos -= litStart
+				litStart = 0
+			}
+			n, err := r.Read(buf[len(buf):cap(buf)])
+			buf = buf[:len(buf)+n]
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for {
+		err := fill()
+		if err != nil {
+			return err
+		}
+		if len(buf)-pos < blockSize {
+			//the tail, shorter than a block
+			pos = len(buf)
+			err = flushLiteral()
+			if err != nil {
+				return err
+			}
+			return flushCopy()
+		}
+		window := buf[pos : pos+blockSize]
+		if !rollingValid {
+			rolling.Init(window)
+			rollingValid = true
+		}
+		if loc, found := index.Find(rolling.Sum(), window); found {
+			err = flushLiteral()
+			if err != nil {
+				return err
+			}
+			if pendingCopy != nil && pendingCopy.CopyLoc+pendingCopy.Length == loc {
+				pendingCopy.Length += int64(blockSize)
+			} else {
+				err = flushCopy()
+				if err != nil {
+					return err
+				}
+				pendingCopy = messages.NewCopyDeltaMessage(outLoc, loc, int64(blockSize))
+			}
+			outLoc += int64(blockSize)
+			pos += blockSize
+			litStart = pos
+			rollingValid = false
+			continue
+		}
+		if pos+blockSize < len(buf) {
+			rolling.Roll(buf[pos], buf[pos+blockSize])
+		} else {
+			rollingValid = false
+		}
+		pos++
+		if int64(pos-litStart) >= maxLiteral {
+			err = flushLiteral()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
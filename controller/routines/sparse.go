@@ -0,0 +1,85 @@
+package routines
+
+import (
+	"errors"
+	"github.com/ftarlao/goblocksync/data/configuration"
+	"github.com/ftarlao/goblocksync/utils"
+	"os"
+)
+
+// Returned by PunchHole when the file system (or the OS) cannot deallocate file regions
+var ErrHolesUnsupported = errors.New("hole punching is not supported")
+
+// Deallocation of file regions, the region reads back as zeros
+type HolePuncher interface {
+	PunchHole(off int64, length int64) error
+}
+
+// Regular destination file of the sparse mode, the Writer punches holes for the zero regions instead of writing them
+type SparseFile struct {
+	*os.File
+}
+
+func NewSparseFile(f *os.File) *SparseFile {
+	return &SparseFile{File: f}
+}
+
+// Deallocates [off, off+length), a region beyond the end of the file extends the file (the extension is a hole)
+func (f *SparseFile) PunchHole(off int64, length int64) error {
+	fileInfo, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := fileInfo.Size()
+	if off+length > size {
+		err = f.Truncate(off + length)
+		if err != nil {
+			return err
+		}
+	}
+	if off >= size {
+		return nil
+	}
+	if off+length > size {
+		length = size - off
+	}
+	return punchHole(f.File, off, length)
+}
+
+// Zeroes [off, off+length) of a block device (or of a file), the sector aligned part is discarded and zeroed by the
+// device when supported, the rest is written with zeros. The region is synced
+func ZeroRange(f *os.File, off int64, length int64, sectorSize int64) error {
+	if sectorSize <= 0 {
+		sectorSize = configuration.DefaultSectorSize
+	}
+	head := utils.IntMin((sectorSize-off%sectorSize)%sectorSize, length)
+	err := writeZeros(f, off, head)
+	if err != nil {
+		return err
+	}
+	off += head
+	length -= head
+	aligned := length - length%sectorSize
+	if aligned > 0 && zeroOut(f, off, aligned) != nil {
+		err = writeZeros(f, off, aligned)
+		if err != nil {
+			return err
+		}
+	}
+	err = writeZeros(f, off+aligned, length-aligned)
+	if err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func writeZeros(f *os.File, off int64, length int64) error {
+	zeros := make([]byte, utils.IntMin(length, configuration.WriteCoalesceMaxBytes))
+	for done := int64(0); done < length; done += int64(len(zeros)) {
+		_, err := f.WriteAt(zeros[:utils.IntMin(int64(len(zeros)), length-done)], off+done)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
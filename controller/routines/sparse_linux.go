@@ -0,0 +1,38 @@
+//go:build linux
+
+package routines
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Block device ioctls, see linux/fs.h
+const blkDiscard = 0x1277
+const blkZeroOut = 0x127f
+
+// fallocate mode flags, FALLOC_FL_KEEP_SIZE | FALLOC_FL_PUNCH_HOLE
+const fallocPunchHole = 0x01 | 0x02
+
+func punchHole(f *os.File, off int64, length int64) error {
+	err := syscall.Fallocate(int(f.Fd()), fallocPunchHole, off, length)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return ErrHolesUnsupported
+	}
+	if err != nil {
+		return &os.PathError{Op: "fallocate", Path: f.Name(), Err: err}
+	}
+	return nil
+}
+
+// Discards the sector aligned region of a block device (best effort), then zeroes it
+func zeroOut(f *os.File, off int64, length int64) error {
+	region := [2]uint64{uint64(off), uint64(length)}
+	syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), blkDiscard, uintptr(unsafe.Pointer(&region)))
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), blkZeroOut, uintptr(unsafe.Pointer(&region)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package routines
+
+import "os"
+
+func punchHole(f *os.File, off int64, length int64) error {
+	return ErrHolesUnsupported
+}
+
+func zeroOut(f *os.File, off int64, length int64) error {
+	return ErrHolesUnsupported
+}
@@ -0,0 +1,259 @@
+package routines
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ftarlao/goblocksync/data/messages"
+	"github.com/ftarlao/goblocksync/utils"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The Writer applies the DataBlockMessages to the destination file, the blocks are queued in a bounded input channel
+// and written by a dedicated goroutine with positioned writes. Adjacent blocks are coalesced in larger writes.
+// ZeroBlockMessages are written as zeros, or deallocated when the file is a HolePuncher (e.g. a SparseFile).
+// An EndMessage in input flushes and syncs the file, the EndMessage is then provided in output. CheckpointMessages are
+// handled the same way, but the writer goes on and checkpoints may be dropped when the output is full. The first write error
+// is provided as an ErrorMessage in output; the following blocks are discarded till the EndMessage.
+type Writer interface {
+	GetInMsgChannel() chan messages.Message
+	GetOutMsgChannel() chan messages.Message
+	Start() error
+	Stop() error
+	GetWrittenBytes() int64
+	IsRunning() bool
+}
+
+// Positioned writes, implemented by *os.File
+type WriterAtSyncer interface {
+	WriteAt(b []byte, off int64) (n int, err error)
+	Sync() error
+}
+
+type writerImpl struct {
+	// Destination file descriptor
+	fileDesc WriterAtSyncer
+	// Max size of a coalesced write [bytes]
+	maxWriteBytes int64
+	// Input chan for the blocks to write (and CheckpointMessage, EndMessage)
+	inMsgChannel chan messages.Message
+	// Output chan for CheckpointMessage, EndMessage and ErrorMessage
+	outMsgChannel chan messages.Message
+	// Total written bytes
+	writtenBytes int64
+	// Current running status
+	running int
+	// lockWriter on Start/Stop
+	lockWriter sync.Mutex
+	// channel for stop signals
+	stopChannel chan bool
+	// closed on Stop
+	doneChannel chan bool
+}
+
+func (w *writerImpl) GetInMsgChannel() chan messages.Message {
+	return w.inMsgChannel
+}
+
+func (w *writerImpl) GetOutMsgChannel() chan messages.Message {
+	return w.outMsgChannel
+}
+
+func (w *writerImpl) Start() error {
+	w.lockWriter.Lock()
+	defer w.lockWriter.Unlock()
+	if w.running != STOPPED {
+		return errors.New("the 'writer' is already running")
+	}
+	w.running = RUNNING
+
+	go writerRoutine(w)
+
+	return nil
+}
+
+func writerRoutine(w *writerImpl) {
+	defer func() {
+		if r := recover(); r != nil { //defensive
+			w.outMsgChannel <- messages.NewErrorMessage(fmt.Errorf("writer failure: %v", r))
+		}
+	}()
+	defer func() {
+		w.stopChannel <- true
+	}()
+
+	// pending coalesced write
+	var pendingLoc int64
+	pending := make([]byte, 0, w.maxWriteBytes)
+	var failed bool
+	// nil when the file is not sparse, or when the file system cannot punch holes
+	puncher, _ := w.fileDesc.(HolePuncher)
+	var zeros []byte
+
+	flush := func() {
+		if len(pending) == 0 || failed {
+			pending = pending[:0]
+			return
+		}
+		n, err := w.fileDesc.WriteAt(pending, pendingLoc)
+		atomic.AddInt64(&w.writtenBytes, int64(n))
+		pending = pending[:0]
+		if err != nil {
+			failed = true
+			w.outMsgChannel <- messages.NewErrorMessage(err)
+		}
+	}
+
+	add := func(startLoc int64, data []byte) {
+		adjacent := pendingLoc+int64(len(pending)) == startLoc
+		if !adjacent || int64(len(pending)+len(data)) > w.maxWriteBytes {
+			flush()
+		}
+		if len(pending) == 0 {
+			pendingLoc = startLoc
+		}
+		pending = append(pending, data...)
+		if int64(len(data)) > w.maxWriteBytes {
+			//bigger than the coalescing buffer, written as is
+			flush()
+		}
+	}
+
+	for {
+		var msg messages.Message
+		// Flush when no other blocks are immediately available, coalescing should never delay the writes
+		select {
+		case msg = <-w.inMsgChannel:
+		default:
+			flush()
+			select {
+			case msg = <-w.inMsgChannel:
+			case <-w.doneChannel:
+				return
+			}
+		}
+
+		switch msg.GetMessageID() {
+		case messages.DataBlockMessageID:
+			dataMsg := msg.(*messages.DataBlockMessage)
+			add(dataMsg.StartLoc, dataMsg.Data)
+		case messages.ZeroBlockMessageID:
+			zeroMsg := msg.(*messages.ZeroBlockMessage)
+			if failed || zeroMsg.Length <= 0 {
+				continue
+			}
+			if puncher != nil {
+				flush()
+				err := puncher.PunchHole(zeroMsg.StartLoc, zeroMsg.Length)
+				if err == nil {
+					atomic.AddInt64(&w.writtenBytes, zeroMsg.Length)
+					continue
+				}
+				if err != ErrHolesUnsupported {
+					failed = true
+					w.outMsgChannel <- messages.NewErrorMessage(err)
+					continue
+				}
+				//zeros are written from now on
+				puncher = nil
+			}
+			if zeros == nil {
+				zeros = make([]byte, w.maxWriteBytes)
+			}
+			for done := int64(0); done < zeroMsg.Length; done += int64(len(zeros)) {
+				add(zeroMsg.StartLoc+done, zeros[:utils.IntMin(int64(len(zeros)), zeroMsg.Length-done)])
+			}
+		case messages.CheckpointMessageID:
+			//the blocks before the checkpoint are durable when it is provided back
+			flush()
+			if failed {
+				continue
+			}
+			err := w.fileDesc.Sync()
+			if err != nil {
+				failed = true
+				w.outMsgChannel <- messages.NewErrorMessage(err)
+				continue
+			}
+			select {
+			case w.outMsgChannel <- msg:
+			default:
+				//a later checkpoint supersedes this one, the routine never blocks on output
+			}
+		case messages.EndMessageID:
+			flush()
+			if failed {
+				//the error has already been notified
+				return
+			}
+			err := w.fileDesc.Sync()
+			if err != nil {
+				w.outMsgChannel <- messages.NewErrorMessage(err)
+				return
+			}
+			w.outMsgChannel <- msg
+			return
+		default:
+			if !failed {
+				failed = true
+				w.outMsgChannel <- messages.NewErrorMessage(fmt.Errorf("unexpected msg type %d provided to the writer", msg.GetMessageID()))
+			}
+		}
+	}
+}
+
+func (w *writerImpl) Stop() error {
+	w.lockWriter.Lock()
+	defer w.lockWriter.Unlock()
+	if w.running != RUNNING {
+		return nil
+	}
+	w.running = SHUTDOWN
+	close(w.doneChannel)
+	select {
+	case <-w.stopChannel:
+	case <-time.After(stopTimeout):
+		return errors.New("stop timeout")
+	}
+	return nil
+}
+
+func (w *writerImpl) GetWrittenBytes() int64 {
+	return atomic.LoadInt64(&w.writtenBytes)
+}
+
+func (w *writerImpl) IsRunning() bool {
+	w.lockWriter.Lock()
+	defer w.lockWriter.Unlock()
+	return w.running == RUNNING
+}
+
+// queueSize is the max number of queued blocks, maxWriteBytes is the max size of a coalesced write
+func NewWriterImpl(fileDesc WriterAtSyncer, queueSize int, maxWriteBytes int64) Writer {
+	instance := writerImpl{
+		fileDesc:      fileDesc,
+		maxWriteBytes: maxWriteBytes,
+		running:       STOPPED}
+
+	instance.inMsgChannel = make(chan messages.Message, queueSize)
+	// room for the error(s) and the EndMessage, the routine never blocks on output
+	instance.outMsgChannel = make(chan messages.Message, 3)
+	instance.stopChannel = make(chan bool, 1)
+	instance.doneChannel = make(chan bool)
+	return &instance
+}
+
+// Opens the destination for positioned read-write access, regular files are created when missing, block devices
+// are opened as they are
+func OpenWritable(fileName string) (*os.File, error) {
+	fileInfo, err := os.Stat(fileName)
+	if err == nil && fileInfo.Mode()&os.ModeDevice != 0 {
+		return os.OpenFile(fileName, os.O_RDWR, 0)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0644)
+}
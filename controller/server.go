@@ -0,0 +1,207 @@
+package controller
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Slave daemon, accepts master connections and runs a slave on each connection: the handshake, then the sessions of
+// the master (configuration plus role) one after the other. The sessions are confined to the root directory: relative
+// paths are relative to the root, absolute paths and symbolic links should stay inside it. A daemon listening on a non
+// loopback address requires the TLS client authentication
+
+type Server struct {
+	// Listen address host:port
+	Address string
+	// Directory containing all the files of the sessions
+	Root string
+	// TLS configuration, nil for plain TCP
+	TLSConfig *tls.Config
+	listener  net.Listener
+	// Running sessions, the connections are closed when the shutdown timeout expires
+	sessions     map[net.Conn]bool
+	lockSessions sync.Mutex
+	wgSessions   sync.WaitGroup
+	shuttingDown bool
+	// closed on shutdown, the slaves waiting the next session end
+	shutdown chan bool
+}
+
+func NewServer(address string, root string) *Server {
+	return &Server{Address: address, Root: root, sessions: make(map[net.Conn]bool), shutdown: make(chan bool)}
+}
+
+// Opens the listening socket, checks the root directory and the client authentication of non loopback addresses
+func (s *Server) Listen() (err error) {
+	info, err := os.Stat(s.Root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.New("the root " + s.Root + " is not a directory")
+	}
+	if !isLoopback(s.Address) && (s.TLSConfig == nil || s.TLSConfig.ClientCAs == nil) {
+		return errors.New("listening on " + s.Address + " requires the TLS client authentication, or a loopback address")
+	}
+	s.listener, err = net.Listen("tcp", s.Address)
+	if err == nil && s.TLSConfig != nil {
+		s.listener = tls.NewListener(s.listener, s.TLSConfig)
+	}
+	return err
+}
+
+// Address the server is listening on, useful when the port is chosen by the system (":0")
+func (s *Server) ListenAddress() net.Addr {
+	return s.listener.Addr()
+}
+
+// Accepts connections till Shutdown, each session runs in its own goroutine
+func (s *Server) Serve() error {
+	if s.listener == nil {
+		return errors.New("the server is not listening")
+	}
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			s.lockSessions.Lock()
+			shuttingDown := s.shuttingDown
+			s.lockSessions.Unlock()
+			if shuttingDown {
+				return nil
+			}
+			return err
+		}
+		if !s.addSession(conn) {
+			conn.Close()
+			continue
+		}
+		go s.serveSession(conn)
+	}
+}
+
+func (s *Server) addSession(conn net.Conn) bool {
+	s.lockSessions.Lock()
+	defer s.lockSessions.Unlock()
+	if s.shuttingDown {
+		return false
+	}
+	s.sessions[conn] = true
+	s.wgSessions.Add(1)
+	return true
+}
+
+func (s *Server) serveSession(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.lockSessions.Lock()
+		delete(s.sessions, conn)
+		s.lockSessions.Unlock()
+		s.wgSessions.Done()
+	}()
+
+	//the slave logs the session records
+	slave := NewStreamSlave(conn, conn)
+	slave.master = conn.RemoteAddr().String()
+	slave.root = s.Root
+	slave.shutdown = s.shutdown
+	ProcessLogger(RoleDaemon).Debug("Connection accepted", "master", slave.master)
+	slave.Start()
+}
+
+// Stops accepting connections and waits the running sessions, after the timeout their connections are closed
+func (s *Server) Shutdown(timeout time.Duration) error {
+	s.lockSessions.Lock()
+	if !s.shuttingDown {
+		s.shuttingDown = true
+		close(s.shutdown)
+	}
+	s.lockSessions.Unlock()
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+
+	done := make(chan bool)
+	go func() {
+		s.wgSessions.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-time.After(timeout):
+	}
+
+	s.lockSessions.Lock()
+	for conn := range s.sessions {
+		conn.Close()
+	}
+	s.lockSessions.Unlock()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+	return errors.New("shutdown timeout, the running sessions have been interrupted")
+}
+
+// True when the host of the address is a loopback address, an empty host listens on all the interfaces
+func isLoopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil || host == "" {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Resolves the name inside the root directory, relative names are relative to the root. Names escaping the root,
+// through ".." or through the symbolic links of the existing part of the path, are refused
+func confine(root string, name string) (string, error) {
+	root, err := filepath.Abs(root)
+	if err == nil {
+		root, err = filepath.EvalSymlinks(root)
+	}
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(root, name)
+	}
+	name = filepath.Clean(name)
+	escape := errors.New("the path " + name + " is outside the root " + root)
+	if !inside(root, name) {
+		return "", escape
+	}
+	//the missing part of the path is created by the session, the existing part is resolved
+	existing, missing := name, ""
+	for {
+		resolved, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			existing = resolved
+			break
+		}
+		if !os.IsNotExist(err) || filepath.Dir(existing) == existing {
+			return "", err
+		}
+		missing = filepath.Join(filepath.Base(existing), missing)
+		existing = filepath.Dir(existing)
+	}
+	if !inside(root, existing) {
+		return "", escape
+	}
+	return filepath.Join(existing, missing), nil
+}
+
+// True when the clean absolute name is the root or a path inside it
+func inside(root string, name string) bool {
+	rel, err := filepath.Rel(root, name)
+	return err == nil && filepath.IsLocal(rel)
+}
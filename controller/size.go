@@ -0,0 +1,71 @@
+package controller
+
+import (
+	"fmt"
+	"github.com/ftarlao/goblocksync/controller/routines"
+	"github.com/ftarlao/goblocksync/data/configuration"
+	"github.com/ftarlao/goblocksync/data/messages"
+	"os"
+)
+
+// Completes the destination once all the blocks are written and synced: the file is checked against the source
+// digest, then its size is reconciled. Returns the outcome of the size policy, empty without the source digest
+func completeDestination(config configuration.Configuration, f *os.File, sourceDigest *messages.DigestMessage) (string, error) {
+	if sourceDigest == nil {
+		return "", nil
+	}
+	err := checkDigest(f, sourceDigest)
+	if err != nil {
+		return "", err
+	}
+	return reconcileSize(config, f, sourceDigest.Size)
+}
+
+// The master destination reports the outcome of the size policy
+func reportSize(config configuration.Configuration, progress *routines.Progress, summary string) {
+	if !config.IsMaster || config.NoSummary || summary == "" {
+		return
+	}
+	progress.Finish()
+	fmt.Println("Destination size:\t", summary)
+}
+
+// Reconciles the size of the synced destination with the source size, following the size policy. The destination
+// details of the configuration are the ones before the sync, the writes have already extended a smaller destination.
+// Returns the outcome for the summary
+func reconcileSize(config configuration.Configuration, f *os.File, sourceSize int64) (string, error) {
+	destination := config.DestinationFile
+	if destination.Size > sourceSize {
+		var err error
+		switch {
+		case destination.IsDevice && config.SizePolicy == configuration.SizeZeroTail:
+			err = routines.ZeroRange(f, sourceSize, destination.Size-sourceSize, destination.LogicalSectorSize)
+		case !destination.IsDevice && config.SizePolicy != configuration.SizeExtend:
+			err = f.Truncate(sourceSize)
+			if err == nil {
+				err = f.Sync()
+			}
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return describeSize(config, sourceSize), nil
+}
+
+// Outcome of the size policy for the source size and the destination size before the sync
+func describeSize(config configuration.Configuration, sourceSize int64) string {
+	destination := config.DestinationFile
+	switch {
+	case destination.Size == sourceSize:
+		return fmt.Sprintf("unchanged (%d bytes)", sourceSize)
+	case destination.Size < sourceSize:
+		return fmt.Sprintf("extended from %d to %d bytes", destination.Size, sourceSize)
+	case destination.IsDevice && config.SizePolicy == configuration.SizeZeroTail:
+		return fmt.Sprintf("device of %d bytes, tail of %d bytes zeroed and discarded", destination.Size, destination.Size-sourceSize)
+	case destination.IsDevice || config.SizePolicy == configuration.SizeExtend:
+		return fmt.Sprintf("%d bytes, tail of %d bytes left alone", destination.Size, destination.Size-sourceSize)
+	default:
+		return fmt.Sprintf("truncated from %d to %d bytes", destination.Size, sourceSize)
+	}
+}
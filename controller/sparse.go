@@ -0,0 +1,54 @@
+package controller
+
+import (
+	"github.com/ftarlao/goblocksync/controller/routines"
+	"github.com/ftarlao/goblocksync/data/configuration"
+	"github.com/ftarlao/goblocksync/data/messages"
+	"os"
+)
+
+// Writer of the destination file, the zero regions of a regular file are deallocated in sparse mode
+func newDestinationWriter(config configuration.Configuration, f *os.File) (routines.Writer, error) {
+	var file routines.WriterAtSyncer = f
+	if config.Sparse {
+		fileInfo, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if fileInfo.Mode().IsRegular() {
+			file = routines.NewSparseFile(f)
+		}
+	}
+	return routines.NewWriterImpl(file, int(configuration.WriteMaxBytes/config.BlockSize), configuration.WriteCoalesceMaxBytes), nil
+}
+
+// Adjacent zero blocks of the source, sent to the destination as a single ZeroBlockMessage
+type zeroRange struct {
+	startLoc int64
+	length   int64
+}
+
+// Extends the range with [startLoc, startLoc+length), a non-adjacent region sends the pending range first
+func (z *zeroRange) add(netManager *routines.NetworkManager, startLoc int64, length int64) error {
+	if z.length > 0 && z.startLoc+z.length != startLoc {
+		err := z.flush(netManager)
+		if err != nil {
+			return err
+		}
+	}
+	if z.length == 0 {
+		z.startLoc = startLoc
+	}
+	z.length += length
+	return nil
+}
+
+// Sends the pending range, if any
+func (z *zeroRange) flush(netManager *routines.NetworkManager) error {
+	if z.length == 0 {
+		return nil
+	}
+	err := netManager.Send(messages.NewZeroBlockMessage(z.startLoc, z.length))
+	z.length = 0
+	return err
+}
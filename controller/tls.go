@@ -0,0 +1,112 @@
+package controller
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/ftarlao/goblocksync/data/configuration"
+	"net"
+	"os"
+	"strings"
+)
+
+// TLS for the TCP transport. The daemon presents its certificate and, when a client CA is provided, requires and
+// verifies the master certificate (mutual authentication). The master verifies the daemon against its CA and/or a
+// pinned certificate fingerprint.
+
+// TLS configuration of the slave daemon, nil when no certificate is provided (plain TCP)
+func ServerTLSConfig(certFile string, keyFile string, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" && clientCAFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("TLS requires both the certificate and the key")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if clientCAFile != "" {
+		tlsConfig.ClientCAs, err = loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// TLS configuration of the master, nil when TLS is not enabled in the configuration
+func ClientTLSConfig(config configuration.Configuration) (*tls.Config, error) {
+	if !config.TLSEnabled() {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	host, _, err := net.SplitHostPort(config.ConnectAddress)
+	if err == nil {
+		tlsConfig.ServerName = host
+	}
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		return nil, errors.New("TLS client authentication requires both the certificate and the key")
+	}
+	if config.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.TLSCertFile, config.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if config.TLSCAFile != "" {
+		tlsConfig.RootCAs, err = loadCertPool(config.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.TLSPin != "" {
+		pin, err := parseFingerprint(config.TLSPin)
+		if err != nil {
+			return nil, err
+		}
+		//without a CA the pin is the only verification of the daemon certificate, with a CA the chain is verified too
+		tlsConfig.InsecureSkipVerify = config.TLSCAFile == ""
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 || CertificateFingerprint(state.PeerCertificates[0]) != pin {
+				return errors.New("the daemon certificate does not match the pinned fingerprint")
+			}
+			return nil
+		}
+	}
+	return tlsConfig, nil
+}
+
+// SHA-256 fingerprint of the certificate, lowercase hexadecimal
+func CertificateFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// Accepts hexadecimal fingerprints, also in the "AB:CD:.." form
+func parseFingerprint(pin string) (string, error) {
+	pin = strings.ToLower(strings.ReplaceAll(pin, ":", ""))
+	decoded, err := hex.DecodeString(pin)
+	if err != nil || len(decoded) != sha256.Size {
+		return "", fmt.Errorf("invalid certificate fingerprint %q, expected a SHA-256 in hexadecimal", pin)
+	}
+	return pin, nil
+}
+
+func loadCertPool(fileName string) (*x509.CertPool, error) {
+	pemData, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemData) {
+		return nil, errors.New("no valid PEM certificate found in " + fileName)
+	}
+	return pool, nil
+}
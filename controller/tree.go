@@ -0,0 +1,290 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ftarlao/goblocksync/controller/routines"
+	"github.com/ftarlao/goblocksync/data/configuration"
+	"github.com/ftarlao/goblocksync/data/messages"
+	"github.com/ftarlao/goblocksync/utils"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// Directory tree mode. The source walks its directory and sends a TreeEntryMessage for each directory and regular
+// file (parents first, other file types are skipped), followed by an EndMessage. The destination creates the missing
+// directories, deletes the extra entries when enabled, and replies with the entries of the files whose size or
+// modification time differ (with the destination size), followed by an EndMessage. Then the changed files are synced
+// in order by the roles of the sync mode over the same session; the destination applies the source modification time
+// and permissions to each synced file.
+
+// Directory tree sync of the local peer
+func syncTree(config configuration.Configuration, protocol int, netManager *routines.NetworkManager) error {
+	t := &tree{Config: config, protocol: protocol, netManager: netManager, logger: sessionLogger(config)}
+	var err error
+	if config.IsSource {
+		err = t.source()
+	} else {
+		err = t.destination()
+	}
+	if err != nil {
+		t.netManager.Send(messages.NewErrorMessage(err))
+		return err
+	}
+	if config.IsMaster && !config.NoSummary {
+		for _, entry := range t.changed {
+			fmt.Println("Synced file:\t\t", entry.Path)
+		}
+		fmt.Println("Tree entries:\t\t", t.entries)
+		fmt.Println("Synced files:\t\t", len(t.changed))
+	}
+	return nil
+}
+
+type tree struct {
+	Config     configuration.Configuration
+	protocol   int
+	netManager *routines.NetworkManager
+	logger     *slog.Logger
+	// Entries listed by the source, and files to sync in order
+	entries int
+	changed []*messages.TreeEntryMessage
+	// Size of the largest file of both the trees [bytes]
+	maxSize int64
+}
+
+func (t *tree) source() error {
+	root := t.Config.SourceFile.FileName
+	info, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.New("recursive mode, the source " + root + " is not a directory")
+	}
+	err = filepath.WalkDir(root, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || name == root {
+			return err
+		}
+		if !entry.IsDir() && !entry.Type().IsRegular() {
+			t.logger.Warn("Skipped, not a regular file", offsetAttr(0), "path", name)
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, name)
+		if err != nil {
+			return err
+		}
+		t.entries++
+		t.maxSize = utils.IntMax(t.maxSize, info.Size())
+		return t.netManager.Send(&messages.TreeEntryMessage{Path: filepath.ToSlash(rel), IsDir: entry.IsDir(),
+			Mode: uint32(info.Mode().Perm()), Size: info.Size(), ModTime: info.ModTime().UnixNano()})
+	})
+	if err != nil {
+		return err
+	}
+	err = t.netManager.Send(messages.NewEndMessage())
+	if err != nil {
+		return err
+	}
+	t.changed, err = t.receiveEntries()
+	if err != nil {
+		return err
+	}
+	for _, entry := range t.changed {
+		t.maxSize = utils.IntMax(t.maxSize, entry.Size)
+	}
+
+	t.setLimits()
+	for _, entry := range t.changed {
+		config := t.fileConfig(entry)
+		t.logger.Debug("Syncing file", offsetAttr(0), "path", entry.Path)
+		config.DestinationFile.Size = entry.Size
+		_, err = config.SourceFile.Update()
+		if err != nil {
+			return err
+		}
+		source, err := NewSource(config, t.protocol, t.netManager)
+		if err != nil {
+			return err
+		}
+		err = source.Start()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *tree) destination() error {
+	root := t.Config.DestinationFile.FileName
+	err := os.MkdirAll(root, 0755)
+	if err != nil {
+		return err
+	}
+	entries, err := t.receiveEntries()
+	if err != nil {
+		return err
+	}
+	t.entries = len(entries)
+	listed := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		listed[entry.Path] = true
+	}
+	if t.Config.DeleteExtras {
+		err = deleteExtras(root, listed, t.logger)
+		if err != nil {
+			return err
+		}
+	}
+	for _, entry := range entries {
+		name := filepath.Join(root, filepath.FromSlash(entry.Path))
+		info, err := os.Lstat(name)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if entry.IsDir {
+			if os.IsNotExist(err) {
+				t.logger.Debug("Created directory", offsetAttr(0), "path", name)
+				err = os.Mkdir(name, os.FileMode(entry.Mode))
+			} else if !info.IsDir() {
+				err = errors.New("recursive mode, the destination " + name + " is not a directory")
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err == nil && !info.Mode().IsRegular() {
+			return errors.New("recursive mode, the destination " + name + " is not a regular file")
+		}
+		//quick check, files with the same size and modification time are not synced
+		if err == nil && info.Size() == entry.Size && info.ModTime().UnixNano() == entry.ModTime {
+			continue
+		}
+		changed := *entry
+		changed.Size = 0
+		if err == nil {
+			changed.Size = info.Size()
+		}
+		t.maxSize = utils.IntMax(t.maxSize, utils.IntMax(entry.Size, changed.Size))
+		t.changed = append(t.changed, entry)
+		err = t.netManager.Send(&changed)
+		if err != nil {
+			return err
+		}
+	}
+	t.setLimits()
+	err = t.netManager.Send(messages.NewEndMessage())
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range t.changed {
+		config := t.fileConfig(entry)
+		t.logger.Debug("Syncing file", offsetAttr(0), "path", entry.Path)
+		config.SourceFile.Size = entry.Size
+		_, err = config.DestinationFile.Update()
+		if err == nil {
+			err = config.CheckFiles()
+		}
+		if err != nil {
+			return err
+		}
+		destination, err := NewDestination(config, t.protocol, t.netManager)
+		if err != nil {
+			return err
+		}
+		err = destination.Start()
+		if err != nil {
+			return err
+		}
+		name := config.DestinationFile.FileName
+		modTime := time.Unix(0, entry.ModTime)
+		err = os.Chmod(name, os.FileMode(entry.Mode))
+		if err == nil {
+			err = os.Chtimes(name, modTime, modTime)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Receives the tree entries till the EndMessage, the paths should stay inside the tree
+func (t *tree) receiveEntries() ([]*messages.TreeEntryMessage, error) {
+	var entries []*messages.TreeEntryMessage
+	for msg := range t.netManager.GetInMsgChannel() {
+		switch msg.GetMessageID() {
+		case messages.TreeEntryMessageID:
+			entry := msg.(*messages.TreeEntryMessage)
+			if !filepath.IsLocal(filepath.FromSlash(entry.Path)) || path.Clean(entry.Path) != entry.Path {
+				return nil, errors.New("invalid tree entry path " + entry.Path)
+			}
+			entries = append(entries, entry)
+		case messages.EndMessageID:
+			return entries, nil
+		case messages.ErrorMessageID:
+			return nil, t.netManager.MessageError(msg.(*messages.ErrorMessage))
+		default:
+			return nil, fmt.Errorf("unexpected message type %d received in the tree listing", msg.GetMessageID())
+		}
+	}
+	return nil, closedError(t.netManager, "connection closed during the tree listing")
+}
+
+// Configuration of the sync of a file of the tree, the roles of a single file never report as master
+func (t *tree) fileConfig(entry *messages.TreeEntryMessage) configuration.Configuration {
+	config := t.Config
+	config.IsMaster = false
+	config.Recursive = false
+	config.DeleteExtras = false
+	config.SourceFile = configuration.FileDetails{FileName: filepath.Join(t.Config.SourceFile.FileName, filepath.FromSlash(entry.Path))}
+	config.DestinationFile = configuration.FileDetails{FileName: filepath.Join(t.Config.DestinationFile.FileName, filepath.FromSlash(entry.Path))}
+	return config
+}
+
+// Limits of the received messages, the regions end within the largest file of both the trees. The first messages of
+// the peer may be decoded before, with the default limits
+func (t *tree) setLimits() {
+	algorithm, err := hashAlgorithm(t.Config)
+	if err != nil {
+		return
+	}
+	config := t.Config
+	config.SourceFile.Size, config.DestinationFile.Size = t.maxSize, 0
+	t.netManager.SetLimits(messages.NewLimits(config, algorithm))
+}
+
+// Deletes the entries of the destination tree that are not listed by the source
+func deleteExtras(root string, listed map[string]bool, logger *slog.Logger) error {
+	return filepath.WalkDir(root, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || name == root {
+			return err
+		}
+		rel, err := filepath.Rel(root, name)
+		if err != nil {
+			return err
+		}
+		if listed[filepath.ToSlash(rel)] {
+			return nil
+		}
+		logger.Info("Deleted", offsetAttr(0), "path", name)
+		err = os.RemoveAll(name)
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
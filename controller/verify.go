@@ -0,0 +1,132 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/ftarlao/goblocksync/controller/routines"
+	"github.com/ftarlao/goblocksync/data/configuration"
+	"github.com/ftarlao/goblocksync/data/messages"
+	"github.com/ftarlao/goblocksync/utils/hashing"
+	"io"
+	"os"
+)
+
+// End-to-end verification. The source computes the whole-file digest while its blocks are hashed and sends it before
+// the EndMessage; after all the writes the destination computes the digest of the same region of its file and fails
+// the session on a mismatch. The verify command compares the digests of two files without syncing: both peers
+// digest their file and send the digest to each other, the master reports the result.
+
+// The files compared by the verify command differ
+var ErrFilesDiffer = errors.New("files differ")
+
+// Hash algorithm of the whole-file digests
+func digestAlgorithm() (hashing.HashAlgorithm, error) {
+	algorithm, ok := hashing.Get(configuration.DigestAlgorithm)
+	if !ok {
+		return algorithm, errors.New("unknown digest algorithm " + configuration.DigestAlgorithm)
+	}
+	return algorithm, nil
+}
+
+// Checks the destination file against the source digest
+func checkDigest(f io.ReaderAt, source *messages.DigestMessage) error {
+	algorithm, ok := hashing.Get(source.Algorithm)
+	if !ok {
+		return errors.New("unknown digest algorithm " + source.Algorithm)
+	}
+	size, digest, err := routines.FileDigest(f, source.Size, algorithm, nil)
+	if err != nil {
+		return err
+	}
+	if size != source.Size || !bytes.Equal(digest, source.Digest) {
+		return fmt.Errorf("integrity verification failed, the %s digest of the destination differs from the source one", source.Algorithm)
+	}
+	return nil
+}
+
+// Peer of the verify command, for both the source and the destination
+type verifier struct {
+	Config     configuration.Configuration
+	netManager *routines.NetworkManager
+	progress   *routines.Progress
+}
+
+func (v *verifier) GetConfig() configuration.Configuration {
+	return v.Config
+}
+
+func (v *verifier) GetProgress() *routines.Progress {
+	return v.progress
+}
+
+// Returns ErrFilesDiffer on the master when the files differ
+func (v *verifier) Start() error {
+	err := v.verify()
+	if err != nil && err != ErrFilesDiffer {
+		v.netManager.Send(messages.NewErrorMessage(err))
+	}
+	return err
+}
+
+func (v *verifier) verify() error {
+	fileName := v.Config.DestinationFile.FileName
+	if v.Config.IsSource {
+		fileName = v.Config.SourceFile.FileName
+	}
+	f, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if v.Config.LocalFile().UpdateFile(f) == nil {
+		v.progress.SetTotal(v.Config.LocalFile().Size)
+	}
+	algorithm, err := digestAlgorithm()
+	if err != nil {
+		return err
+	}
+	size, digest, err := routines.FileDigest(f, -1, algorithm, v.progress)
+	if err != nil {
+		return err
+	}
+	local := messages.NewDigestMessage(algorithm.Name, size, digest)
+	//a failed peer may have closed the connection, its error is more useful than the send one
+	sendErr := v.netManager.Send(local)
+	msg, ok := <-v.netManager.GetInMsgChannel()
+	if !ok {
+		if sendErr != nil {
+			return sendErr
+		}
+		return closedError(v.netManager, "connection closed by the peer before the end of the verification")
+	}
+	switch msg.GetMessageID() {
+	case messages.DigestMessageID:
+		if sendErr != nil {
+			return sendErr
+		}
+	case messages.ErrorMessageID:
+		return v.netManager.MessageError(msg.(*messages.ErrorMessage))
+	default:
+		return fmt.Errorf("unexpected message type %d received during the verification", msg.GetMessageID())
+	}
+	remote := msg.(*messages.DigestMessage)
+	v.progress.Finish()
+	if !v.Config.IsMaster {
+		return nil
+	}
+
+	source, destination := local, remote
+	if !v.Config.IsSource {
+		source, destination = remote, local
+	}
+	fmt.Println("Source digest:\t\t", source.Algorithm, hex.EncodeToString(source.Digest), "(", source.Size, "bytes )")
+	fmt.Println("Destination digest:\t", destination.Algorithm, hex.EncodeToString(destination.Digest), "(", destination.Size, "bytes )")
+	if source.Algorithm != destination.Algorithm || source.Size != destination.Size || !bytes.Equal(source.Digest, destination.Digest) {
+		fmt.Println("Files differ")
+		return ErrFilesDiffer
+	}
+	fmt.Println("Files are identical")
+	return nil
+}
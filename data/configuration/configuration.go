@@ -2,8 +2,13 @@ package configuration
 
 import (
 	"errors"
+	"fmt"
+	"math"
 	"github.com/ftarlao/goblocksync/utils"
+	"github.com/ftarlao/goblocksync/utils/compression"
+	"github.com/ftarlao/goblocksync/utils/hashing"
 	"os"
+	"strings"
 )
 
 //TODO Should few details about Master file names be masked .. and useless fields emptied? Less infos to the slave peer
@@ -21,6 +26,69 @@ type Configuration struct {
 	StartLoc int64
 	// BlockSize [bytes]
 	BlockSize int64
+	// Sync mode, ModeBlock (default when empty), ModeMerkle or ModeRolling
+	Mode string
+	// Merkle tree fanout and number of levels above the blocks, ModeMerkle only
+	MerkleFanout int
+	MerkleLevels int
+	// Name of the hash algorithm, chosen during the handshake. When set by the user it is the only advertised one
+	HashAlgorithm string
+	// Number of hashing goroutines of each hasher, one for each CPU when zero
+	HashWorkers int
+	// Name of the data block compression algorithm, chosen during the handshake. When set by the user it is the only
+	// advertised one, "none" disables the compression
+	Compression string
+	// Bandwidth limit of both the peers [bytes/s] and burst [bytes], zero rate is no limit and zero burst is the
+	// default burst of the rate
+	BandwidthLimit int64
+	BandwidthBurst int64
+	// Destination size policy, SizeTruncate (default when empty), SizeExtend, SizeRefuse or SizeZeroTail
+	SizePolicy string
+	// Sparse destination, the zero regions sent by the source are deallocated (hole punching) instead of written when
+	// the destination is a regular file, block and merkle modes
+	Sparse bool
+	// Disables the CRC32C trailers of the exchanged messages, advertised by the master in the handshake
+	NoChecksums bool
+	// Progress report of the master on stderr
+	Progress bool
+	// No summary of the master on stdout, e.g. for the concurrent jobs whose lines would interleave
+	NoSummary bool
+	// Remote peer [user@]host running the slave, empty when the slave runs locally
+	RemoteHost string
+	// Remote shell command template used to reach RemoteHost, e.g. "ssh -p 2222"
+	RemoteShell string
+	// Path of the goblocksync executable on RemoteHost
+	RemoteCommand string
+	// Address host:port of the slave daemon, when set the slave is reached through TCP instead of the remote shell
+	ConnectAddress string
+	// TLS for the TCP transport: client certificate and key, CA of the daemon certificate, SHA-256 fingerprint of the
+	// daemon certificate (hexadecimal)
+	TLSCertFile string
+	TLSKeyFile  string
+	TLSCAFile   string
+	TLSPin      string
+	// Commands run by the master before and after the sync, in the remote shell syntax (no shell), no hook when empty.
+	// A failing hook fails the sync
+	PreHook  string
+	PostHook string
+	// Checkpoint journal of the master, when set the block mode confirms the synced regions with checkpoints
+	JournalFile string
+	// Resumed sync of the journal, the master checks both the files against the journal once they are discovered
+	Resume bool
+	// Dry run, the differing regions are reported (ReportFormat) by the master and the destination is not written
+	DryRun       bool
+	ReportFormat string
+	// Verify command, the digests of the files are compared and nothing is synced
+	Verify bool
+	// Directory tree sync, source and destination are directories whose files are matched by relative path. The
+	// destination entries missing in the source are deleted when DeleteExtras is set
+	Recursive    bool
+	DeleteExtras bool
+	// ID of the sync session, generated by the master; the log records of both the peers carry it
+	SessionID string
+	// Logging of the master, passed to the slave it starts: debug records and format (LogText, LogJSON)
+	Verbose   bool
+	LogFormat string
 }
 
 //TODO integrate validation
@@ -31,19 +99,205 @@ func (c *Configuration) Validate() (bool, error) {
 		err = errors.New("please provide source and destination file names")
 		return correct, err
 	}
-	correct = c.BlockSize > 0
+	return c.ValidateOptions()
+}
+
+// Validates the options, the source and destination file names excluded
+func (c *Configuration) ValidateOptions() (bool, error) {
+	var err error
+	correct := c.BlockSize > 0 && c.BlockSize <= MaxBlockSize
 	if !correct {
-		err = errors.New("block size [byte] should be greater than zero")
+		err = fmt.Errorf("block size [byte] should be greater than zero and at most %d", MaxBlockSize)
 		return correct, err
 	}
+	switch c.Mode {
+	case "", ModeBlock:
+	case ModeMerkle:
+		if c.MerkleFanout < 2 || c.MerkleFanout > HashGroupMessageSize {
+			err = fmt.Errorf("merkle fanout should be between 2 and %d", HashGroupMessageSize)
+			return false, err
+		}
+		if c.MerkleLevels < 1 || c.MerkleLevels > 255 {
+			err = errors.New("merkle levels should be between 1 and 255")
+			return false, err
+		}
+		//the top nodes size should be representable
+		for i, size := 0, c.BlockSize; i < c.MerkleLevels; i++ {
+			if size > math.MaxInt64/int64(c.MerkleFanout) {
+				err = errors.New("merkle top nodes are too large, reduce fanout or levels")
+				return false, err
+			}
+			size *= int64(c.MerkleFanout)
+		}
+	case ModeRolling:
+		//the destination file is rebuilt from scratch
+		if c.StartLoc != 0 {
+			err = errors.New("rolling mode syncs whole files, the start location should be zero")
+			return false, err
+		}
+	default:
+		err = errors.New("unknown sync mode " + c.Mode)
+		return false, err
+	}
+	if c.DryRun {
+		if c.Mode != "" && c.Mode != ModeBlock {
+			err = errors.New("the dry run is available only in block mode")
+			return false, err
+		}
+		if c.ReportFormat != ReportText && c.ReportFormat != ReportJSON {
+			err = errors.New("unknown report format " + c.ReportFormat)
+			return false, err
+		}
+	}
+	if c.Verify && (c.DryRun || c.JournalFile != "") {
+		err = errors.New("the verify command cannot be combined with a dry run or a journal")
+		return false, err
+	}
+	switch c.SizePolicy {
+	case "", SizeTruncate, SizeRefuse, SizeZeroTail:
+	case SizeExtend:
+		if c.Mode == ModeRolling {
+			err = errors.New("rolling mode rebuilds the destination, the extend size policy is not available")
+			return false, err
+		}
+	default:
+		err = errors.New("unknown size policy " + c.SizePolicy)
+		return false, err
+	}
+	if c.LogFormat != "" && c.LogFormat != LogText && c.LogFormat != LogJSON {
+		err = errors.New("unknown log format " + c.LogFormat)
+		return false, err
+	}
+	if c.Recursive && (c.Verify || c.DryRun || c.JournalFile != "" || c.StartLoc != 0) {
+		err = errors.New("the recursive mode cannot be combined with verify, dry run, journal or start location")
+		return false, err
+	}
+	if c.DeleteExtras && !c.Recursive {
+		err = errors.New("deleting the extra destination entries requires the recursive mode")
+		return false, err
+	}
+	for _, hook := range []string{c.PreHook, c.PostHook} {
+		if hook == "" {
+			continue
+		}
+		args, splitErr := utils.SplitCommandLine(hook)
+		if splitErr != nil || len(args) == 0 {
+			err = errors.New("invalid hook command " + hook)
+			return false, err
+		}
+	}
+	if c.Resume && c.JournalFile == "" {
+		err = errors.New("resuming a sync requires its checkpoint journal")
+		return false, err
+	}
+	if c.JournalFile != "" && c.Mode != "" && c.Mode != ModeBlock {
+		err = errors.New("the checkpoint journal is available only in block mode")
+		return false, err
+	}
+	if c.BandwidthLimit < 0 || c.BandwidthBurst < 0 {
+		err = errors.New("bandwidth limit and burst should not be negative")
+		return false, err
+	}
+	if c.TLSEnabled() && c.ConnectAddress == "" && c.IsMaster {
+		err = errors.New("TLS options are available only for the TCP transport (-connect)")
+		return false, err
+	}
+	if c.HashAlgorithm != "" {
+		_, correct = hashing.Get(c.HashAlgorithm)
+		if !correct {
+			err = errors.New("unknown hash algorithm " + c.HashAlgorithm)
+			return correct, err
+		}
+	}
+	if c.Compression != "" {
+		_, correct = compression.Get(c.Compression)
+		if !correct {
+			err = errors.New("unknown compression algorithm " + c.Compression)
+			return correct, err
+		}
+	}
 	return correct, err
 }
 
+// Details of the file of the local peer, the source file on the source
+func (c *Configuration) LocalFile() *FileDetails {
+	if c.IsSource {
+		return &c.SourceFile
+	}
+	return &c.DestinationFile
+}
+
+// Details of the file of the remote peer
+func (c *Configuration) RemoteFile() *FileDetails {
+	if c.IsSource {
+		return &c.DestinationFile
+	}
+	return &c.SourceFile
+}
+
+// Checks the discovered details of both the files, before the sync starts. The files of a directory tree are checked
+// one by one
+func (c *Configuration) CheckFiles() error {
+	if c.Verify || c.DryRun || c.Recursive {
+		return nil
+	}
+	if c.SizePolicy == SizeRefuse && c.SourceFile.Size != c.DestinationFile.Size {
+		return fmt.Errorf("source and destination sizes differ (%d and %d bytes), refused by the size policy",
+			c.SourceFile.Size, c.DestinationFile.Size)
+	}
+	if !c.DestinationFile.IsDevice {
+		return nil
+	}
+	if c.Mode == ModeRolling {
+		return errors.New("rolling mode requires a regular destination file, " + c.DestinationFile.FileName + " is a block device")
+	}
+	if c.SourceFile.Size > c.DestinationFile.Size {
+		return fmt.Errorf("the source (%d bytes) does not fit in the destination device (%d bytes)", c.SourceFile.Size,
+			c.DestinationFile.Size)
+	}
+	return nil
+}
+
+// Sets source and destination from the user locations, [user@]host:path for the remote file. The master is the source
+// unless the source is remote
+func (c *Configuration) SetLocations(source string, destination string) error {
+	sourceHost, sourceFileName := ParseLocation(source)
+	destinationHost, destinationFileName := ParseLocation(destination)
+	if sourceHost != "" && destinationHost != "" {
+		return errors.New("source and destination cannot be both remote")
+	}
+	c.RemoteHost = sourceHost + destinationHost
+	if c.ConnectAddress != "" && c.RemoteHost == "" {
+		return errors.New("with a daemon address (-connect) the source or the destination should be remote (host:path)")
+	}
+	c.IsSource = sourceHost == ""
+	c.SourceFile = FileDetails{FileName: sourceFileName}
+	c.DestinationFile = FileDetails{FileName: destinationFileName}
+	return nil
+}
+
+// True when the TCP transport should be protected by TLS
+func (c *Configuration) TLSEnabled() bool {
+	return c.TLSCertFile != "" || c.TLSKeyFile != "" || c.TLSCAFile != "" || c.TLSPin != ""
+}
+
+// Splits an rsync-like location [user@]host:/path in host and path, host is empty for local paths. A colon after a
+// slash is part of a local path (e.g. ./file:name)
+func ParseLocation(location string) (host string, path string) {
+	colon := strings.Index(location, ":")
+	if colon <= 0 || strings.Contains(location[:colon], "/") {
+		return "", location
+	}
+	return location[:colon], location[colon+1:]
+}
+
 //Creates the configuration that should be provided to the remote peer
 func (c *Configuration) Complement() Configuration {
 	conf := *c //copy value
 	conf.IsMaster = !c.IsMaster
 	conf.IsSource = !c.IsSource
+	//the hooks run on the master only
+	conf.PreHook, conf.PostHook = "", ""
 	return conf
 }
 
@@ -59,20 +313,58 @@ func (c *Configuration) EstimateNetworkChannelSize() int {
 
 type FileDetails struct {
 	FileName string
-	//file size [Bytes]
-	size int64
-	// true when file represents a device (Linux/Unix/iOS)
-	isDevice bool
+	//file size [Bytes], device size for block devices
+	Size int64
+	// true when file represents a block device (Linux/Unix/iOS)
+	IsDevice bool
+	// logical and physical sector sizes [Bytes] of block devices, zero for regular files
+	LogicalSectorSize  int64
+	PhysicalSectorSize int64
+	// modification time [ns since the Unix epoch] and inode number, they identify the file; zero when the file does
+	// not exist, the inode is zero when not available
+	ModTime int64
+	Inode   uint64
 }
 
-func (f FileDetails) Update() (bool, error) {
-	fileInfo, err := os.Stat("/path/to/file")
+// Discovers the details of the file FileName, returns false (and zeroed details) when the file does not exist
+func (f *FileDetails) Update() (bool, error) {
+	file, err := os.Open(f.FileName)
+	if os.IsNotExist(err) {
+		*f = FileDetails{FileName: f.FileName}
+		return false, nil
+	}
 	if err != nil {
 		return false, err
 	}
-	// get the size
-	f.size = fileInfo.Size()
-	f.isDevice = false
-	//TODO to operate with block devices.. for real
-	return true, err
+	defer file.Close()
+	return true, f.UpdateFile(file)
+}
+
+// Discovers the details of the open file
+func (f *FileDetails) UpdateFile(file *os.File) error {
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	details := FileDetails{FileName: f.FileName, ModTime: fileInfo.ModTime().UnixNano(), Inode: inode(fileInfo)}
+	if fileInfo.Mode()&os.ModeDevice == 0 || fileInfo.Mode()&os.ModeCharDevice != 0 {
+		details.Size = fileInfo.Size()
+		*f = details
+		return nil
+	}
+	details.IsDevice = true
+	details.Size, details.LogicalSectorSize, details.PhysicalSectorSize, err = deviceDetails(file)
+	if err != nil {
+		return err
+	}
+	*f = details
+	return nil
+}
+
+func (f FileDetails) String() string {
+	if !f.IsDevice {
+		return fmt.Sprintf("%s (%d bytes)", f.FileName, f.Size)
+	}
+	return fmt.Sprintf("%s (block device, %d bytes, %d/%d bytes logical/physical sectors)", f.FileName, f.Size,
+		f.LogicalSectorSize, f.PhysicalSectorSize)
 }
@@ -1,6 +1,9 @@
 package configuration
 
-import "github.com/ftarlao/goblocksync/utils"
+import (
+	"github.com/ftarlao/goblocksync/utils"
+	"time"
+)
 
 // Hardcoded constants
 const MajorVersion = 0
@@ -16,13 +19,114 @@ const HashMaxBytes = 64 * utils.MB
 //Bytes for buffered queued data (64M)
 const DataMaxBytes = 64 * utils.MB
 
+//Bytes for blocks queued to the destination writer (64M)
+const WriteMaxBytes = 64 * utils.MB
+
+//Max size of a coalesced destination write (4M)
+const WriteCoalesceMaxBytes = 4 * utils.MB
+
 // Hash size [bytes], this is currently used by the dumb hash function
 const HashSize = 32
 
 // Size of the HashGroupMessage channel buffer (max number elements in the channel)
 const HashGroupChannelSize = HashMaxBytes / (HashGroupMessageSize * HashSize)
 
-var SupportedProtocols = []int{1}
+// Protocol versions: gob encoded messages (the hello messages of every version) and binary frames
+const ProtocolGob = 1
+const ProtocolBinary = 2
+
+var SupportedProtocols = []int{ProtocolGob, ProtocolBinary}
+
+// Max payload of a binary frame [bytes], larger frames are refused before reading them
+const MaxFrameSize = MaxBlockSize + MessageOverhead
+
+// Room for the fields of a message besides its data or hashes, and for the configuration [bytes]
+const MessageOverhead = 64 * utils.KB
+
+// Max size of a hash or digest [bytes]
+const MaxHashSize = 64
+
+// Max length of the relative paths of a directory tree sync [bytes]
+const MaxPathLength = 4096
+
+// Max number of protocols, hash algorithms or compressions advertised in a hello message
+const MaxHelloListSize = 64
+
+// Max block size [bytes]
+const MaxBlockSize = 64 * utils.MB
+
+// Default remote shell, used to start the slave on a remote host
+const DefaultRemoteShell = "ssh"
+
+// Default path of the goblocksync executable on the remote host
+const DefaultRemoteCommand = "goblocksync"
+
+// Default listen address of the slave daemon
+const DefaultListenAddress = "127.0.0.1:7373"
+
+// Max wait for the TCP connection to the slave daemon
+const DialTimeout = 30 * time.Second
+
+// Max wait for the running sessions when the slave daemon shuts down
+const ShutdownTimeout = 30 * time.Second
+
+// Sync modes: block-by-block hashes, Merkle tree hierarchical hashes, or rolling checksum deltas (regular files)
+const ModeBlock = "block"
+const ModeMerkle = "merkle"
+const ModeRolling = "rolling"
+
+// Default Merkle tree fanout and number of levels above the blocks, with 4K blocks the top nodes cover 1G
+const DefaultMerkleFanout = 64
+const DefaultMerkleLevels = 3
+
+// Max number of Merkle hash requests waiting for the reply
+const MerkleMaxPendingRequests = 32
+
+// Distance between the sync checkpoints of the block mode, recorded in the master journal (1G)
+const CheckpointInterval = 1 * utils.GB
+
+// Hash algorithm of the whole-file digests, end-to-end verification of the sync and verify command
+const DigestAlgorithm = "sha256"
+
+// Destination size policies. Truncate: regular files are extended or truncated to the source size, the tail of a
+// larger device is left alone. Extend: the destination is only extended. Refuse: different sizes are refused before
+// the sync. ZeroTail: as truncate, but the tail of a larger device is zeroed and discarded
+const SizeTruncate = "truncate"
+const SizeExtend = "extend"
+const SizeRefuse = "refuse"
+const SizeZeroTail = "zero-tail"
+
+// Formats of the dry run report
+const ReportText = "text"
+const ReportJSON = "json"
+
+// Formats of the log records
+const LogText = "text"
+const LogJSON = "json"
+
+// Attributes of the session log records: session ID, role of the peer (e.g. master/source) and sync offset [bytes]
+const LogSession = "session"
+const LogRole = "role"
+const LogOffset = "offset"
+
+// Min burst of the bandwidth limit [bytes], the default burst is a tenth of a second of traffic
+const MinBandwidthBurst = 16 * utils.KB
+
+// Refresh interval of the progress line on a terminal, and interval of the progress log lines otherwise
+const ProgressRefreshInterval = 250 * time.Millisecond
+const ProgressLogInterval = 10 * time.Second
+
+// Sector size [bytes] of the block devices whose sector sizes cannot be discovered
+const DefaultSectorSize = 512
+
+// Default block size [bytes]
+const DefaultBlockSize = 4096
+
+// Size of the network channels before the configuration is known (slave side)
+const DefaultNetworkChannelSize = 64
+
+// Max wait for the handshake messages
+const HandshakeTimeout = 30 * time.Second
 
 // Max number of messages in the message queue, this should be only a small buffer (we have TCP buffers, other queues..)
 // The effective max size [bytes] depends on the message types, max block size.. it should range (approximately) between:
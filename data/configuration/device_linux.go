@@ -0,0 +1,60 @@
+//go:build linux
+
+package configuration
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Block device ioctls, see linux/fs.h
+const blkGetSize64 = 0x80081272
+const blkSectorSize = 0x1268
+const blkPhysicalSectorSize = 0x127b
+
+// Size and sector sizes of the block device, the size falls back to seek-to-end and the sector sizes to
+// DefaultSectorSize when the ioctls are not available
+func deviceDetails(file *os.File) (size int64, logical int64, physical int64, err error) {
+	var size64 uint64
+	if ioctl(file, blkGetSize64, unsafe.Pointer(&size64)) == nil {
+		size = int64(size64)
+	} else {
+		size, err = file.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		_, err = file.Seek(0, io.SeekStart)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+	}
+	var sector int32
+	logical = DefaultSectorSize
+	if ioctl(file, blkSectorSize, unsafe.Pointer(&sector)) == nil && sector > 0 {
+		logical = int64(sector)
+	}
+	var physicalSector uint32
+	physical = logical
+	if ioctl(file, blkPhysicalSectorSize, unsafe.Pointer(&physicalSector)) == nil && physicalSector > 0 {
+		physical = int64(physicalSector)
+	}
+	return size, logical, physical, nil
+}
+
+func ioctl(file *os.File, request uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), request, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Inode number of the file
+func inode(fileInfo os.FileInfo) uint64 {
+	if stat, ok := fileInfo.Sys().(*syscall.Stat_t); ok {
+		return stat.Ino
+	}
+	return 0
+}
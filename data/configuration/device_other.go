@@ -0,0 +1,26 @@
+//go:build !linux
+
+package configuration
+
+import (
+	"io"
+	"os"
+)
+
+// Size of the block device by seek-to-end, the sector sizes are DefaultSectorSize
+func deviceDetails(file *os.File) (size int64, logical int64, physical int64, err error) {
+	size, err = file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return size, DefaultSectorSize, DefaultSectorSize, nil
+}
+
+// Inode number of the file, not available
+func inode(fileInfo os.FileInfo) uint64 {
+	return 0
+}
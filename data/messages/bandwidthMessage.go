@@ -0,0 +1,18 @@
+package messages
+
+const BandwidthMessageID byte = 10
+
+// New bandwidth limit of the peer, Rate [bytes/s] and Burst [bytes]. A Rate of zero removes the limit. The message is
+// applied by the receiving NetworkManager and it is not delivered to the controllers
+type BandwidthMessage struct {
+	Rate  int64
+	Burst int64
+}
+
+func NewBandwidthMessage(rate int64, burst int64) *BandwidthMessage {
+	return &BandwidthMessage{Rate: rate, Burst: burst}
+}
+
+func (*BandwidthMessage) GetMessageID() byte {
+	return BandwidthMessageID
+}
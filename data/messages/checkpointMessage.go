@@ -0,0 +1,17 @@
+package messages
+
+const CheckpointMessageID byte = 8
+
+// Sync checkpoint, sent by the source when all the blocks before Loc have been sent. The destination writes and syncs
+// the blocks, then replies with the same message: the region before Loc is confirmed
+type CheckpointMessage struct {
+	Loc int64
+}
+
+func NewCheckpointMessage(loc int64) *CheckpointMessage {
+	return &CheckpointMessage{Loc: loc}
+}
+
+func (*CheckpointMessage) GetMessageID() byte {
+	return CheckpointMessageID
+}
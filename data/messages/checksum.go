@@ -0,0 +1,133 @@
+package messages
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// CRC32C trailer of the encoded messages, enabled in the handshake when both peers advertise it. Each gob message
+// (protocol version 1) or binary frame (protocol version 2) sent after the hello is followed by the CRC32C
+// (Castagnoli) of its encoded bytes, 4 bytes unsigned big-endian.
+
+// Size of the CRC32C trailer [bytes]
+const ChecksumSize = 4
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Corrupted message, the CRC32C of the received bytes differs from the trailer. The stream cannot be trusted after
+// it, the error is not retryable
+type CorruptionError struct {
+	// Offset of the first byte of the message in the input stream [bytes]
+	Offset int64
+	// Trailer sent by the peer and CRC32C of the received bytes
+	Expected uint32
+	Actual   uint32
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("corrupted message at stream offset %d, CRC32C %08x instead of %08x", e.Offset, e.Actual,
+		e.Expected)
+}
+
+// Always false, the corrupted stream cannot be resumed
+func (e *CorruptionError) Temporary() bool {
+	return false
+}
+
+// Output stream of the encoded messages, computes the CRC32C of the bytes written since Begin
+type ChecksumWriter struct {
+	w   io.Writer
+	crc uint32
+}
+
+func NewChecksumWriter(w io.Writer) *ChecksumWriter {
+	return &ChecksumWriter{w: w}
+}
+
+func (c *ChecksumWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.crc = crc32.Update(c.crc, castagnoli, p[:n])
+	return n, err
+}
+
+// Starts a new message
+func (c *ChecksumWriter) Begin() {
+	c.crc = 0
+}
+
+// Writes the CRC32C trailer of the message started by Begin
+func (c *ChecksumWriter) WriteTrailer() error {
+	var trailer [ChecksumSize]byte
+	binary.BigEndian.PutUint32(trailer[:], c.crc)
+	_, err := c.w.Write(trailer[:])
+	return err
+}
+
+// Buffered input stream of the encoded messages, computes the CRC32C of the bytes read since Begin and the stream
+// offset. It is an io.ByteReader, the gob decoder reads exactly its messages and nothing else
+type ChecksumReader struct {
+	r   *bufio.Reader
+	crc uint32
+	// bytes read from the stream and offset of the current message
+	offset int64
+	start  int64
+}
+
+func NewChecksumReader(r io.Reader) *ChecksumReader {
+	return &ChecksumReader{r: bufio.NewReader(r)}
+}
+
+func (c *ChecksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.crc = crc32.Update(c.crc, castagnoli, p[:n])
+	c.offset += int64(n)
+	return n, err
+}
+
+func (c *ChecksumReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err != nil {
+		return b, err
+	}
+	c.crc = crc32.Update(c.crc, castagnoli, []byte{b})
+	c.offset++
+	return b, nil
+}
+
+// Next n bytes, without consuming them
+func (c *ChecksumReader) Peek(n int) ([]byte, error) {
+	return c.r.Peek(n)
+}
+
+// Starts a new message at the current offset
+func (c *ChecksumReader) Begin() {
+	c.crc = 0
+	c.start = c.offset
+}
+
+// Offset of the current message in the stream [bytes]
+func (c *ChecksumReader) Offset() int64 {
+	return c.start
+}
+
+// Reads the CRC32C trailer of the message started by Begin, a mismatch is a *CorruptionError
+func (c *ChecksumReader) CheckTrailer() error {
+	actual := c.crc
+	var trailer [ChecksumSize]byte
+	n, err := io.ReadFull(c.r, trailer[:])
+	c.offset += int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	expected := binary.BigEndian.Uint32(trailer[:])
+	if expected != actual {
+		return &CorruptionError{Offset: c.start, Expected: expected, Actual: actual}
+	}
+	return nil
+}
@@ -7,6 +7,8 @@ type DataBlockMessage struct {
 	Data     []byte
 	//Hash of data, normally is null
 	Hash []byte
+	//True when Data is compressed with the algorithm chosen in the handshake
+	Compressed bool
 }
 
 func NewDataBlockMessage(startLoc int64, dataBlock []byte) *DataBlockMessage {
@@ -0,0 +1,30 @@
+package messages
+
+const DeltaMessageID byte = 7
+
+// Delta instruction of the rolling checksum mode, the Length bytes at StartLoc of the new destination file are copied
+// from CopyLoc of the old destination file, or are the literal Data when Data is not nil
+type DeltaMessage struct {
+	StartLoc int64
+	CopyLoc  int64
+	Length   int64
+	Data     []byte
+}
+
+// Literal data instruction
+func NewLiteralDeltaMessage(startLoc int64, data []byte) *DeltaMessage {
+	return &DeltaMessage{StartLoc: startLoc, CopyLoc: -1, Length: int64(len(data)), Data: data}
+}
+
+// Copy-from-offset instruction
+func NewCopyDeltaMessage(startLoc int64, copyLoc int64, length int64) *DeltaMessage {
+	return &DeltaMessage{StartLoc: startLoc, CopyLoc: copyLoc, Length: length}
+}
+
+func (m *DeltaMessage) IsLiteral() bool {
+	return m.Data != nil
+}
+
+func (*DeltaMessage) GetMessageID() byte {
+	return DeltaMessageID
+}
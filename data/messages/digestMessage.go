@@ -0,0 +1,19 @@
+package messages
+
+const DigestMessageID byte = 11
+
+// Whole-file digest of the first Size bytes of a file, computed with the named hash algorithm. The source sends its
+// digest before the EndMessage, the destination checks its file after all the writes
+type DigestMessage struct {
+	Algorithm string
+	Size      int64
+	Digest    []byte
+}
+
+func NewDigestMessage(algorithm string, size int64, digest []byte) *DigestMessage {
+	return &DigestMessage{Algorithm: algorithm, Size: size, Digest: digest}
+}
+
+func (*DigestMessage) GetMessageID() byte {
+	return DigestMessageID
+}
@@ -0,0 +1,17 @@
+package messages
+
+const ExtentMessageID byte = 9
+
+// Differing region of a dry run, reported by the source to the master destination
+type ExtentMessage struct {
+	StartLoc int64
+	Length   int64
+}
+
+func NewExtentMessage(startLoc int64, length int64) *ExtentMessage {
+	return &ExtentMessage{StartLoc: startLoc, Length: length}
+}
+
+func (*ExtentMessage) GetMessageID() byte {
+	return ExtentMessageID
+}
@@ -0,0 +1,19 @@
+package messages
+
+import "github.com/ftarlao/goblocksync/data/configuration"
+
+const FileDetailsMessageID byte = 13
+
+// Details of the slave file, sent in reply to the configuration. The configuration already carries the master file
+// details, both peers agree on both files before the sync starts
+type FileDetailsMessage struct {
+	Details configuration.FileDetails
+}
+
+func NewFileDetailsMessage(details configuration.FileDetails) *FileDetailsMessage {
+	return &FileDetailsMessage{Details: details}
+}
+
+func (*FileDetailsMessage) GetMessageID() byte {
+	return FileDetailsMessageID
+}
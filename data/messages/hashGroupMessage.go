@@ -10,10 +10,12 @@ type HashGroupMessage struct {
 	StartLoc  int64
 	NumHash   int16
 	HashGroup [][]byte
+	// Merkle tree level of the hashes, 0 for block hashes
+	Level byte
 }
 
 func NewHashGroupMessage(startLoc int64) *HashGroupMessage {
-	return &HashGroupMessage{startLoc, 0, make([][]byte, configuration.HashGroupMessageSize)}
+	return &HashGroupMessage{startLoc, 0, make([][]byte, configuration.HashGroupMessageSize), 0}
 }
 
 func (m *HashGroupMessage) TruncHashGroup() {
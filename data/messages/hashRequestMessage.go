@@ -0,0 +1,18 @@
+package messages
+
+const HashRequestMessageID byte = 6
+
+// Requests the hashes of the children of the Merkle node of the given Level starting at StartLoc, the reply is a
+// HashGroupMessage of Level-1 with the same StartLoc
+type HashRequestMessage struct {
+	StartLoc int64
+	Level    byte
+}
+
+func NewHashRequestMessage(startLoc int64, level byte) *HashRequestMessage {
+	return &HashRequestMessage{StartLoc: startLoc, Level: level}
+}
+
+func (*HashRequestMessage) GetMessageID() byte {
+	return HashRequestMessageID
+}
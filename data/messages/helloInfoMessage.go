@@ -1,16 +1,28 @@
 package messages
 
-import "github.com/ftarlao/goblocksync/data/configuration"
+import (
+	"github.com/ftarlao/goblocksync/data/configuration"
+	"github.com/ftarlao/goblocksync/utils/compression"
+	"github.com/ftarlao/goblocksync/utils/hashing"
+)
 
 const HelloInfoMessageID byte = 1
 
 type HelloInfoMessage struct {
 	Hello              string
 	SupportedProtocols []int
+	// Names of the supported hash algorithms
+	SupportedHashes []string
+	// Names of the supported data block compression algorithms
+	SupportedCompressions []string
+	// CRC32C trailers of the messages after the hello, enabled when both the peers set it
+	Checksums bool
+	// Further sessions on the same streams after the first one, enabled when both the peers set it
+	Sessions bool
 }
 
 func NewHelloInfo() *HelloInfoMessage {
-	return &HelloInfoMessage{"goblocksync", configuration.SupportedProtocols}
+	return &HelloInfoMessage{"goblocksync", configuration.SupportedProtocols, hashing.Names(), compression.Names(), true, true}
 }
 
 func (*HelloInfoMessage) GetMessageID() byte {
@@ -0,0 +1,245 @@
+package messages
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ftarlao/goblocksync/data/configuration"
+	"github.com/ftarlao/goblocksync/utils/hashing"
+	"io"
+	"math"
+)
+
+// Maximums of the decoded messages, the peers agree on them in the handshake and with the configuration. A message
+// exceeding them is refused, a broken or malicious peer cannot make the decoder allocate more than the encoded size
+// of MaxMessageSize
+type Limits struct {
+	// Max data of a DataBlockMessage or DeltaMessage [bytes]
+	BlockSize int64
+	// Max hashes of a HashGroupMessage
+	HashesPerGroup int
+	// Length of every hash [bytes], any length up to configuration.MaxHashSize when zero
+	HashSize int
+	// Max Merkle tree level of the hashes and of the hash requests
+	MaxLevel byte
+	// Max end location of the file regions [bytes]
+	EndLoc int64
+}
+
+// Limits before the configuration is known
+func DefaultLimits() Limits {
+	return Limits{
+		BlockSize:      configuration.MaxBlockSize,
+		HashesPerGroup: configuration.HashGroupMessageSize,
+		MaxLevel:       math.MaxUint8,
+		EndLoc:         math.MaxInt64}
+}
+
+// Limits of the sync described by the configuration, with the hash algorithm chosen in the handshake. The regions
+// end within the larger of the two files, whose details are exchanged before the sync
+func NewLimits(config configuration.Configuration, algorithm hashing.HashAlgorithm) Limits {
+	l := DefaultLimits()
+	l.BlockSize = config.BlockSize
+	l.HashSize = algorithm.Size
+	l.MaxLevel = 0
+	switch config.Mode {
+	case configuration.ModeMerkle:
+		l.MaxLevel = byte(config.MerkleLevels)
+	case configuration.ModeRolling:
+		//weak rolling checksum followed by the strong hash
+		l.HashSize += 4
+	}
+	l.EndLoc = config.SourceFile.Size
+	if config.DestinationFile.Size > l.EndLoc {
+		l.EndLoc = config.DestinationFile.Size
+	}
+	return l
+}
+
+// Max encoded size of a message [bytes]: the largest data or hash group, plus room for the other fields and for the
+// configuration
+func (l Limits) MaxMessageSize() int {
+	size := l.BlockSize
+	hashSize := int64(l.HashSize)
+	if hashSize == 0 {
+		hashSize = configuration.MaxHashSize
+	}
+	//each hash is prefixed by its length
+	if groupSize := int64(l.HashesPerGroup) * (hashSize + 8); groupSize > size {
+		size = groupSize
+	}
+	return int(size + configuration.MessageOverhead)
+}
+
+// Checks the decoded message against the limits
+func (l Limits) Check(m Message) error {
+	var err error
+	switch msg := m.(type) {
+	case *HashGroupMessage:
+		if msg.NumHash < 0 || int(msg.NumHash) > len(msg.HashGroup) || len(msg.HashGroup) > l.HashesPerGroup {
+			return fmt.Errorf("hash group of %d hashes (%d provided), max %d hashes", msg.NumHash, len(msg.HashGroup),
+				l.HashesPerGroup)
+		}
+		for _, hash := range msg.HashGroup[:msg.NumHash] {
+			err = l.checkHash(hash)
+			if err != nil {
+				return err
+			}
+		}
+		err = l.checkLevel(msg.Level)
+		if err == nil {
+			err = l.checkRegion(msg.StartLoc, 0)
+		}
+	case *HelloInfoMessage:
+		if len(msg.SupportedProtocols) > configuration.MaxHelloListSize ||
+			len(msg.SupportedHashes) > configuration.MaxHelloListSize ||
+			len(msg.SupportedCompressions) > configuration.MaxHelloListSize {
+			return fmt.Errorf("hello with more than %d protocols, hashes or compressions", configuration.MaxHelloListSize)
+		}
+	case *DataBlockMessage:
+		err = l.checkData(msg.Data)
+		if err == nil && len(msg.Hash) > 0 {
+			err = l.checkHash(msg.Hash)
+		}
+		if err == nil {
+			err = l.checkRegion(msg.StartLoc, int64(len(msg.Data)))
+		}
+	case *HashRequestMessage:
+		err = l.checkLevel(msg.Level)
+		if err == nil {
+			err = l.checkRegion(msg.StartLoc, 0)
+		}
+	case *DeltaMessage:
+		if msg.IsLiteral() {
+			if msg.Length != int64(len(msg.Data)) {
+				return errors.New("literal delta length differs from its data")
+			}
+			err = l.checkData(msg.Data)
+		} else {
+			err = l.checkRegion(msg.CopyLoc, msg.Length)
+		}
+		if err == nil {
+			err = l.checkRegion(msg.StartLoc, msg.Length)
+		}
+	case *CheckpointMessage:
+		err = l.checkRegion(msg.Loc, 0)
+	case *ExtentMessage:
+		err = l.checkRegion(msg.StartLoc, msg.Length)
+	case *ZeroBlockMessage:
+		err = l.checkRegion(msg.StartLoc, msg.Length)
+	case *BandwidthMessage:
+		if msg.Rate < 0 || msg.Burst < 0 {
+			return errors.New("negative bandwidth limit")
+		}
+	case *TreeEntryMessage:
+		if msg.Path == "" || len(msg.Path) > configuration.MaxPathLength || msg.Size < 0 {
+			return errors.New("malformed tree entry")
+		}
+	case *DigestMessage:
+		if msg.Size < 0 || len(msg.Digest) > configuration.MaxHashSize {
+			return errors.New("malformed digest")
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("message type %d refused: %w", m.GetMessageID(), err)
+	}
+	return nil
+}
+
+func (l Limits) checkData(data []byte) error {
+	if int64(len(data)) > l.BlockSize {
+		return fmt.Errorf("%d bytes of data, max %d bytes", len(data), l.BlockSize)
+	}
+	return nil
+}
+
+func (l Limits) checkHash(hash []byte) error {
+	if l.HashSize == 0 && len(hash) <= configuration.MaxHashSize || len(hash) == l.HashSize {
+		return nil
+	}
+	return fmt.Errorf("hash of %d bytes, the agreed algorithm hashes are %d bytes", len(hash), l.HashSize)
+}
+
+func (l Limits) checkLevel(level byte) error {
+	if level > l.MaxLevel {
+		return fmt.Errorf("hash level %d, max %d", level, l.MaxLevel)
+	}
+	return nil
+}
+
+// The region [loc, loc+length) should be within [0, EndLoc]
+func (l Limits) checkRegion(loc int64, length int64) error {
+	if loc < 0 || length < 0 || loc > l.EndLoc || length > l.EndLoc-loc {
+		return fmt.Errorf("region at %d of %d bytes out of range [0, %d]", loc, length, l.EndLoc)
+	}
+	return nil
+}
+
+// Input of the gob decoder, refuses the gob messages longer than Max bytes before the decoder allocates them. The gob
+// decoder reads each length prefix and then exactly the message, the prefix is inspected before it is consumed
+type GobLimitReader struct {
+	r *ChecksumReader
+	// Max length of a gob message [bytes]
+	Max int
+	// bytes of the current gob message (and its length prefix) still to be read
+	remaining int
+}
+
+func NewGobLimitReader(r *ChecksumReader, max int) *GobLimitReader {
+	return &GobLimitReader{r: r, Max: max}
+}
+
+func (g *GobLimitReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if g.remaining == 0 {
+		err := g.next()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if len(p) > g.remaining {
+		p = p[:g.remaining]
+	}
+	n, err := g.r.Read(p)
+	g.remaining -= n
+	return n, err
+}
+
+func (g *GobLimitReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(g, b[:])
+	return b[0], err
+}
+
+// Inspects the length prefix of the next gob message: one byte below 0x80, or the negated number of the following
+// big-endian bytes
+func (g *GobLimitReader) next() error {
+	prefix, err := g.r.Peek(1)
+	if err != nil {
+		return err
+	}
+	width, length := 1, uint64(prefix[0])
+	if prefix[0] >= 0x80 {
+		width += -int(int8(prefix[0]))
+		if width > 9 {
+			return errors.New("malformed gob message length")
+		}
+		prefix, err = g.r.Peek(width)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+		length = 0
+		for _, b := range prefix[1:] {
+			length = length<<8 | uint64(b)
+		}
+	}
+	if length > uint64(g.Max) {
+		return fmt.Errorf("gob message too large, %d bytes (max %d bytes)", length, g.Max)
+	}
+	g.remaining = width + int(length)
+	return nil
+}
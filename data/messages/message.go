@@ -48,6 +48,42 @@ func DecodeMessage(decoder *gob.Decoder) (m Message, err error) {
 		var msg HelloInfoMessage
 		err = decoder.Decode(&msg)
 		m = &msg
+	case HashRequestMessageID:
+		var msg HashRequestMessage
+		err = decoder.Decode(&msg)
+		m = &msg
+	case DeltaMessageID:
+		var msg DeltaMessage
+		err = decoder.Decode(&msg)
+		m = &msg
+	case CheckpointMessageID:
+		var msg CheckpointMessage
+		err = decoder.Decode(&msg)
+		m = &msg
+	case ExtentMessageID:
+		var msg ExtentMessage
+		err = decoder.Decode(&msg)
+		m = &msg
+	case BandwidthMessageID:
+		var msg BandwidthMessage
+		err = decoder.Decode(&msg)
+		m = &msg
+	case DigestMessageID:
+		var msg DigestMessage
+		err = decoder.Decode(&msg)
+		m = &msg
+	case ZeroBlockMessageID:
+		var msg ZeroBlockMessage
+		err = decoder.Decode(&msg)
+		m = &msg
+	case FileDetailsMessageID:
+		var msg FileDetailsMessage
+		err = decoder.Decode(&msg)
+		m = &msg
+	case TreeEntryMessageID:
+		var msg TreeEntryMessage
+		err = decoder.Decode(&msg)
+		m = &msg
 	default:
 		err = errors.New("unknown message ID")
 	}
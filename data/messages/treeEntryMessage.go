@@ -0,0 +1,21 @@
+package messages
+
+const TreeEntryMessageID byte = 14
+
+// Directory or regular file of a directory tree sync. The source lists its tree with these entries, the destination
+// replies with the entries of the files to sync
+type TreeEntryMessage struct {
+	// Path relative to the tree root, slash separated
+	Path  string
+	IsDir bool
+	// Permission bits
+	Mode uint32
+	// File size [bytes], the destination size in the replies of the destination
+	Size int64
+	// Modification time [ns since the epoch]
+	ModTime int64
+}
+
+func (*TreeEntryMessage) GetMessageID() byte {
+	return TreeEntryMessageID
+}
@@ -0,0 +1,425 @@
+package messages
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/ftarlao/goblocksync/data/configuration"
+	"io"
+	"math"
+)
+
+// Binary wire protocol (protocol version 2). The peers exchange the HelloInfoMessages with the gob encoding of
+// protocol version 1, then both switch to the binary framing when version 2 is the best common version.
+//
+// Each message is a frame:
+//
+//	type    1 byte, the message ID
+//	length  4 bytes, unsigned big-endian, size of the payload
+//	payload length bytes
+//
+// The payload has a fixed layout for each message type, built from these fields:
+//
+//	int64   8 bytes, two's complement big-endian
+//	int32   4 bytes, two's complement big-endian
+//	int16   2 bytes, two's complement big-endian
+//	byte    1 byte (bools are 0 or 1)
+//	bytes   4 bytes unsigned big-endian length, followed by the bytes
+//	string  as bytes, UTF-8
+//	list    4 bytes unsigned big-endian count, followed by the elements
+//
+// Payload layouts:
+//
+//	0  HashGroup    StartLoc int64, NumHash int16, Level byte, HashGroup list of bytes
+//	1  HelloInfo    Hello string, SupportedProtocols list of int32, SupportedHashes list of string,
+//	                SupportedCompressions list of string, Checksums byte, Sessions byte
+//	2  Error        Err string
+//	3  Configuration Layout byte (ConfigurationLayout), IsMaster byte, IsSource byte, SourceFile details,
+//	                DestinationFile details, StartLoc int64, BlockSize int64, Mode string, MerkleFanout int32,
+//	                MerkleLevels int32, HashAlgorithm string, HashWorkers int32, Compression string,
+//	                BandwidthLimit int64, BandwidthBurst int64, SizePolicy string, Sparse byte, NoChecksums byte,
+//	                JournalFile string, DryRun byte, ReportFormat string, Verify byte, Recursive byte,
+//	                DeleteExtras byte, SessionID string, Verbose byte, LogFormat string
+//	4  End          empty
+//	5  DataBlock    StartLoc int64, Compressed byte, Data bytes, Hash bytes
+//	6  HashRequest  StartLoc int64, Level byte
+//	7  Delta        StartLoc int64, CopyLoc int64, Length int64, Data bytes
+//	8  Checkpoint   Loc int64
+//	9  Extent       StartLoc int64, Length int64
+//	10 Bandwidth    Rate int64, Burst int64
+//	11 Digest       Algorithm string, Size int64, Digest bytes
+//	12 ZeroBlock    StartLoc int64, Length int64
+//	13 FileDetails  details
+//	14 TreeEntry    Path string, IsDir byte, Mode int32, Size int64, ModTime int64
+//
+// where details is FileName string, Size int64, IsDevice byte, LogicalSectorSize int64, PhysicalSectorSize int64,
+// ModTime int64, Inode int64. The Configuration fields of the master transport (remote shell and command, daemon
+// address, TLS, progress, summary, resume, hooks) are not sent; a different layout byte is refused.
+//
+// A payload longer than its layout is malformed. When enabled in the handshake, each frame is followed by its CRC32C
+// trailer (see checksum.go).
+
+// Size of the frame header [bytes]
+const FrameHeaderSize = 5
+
+// Version of the Configuration payload layout
+const ConfigurationLayout byte = 1
+
+// Writes the message as a binary frame, with a single write
+func EncodeFrame(w io.Writer, m Message) error {
+	payload := &payloadWriter{buf: make([]byte, FrameHeaderSize, FrameHeaderSize+64)}
+	err := payload.message(m)
+	if err != nil {
+		return err
+	}
+	frame := payload.buf
+	length := len(frame) - FrameHeaderSize
+	if uint64(length) > math.MaxUint32 {
+		return fmt.Errorf("message type %d too large for a frame, %d bytes", m.GetMessageID(), length)
+	}
+	frame[0] = m.GetMessageID()
+	binary.BigEndian.PutUint32(frame[1:FrameHeaderSize], uint32(length))
+	_, err = w.Write(frame)
+	return err
+}
+
+// Reads and decodes a binary frame, payloads longer than maxPayload bytes are refused before their allocation
+func DecodeFrame(r io.Reader, maxPayload int) (Message, error) {
+	msgID, payload, err := ReadFrame(r, maxPayload)
+	if err != nil {
+		return nil, err
+	}
+	return DecodePayload(msgID, payload)
+}
+
+// Reads a binary frame without decoding its payload, payloads longer than maxPayload bytes are refused before their
+// allocation
+func ReadFrame(r io.Reader, maxPayload int) (msgID byte, payload []byte, err error) {
+	var header [FrameHeaderSize]byte
+	_, err = io.ReadFull(r, header[:])
+	if err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if uint64(length) > uint64(maxPayload) {
+		return 0, nil, fmt.Errorf("frame of message type %d too large, %d bytes (max %d bytes)", header[0], length, maxPayload)
+	}
+	payload = make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+// Decodes the payload of a binary frame of the given message type
+func DecodePayload(msgID byte, payload []byte) (m Message, err error) {
+	p := &payloadReader{data: payload}
+	switch msgID {
+	case HashGroupMessageID:
+		msg := HashGroupMessage{StartLoc: p.int64(), NumHash: p.int16(), Level: p.byte()}
+		for i, count := 0, p.count(4); i < count; i++ {
+			msg.HashGroup = append(msg.HashGroup, p.bytes())
+		}
+		m = &msg
+	case HelloInfoMessageID:
+		msg := HelloInfoMessage{Hello: p.string()}
+		for i, count := 0, p.count(4); i < count; i++ {
+			msg.SupportedProtocols = append(msg.SupportedProtocols, int(p.int32()))
+		}
+		msg.SupportedHashes = p.strings()
+		msg.SupportedCompressions = p.strings()
+		msg.Checksums = p.byte() != 0
+		msg.Sessions = p.byte() != 0
+		m = &msg
+	case ErrorMessageID:
+		m = &ErrorMessage{Err: p.string()}
+	case configuration.ConfigurationMessageID:
+		if layout := p.byte(); p.err == nil && layout != ConfigurationLayout {
+			return nil, fmt.Errorf("unsupported configuration layout %d", layout)
+		}
+		m = &configuration.Configuration{IsMaster: p.byte() != 0, IsSource: p.byte() != 0,
+			SourceFile: p.fileDetails(), DestinationFile: p.fileDetails(), StartLoc: p.int64(), BlockSize: p.int64(),
+			Mode: p.string(), MerkleFanout: int(p.int32()), MerkleLevels: int(p.int32()), HashAlgorithm: p.string(),
+			HashWorkers: int(p.int32()), Compression: p.string(), BandwidthLimit: p.int64(),
+			BandwidthBurst: p.int64(), SizePolicy: p.string(), Sparse: p.byte() != 0, NoChecksums: p.byte() != 0,
+			JournalFile: p.string(), DryRun: p.byte() != 0, ReportFormat: p.string(), Verify: p.byte() != 0,
+			Recursive: p.byte() != 0, DeleteExtras: p.byte() != 0, SessionID: p.string(), Verbose: p.byte() != 0,
+			LogFormat: p.string()}
+	case EndMessageID:
+		m = &EndMessage{}
+	case DataBlockMessageID:
+		msg := DataBlockMessage{StartLoc: p.int64(), Compressed: p.byte() != 0}
+		msg.Data = p.bytes()
+		msg.Hash = p.bytes()
+		m = &msg
+	case HashRequestMessageID:
+		m = &HashRequestMessage{StartLoc: p.int64(), Level: p.byte()}
+	case DeltaMessageID:
+		m = &DeltaMessage{StartLoc: p.int64(), CopyLoc: p.int64(), Length: p.int64(), Data: p.bytes()}
+	case CheckpointMessageID:
+		m = &CheckpointMessage{Loc: p.int64()}
+	case ExtentMessageID:
+		m = &ExtentMessage{StartLoc: p.int64(), Length: p.int64()}
+	case BandwidthMessageID:
+		m = &BandwidthMessage{Rate: p.int64(), Burst: p.int64()}
+	case DigestMessageID:
+		m = &DigestMessage{Algorithm: p.string(), Size: p.int64(), Digest: p.bytes()}
+	case ZeroBlockMessageID:
+		m = &ZeroBlockMessage{StartLoc: p.int64(), Length: p.int64()}
+	case FileDetailsMessageID:
+		m = &FileDetailsMessage{Details: p.fileDetails()}
+	case TreeEntryMessageID:
+		m = &TreeEntryMessage{Path: p.string(), IsDir: p.byte() != 0, Mode: uint32(p.int32()), Size: p.int64(),
+			ModTime: p.int64()}
+	default:
+		return nil, errors.New("unknown message ID")
+	}
+	if p.err == nil && len(p.data) > 0 {
+		p.err = fmt.Errorf("%d unexpected trailing bytes", len(p.data))
+	}
+	if p.err != nil {
+		return nil, fmt.Errorf("malformed frame of message type %d: %w", msgID, p.err)
+	}
+	return m, nil
+}
+
+type payloadWriter struct {
+	buf []byte
+}
+
+func (p *payloadWriter) message(m Message) error {
+	switch msg := m.(type) {
+	case *HashGroupMessage:
+		p.int64(msg.StartLoc)
+		p.int16(msg.NumHash)
+		p.byte(msg.Level)
+		p.count(len(msg.HashGroup))
+		for _, h := range msg.HashGroup {
+			p.bytes(h)
+		}
+	case *HelloInfoMessage:
+		p.string(msg.Hello)
+		p.count(len(msg.SupportedProtocols))
+		for _, v := range msg.SupportedProtocols {
+			p.int32(int32(v))
+		}
+		p.strings(msg.SupportedHashes)
+		p.strings(msg.SupportedCompressions)
+		p.bool(msg.Checksums)
+		p.bool(msg.Sessions)
+	case *ErrorMessage:
+		p.string(msg.Err)
+	case *configuration.Configuration:
+		p.byte(ConfigurationLayout)
+		p.bool(msg.IsMaster)
+		p.bool(msg.IsSource)
+		p.fileDetails(msg.SourceFile)
+		p.fileDetails(msg.DestinationFile)
+		p.int64(msg.StartLoc)
+		p.int64(msg.BlockSize)
+		p.string(msg.Mode)
+		p.int32(int32(msg.MerkleFanout))
+		p.int32(int32(msg.MerkleLevels))
+		p.string(msg.HashAlgorithm)
+		p.int32(int32(msg.HashWorkers))
+		p.string(msg.Compression)
+		p.int64(msg.BandwidthLimit)
+		p.int64(msg.BandwidthBurst)
+		p.string(msg.SizePolicy)
+		p.bool(msg.Sparse)
+		p.bool(msg.NoChecksums)
+		p.string(msg.JournalFile)
+		p.bool(msg.DryRun)
+		p.string(msg.ReportFormat)
+		p.bool(msg.Verify)
+		p.bool(msg.Recursive)
+		p.bool(msg.DeleteExtras)
+		p.string(msg.SessionID)
+		p.bool(msg.Verbose)
+		p.string(msg.LogFormat)
+	case *EndMessage:
+	case *DataBlockMessage:
+		p.int64(msg.StartLoc)
+		p.bool(msg.Compressed)
+		p.bytes(msg.Data)
+		p.bytes(msg.Hash)
+	case *HashRequestMessage:
+		p.int64(msg.StartLoc)
+		p.byte(msg.Level)
+	case *DeltaMessage:
+		p.int64(msg.StartLoc)
+		p.int64(msg.CopyLoc)
+		p.int64(msg.Length)
+		p.bytes(msg.Data)
+	case *CheckpointMessage:
+		p.int64(msg.Loc)
+	case *ExtentMessage:
+		p.int64(msg.StartLoc)
+		p.int64(msg.Length)
+	case *BandwidthMessage:
+		p.int64(msg.Rate)
+		p.int64(msg.Burst)
+	case *DigestMessage:
+		p.string(msg.Algorithm)
+		p.int64(msg.Size)
+		p.bytes(msg.Digest)
+	case *ZeroBlockMessage:
+		p.int64(msg.StartLoc)
+		p.int64(msg.Length)
+	case *FileDetailsMessage:
+		p.fileDetails(msg.Details)
+	case *TreeEntryMessage:
+		p.string(msg.Path)
+		p.bool(msg.IsDir)
+		p.int32(int32(msg.Mode))
+		p.int64(msg.Size)
+		p.int64(msg.ModTime)
+	default:
+		return fmt.Errorf("message type %d has no binary encoding", m.GetMessageID())
+	}
+	return nil
+}
+
+func (p *payloadWriter) int64(v int64) {
+	p.buf = binary.BigEndian.AppendUint64(p.buf, uint64(v))
+}
+
+func (p *payloadWriter) int32(v int32) {
+	p.buf = binary.BigEndian.AppendUint32(p.buf, uint32(v))
+}
+
+func (p *payloadWriter) int16(v int16) {
+	p.buf = binary.BigEndian.AppendUint16(p.buf, uint16(v))
+}
+
+func (p *payloadWriter) byte(v byte) {
+	p.buf = append(p.buf, v)
+}
+
+func (p *payloadWriter) bool(v bool) {
+	if v {
+		p.byte(1)
+	} else {
+		p.byte(0)
+	}
+}
+
+func (p *payloadWriter) count(n int) {
+	p.buf = binary.BigEndian.AppendUint32(p.buf, uint32(n))
+}
+
+func (p *payloadWriter) bytes(v []byte) {
+	p.count(len(v))
+	p.buf = append(p.buf, v...)
+}
+
+func (p *payloadWriter) string(v string) {
+	p.count(len(v))
+	p.buf = append(p.buf, v...)
+}
+
+func (p *payloadWriter) strings(v []string) {
+	p.count(len(v))
+	for _, s := range v {
+		p.string(s)
+	}
+}
+
+func (p *payloadWriter) fileDetails(v configuration.FileDetails) {
+	p.string(v.FileName)
+	p.int64(v.Size)
+	p.bool(v.IsDevice)
+	p.int64(v.LogicalSectorSize)
+	p.int64(v.PhysicalSectorSize)
+	p.int64(v.ModTime)
+	p.int64(int64(v.Inode))
+}
+
+// Reads the payload fields, the first error is kept and the following reads return zero values
+type payloadReader struct {
+	data []byte
+	err  error
+}
+
+func (p *payloadReader) next(n int) []byte {
+	if p.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(p.data) {
+		p.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	field := p.data[:n]
+	p.data = p.data[n:]
+	return field
+}
+
+func (p *payloadReader) int64() int64 {
+	if field := p.next(8); field != nil {
+		return int64(binary.BigEndian.Uint64(field))
+	}
+	return 0
+}
+
+func (p *payloadReader) int32() int32 {
+	if field := p.next(4); field != nil {
+		return int32(binary.BigEndian.Uint32(field))
+	}
+	return 0
+}
+
+func (p *payloadReader) int16() int16 {
+	if field := p.next(2); field != nil {
+		return int16(binary.BigEndian.Uint16(field))
+	}
+	return 0
+}
+
+func (p *payloadReader) byte() byte {
+	if field := p.next(1); field != nil {
+		return field[0]
+	}
+	return 0
+}
+
+// Number of list elements, each one at least minSize bytes: a count beyond the payload is malformed, no allocation
+// is larger than the payload
+func (p *payloadReader) count(minSize int) int {
+	if field := p.next(4); field != nil {
+		n := binary.BigEndian.Uint32(field)
+		if uint64(n)*uint64(minSize) > uint64(len(p.data)) {
+			p.err = fmt.Errorf("list of %d elements beyond the end of the payload", n)
+			return 0
+		}
+		return int(n)
+	}
+	return 0
+}
+
+func (p *payloadReader) bytes() []byte {
+	n := p.count(1)
+	if p.err != nil || n == 0 {
+		return nil
+	}
+	return p.next(n)
+}
+
+func (p *payloadReader) string() string {
+	return string(p.bytes())
+}
+
+func (p *payloadReader) strings() (list []string) {
+	for i, count := 0, p.count(4); i < count; i++ {
+		list = append(list, p.string())
+	}
+	return list
+}
+
+func (p *payloadReader) fileDetails() configuration.FileDetails {
+	return configuration.FileDetails{FileName: p.string(), Size: p.int64(), IsDevice: p.byte() != 0,
+		LogicalSectorSize: p.int64(), PhysicalSectorSize: p.int64(), ModTime: p.int64(), Inode: uint64(p.int64())}
+}
@@ -0,0 +1,18 @@
+package messages
+
+const ZeroBlockMessageID byte = 12
+
+// Zero-filled region [StartLoc, StartLoc+Length) of the source, sent in place of the DataBlockMessages of the region.
+// The destination writes zeros, or punches a hole in sparse mode
+type ZeroBlockMessage struct {
+	StartLoc int64
+	Length   int64
+}
+
+func NewZeroBlockMessage(startLoc int64, length int64) *ZeroBlockMessage {
+	return &ZeroBlockMessage{StartLoc: startLoc, Length: length}
+}
+
+func (*ZeroBlockMessage) GetMessageID() byte {
+	return ZeroBlockMessageID
+}
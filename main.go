@@ -1,66 +1,567 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/ftarlao/goblocksync/controller"
 	"github.com/ftarlao/goblocksync/data/configuration"
+	"github.com/ftarlao/goblocksync/utils"
+	"github.com/ftarlao/goblocksync/utils/compression"
+	"github.com/ftarlao/goblocksync/utils/hashing"
+	"log/slog"
 	"os"
-	"time"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 )
 
+// Source and destination, as provided by the user
+var sourceLocation, destinationLocation *string
+
+// Bandwidth limit file, read again on SIGHUP
+var bandwidthFile *string
+
 func main() {
-	globalConfig, isMaster, err := parseArgs()
+	if len(os.Args) > 1 && os.Args[1] == "serve" {
+		os.Exit(serve(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "diff" {
+		os.Exit(diff(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		os.Exit(verify(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "jobs" {
+		os.Exit(jobs(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(showConfig(os.Args[2:]))
+	}
+
+	globalConfig, isMaster, err := parseArgs(os.Args[1:], false)
 	if err != nil {
-		fmt.Println("Error: ", err)
+		controller.ProcessLogger(controller.RoleMaster).Error("Invalid arguments", "error", err)
 		os.Exit(3) //let's look for hardcoded error codes
 	}
 	if isMaster {
-		fmt.Println("Goblocksync command executed")
-
-		fmt.Println("The destination file will be synched with the source file")
-		fmt.Print("DESTINATION FILE WILL BE OVERWRITTEN\n\n")
-		fmt.Println("Source file:\t\t", globalConfig.SourceFile.FileName)
-		fmt.Println("Destination file:\t", globalConfig.DestinationFile.FileName)
-
 		//Start Master
 		master := controller.NewMaster(*globalConfig)
-		master.Start()
-
-		time.Sleep(3000 * time.Millisecond)
+		logger := master.Logger()
+		logger.Info("Sync requested", "source", *sourceLocation, "destination", *destinationLocation)
+		logger.Warn("The destination file will be overwritten with the source file")
+		if globalConfig.StartLoc > 0 {
+			logger.Info("Resumed from the checkpoint")
+		}
+		if *bandwidthFile != "" {
+			go watchBandwidthFile(master, *bandwidthFile)
+		}
+		//the session records report the failure
+		err = master.Start()
+		if err != nil {
+			os.Exit(1)
+		}
+		master.Logger().Info("Sync completed")
 	} else {
 
+		//the slave lives as long as its streams, a SIGHUP for the master (e.g. -bwlimit-file) should not stop it
+		signal.Ignore(syscall.SIGHUP)
+		//stdout is the protocol stream, the session records of the slave go to stderr
 		slave := controller.NewSlave()
-		slave.Start()
-
-		time.Sleep(3000 * time.Millisecond)
+		err = slave.Start()
+		if err != nil {
+			os.Exit(1)
+		}
 	}
 
 }
 
-// returns configuration, isMaster boolean, and in case.. an error. Configuration is nil for slave
-func parseArgs() (*configuration.Configuration, bool, error) {
+// returns configuration, isMaster boolean, and in case.. an error. Configuration is nil for slave. The configuration
+// shown may have no source and destination, its options are validated without them
+func parseArgs(args []string, show bool) (*configuration.Configuration, bool, error) {
 	flag.Usage = func() {
-		fmt.Print("goblocksync -s sourcefile -d destinationfile\n\n")
+		fmt.Print("goblocksync -s [[user@]host:]sourcefile -d [[user@]host:]destinationfile\n")
+		fmt.Print("goblocksync -r [-delete] -s [[user@]host:]sourcedir -d [[user@]host:]destinationdir\n")
+		fmt.Print("goblocksync diff -s [[user@]host:]sourcefile -d [[user@]host:]destinationfile\n")
+		fmt.Print("goblocksync verify -s [[user@]host:]sourcefile -d [[user@]host:]destinationfile\n")
+		fmt.Print("goblocksync jobs -manifest jobs.json [-parallel n]\n")
+		fmt.Print("goblocksync config show [-config file.json] [-profile name] [options]\n")
+		fmt.Print("goblocksync serve -root directory [-listen address]\n\n")
 		flag.PrintDefaults()
 	}
 
-	sourceFileName := flag.String("s", "", "Source file path")
-	destinationFileName := flag.String("d", "", "Destination file path")
+	peerFlags := addPeerFlags(flag.CommandLine)
+	mode := flag.String("mode", configuration.ModeBlock, "Sync mode: 'block' compares all the block hashes, 'merkle' compares the hashes of large regions first and refines the differing ones, 'rolling' finds shifted content in regular files (rsync-style)")
+	merkleFanout := flag.Int("merkle-fanout", configuration.DefaultMerkleFanout, "Merkle mode, number of children of each region")
+	merkleLevels := flag.Int("merkle-levels", configuration.DefaultMerkleLevels, "Merkle mode, number of levels above the blocks")
+	journalFile := flag.String("journal", "", "Checkpoint journal of the block mode, records the synced regions and the identity of both the files; no journal when empty")
+	sizePolicy := flag.String("size-policy", configuration.SizeTruncate, "Destination size policy: 'truncate' matches the source size (the tail of a larger device is left alone), 'extend' never shrinks the destination, 'refuse' fails when the sizes differ, 'zero-tail' zeroes and discards the tail of a larger device")
+	sparse := flag.Bool("sparse", false, "Punches holes for the zero regions of a regular destination file instead of writing zeros (block and merkle modes)")
+	resume := flag.Bool("resume", false, "Resumes an interrupted block mode sync from the last checkpoint of the -journal, when both the files are the same")
+	recursive := flag.Bool("r", false, "Syncs the directory tree of the source, the changed files (size or modification time) are synced one by one")
+	deleteExtras := flag.Bool("delete", false, "Recursive mode, deletes the destination files and directories missing in the source")
+	bandwidthFile = flag.String("bwlimit-file", "", "File with the bandwidth limit as '<rate> [burst]', overrides -bwlimit and it is read again on SIGHUP to change the limit of a running sync")
 	isSlave := flag.Bool("S", false, "Enables slave mode, the other arguments are ignored")
-	flag.Parse()
+	flag.CommandLine.Parse(args)
 
-	if *isSlave {
-		return nil, false, nil
+	err := peerFlags.logging.setup()
+	if err != nil || *isSlave {
+		return nil, !*isSlave, err
 	}
 	// When master we parse
+	noLocations := show && *sourceLocation == "" && *destinationLocation == ""
+	var globalConfig configuration.Configuration
+	if noLocations {
+		globalConfig, err = peerFlags.baseConfiguration()
+	} else {
+		globalConfig, err = peerFlags.configuration()
+	}
+	if err != nil {
+		return nil, true, err
+	}
+	globalConfig.Mode = *mode
+	globalConfig.MerkleFanout = *merkleFanout
+	globalConfig.MerkleLevels = *merkleLevels
+	globalConfig.JournalFile = *journalFile
+	globalConfig.Resume = *resume
+	globalConfig.Sparse = *sparse
+	globalConfig.SizePolicy = *sizePolicy
+	globalConfig.Recursive = *recursive
+	globalConfig.DeleteExtras = *deleteExtras
+	if *bandwidthFile != "" {
+		globalConfig.BandwidthLimit, globalConfig.BandwidthBurst, err = readBandwidthFile(*bandwidthFile)
+		if err != nil {
+			return nil, true, err
+		}
+	}
+	// validate the configuration
+	if noLocations {
+		_, err = globalConfig.ValidateOptions()
+		return &globalConfig, true, err
+	}
+	_, err = globalConfig.Validate()
+	if err != nil || !*resume {
+		return &globalConfig, true, err
+	}
+	journal, err := controller.LoadJournal(globalConfig.JournalFile)
+	if err == nil {
+		err = journal.Resume(&globalConfig)
+	}
+	return &globalConfig, true, err
+}
+
+// Flags of the source, destination and of the connection to the slave, shared by the master commands
+type peerFlags struct {
+	flags          *flag.FlagSet
+	logging        *logFlags
+	configFile     *string
+	profile        *string
+	blockSize      *string
+	remoteShell    *string
+	remoteCommand  *string
+	connectAddress *string
+	tlsCert        *string
+	tlsKey         *string
+	tlsCA          *string
+	tlsPin         *string
+	hashName       *string
+	hashWorkers    *int
+	compression    *string
+	bandwidthLimit *string
+	bandwidthBurst *string
+	progress       *bool
+	noChecksums    *bool
+	preHook        *string
+	postHook       *string
+}
+
+func addPeerFlags(flags *flag.FlagSet) *peerFlags {
+	sourceLocation = flags.String("s", "", "Source file path, [user@]host:path for a remote file")
+	destinationLocation = flags.String("d", "", "Destination file path, [user@]host:path for a remote file")
+	f := &peerFlags{flags: flags, logging: addLogFlags(flags)}
+	f.configFile = flags.String("config", "", "JSON configuration file with named profiles, the options on the command line override the profile")
+	f.profile = flags.String("profile", "", "Profile of the configuration file, its default profile when empty")
+	f.blockSize = flags.String("block-size", strconv.Itoa(configuration.DefaultBlockSize), "Block size [bytes], with optional K, M suffix")
+	f.remoteShell = flags.String("rsh", configuration.DefaultRemoteShell, "Remote shell command template used to start the remote slave, e.g. \"ssh -p 2222\"")
+	flags.StringVar(f.remoteShell, "e", configuration.DefaultRemoteShell, "Shorthand for -rsh")
+	f.remoteCommand = flags.String("remote-path", configuration.DefaultRemoteCommand, "Path of the goblocksync executable on the remote host")
+	f.connectAddress = flags.String("connect", "", "Address host:port of the slave daemon ('goblocksync serve'), the remote file is the one in host:path form")
+	f.tlsCert = flags.String("tls-cert", "", "TLS client certificate (PEM) for the daemon connection")
+	f.tlsKey = flags.String("tls-key", "", "TLS client key (PEM) for the daemon connection")
+	f.tlsCA = flags.String("tls-ca", "", "CA certificates (PEM) that verify the daemon certificate")
+	f.tlsPin = flags.String("tls-pin", "", "SHA-256 fingerprint (hexadecimal) of the daemon certificate")
+	f.hashName = flags.String("hash", "", "Hash algorithm, the strongest one supported by both peers when empty. Available: "+
+		strings.Join(hashing.Names(), ", "))
+	f.hashWorkers = flags.Int("hash-workers", 0, "Number of hashing goroutines on each peer, one for each CPU when zero")
+	f.bandwidthLimit = flags.String("bwlimit", "0", "Bandwidth limit of both peers [bytes/s], with optional K, M, G suffix, zero is no limit")
+	f.bandwidthBurst = flags.String("bwburst", "0", "Burst of the bandwidth limit [bytes], a tenth of a second of traffic when zero")
+	f.progress = flags.Bool("progress", true, "Reports the progress on stderr, a progress line on a terminal and periodic log lines otherwise")
+	f.compression = flags.String("compress", "", "Data block compression, the preferred one supported by both peers when empty, 'none' disables it. Available: "+
+		strings.Join(compression.Names(), ", "))
+	f.noChecksums = flags.Bool("no-crc", false, "Disables the CRC32C trailers that protect each exchanged message from corruption")
+	f.preHook = flags.String("pre-hook", "", "Command run before the sync (no shell), a non-zero exit fails the sync without syncing")
+	f.postHook = flags.String("post-hook", "", "Command run after the sync (no shell), also after a failed one; a non-zero exit fails the sync")
+	return f
+}
+
+// Logging flags, shared by all the commands
+type logFlags struct {
+	verbose *bool
+	format  *string
+}
+
+func addLogFlags(flags *flag.FlagSet) *logFlags {
+	f := &logFlags{}
+	f.verbose = flags.Bool("v", false, "Verbose, logs the debug records too")
+	f.format = flags.String("log-format", configuration.LogText, "Format of the log records on stderr, 'text' or 'json'")
+	return f
+}
+
+// Sets the default logger for the parsed flags, the records go to stderr
+func (f *logFlags) setup() error {
+	options := &slog.HandlerOptions{Level: slog.LevelInfo}
+	if *f.verbose {
+		options.Level = slog.LevelDebug
+	}
+	var handler slog.Handler
+	switch *f.format {
+	case configuration.LogText:
+		handler = slog.NewTextHandler(os.Stderr, options)
+	case configuration.LogJSON:
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	default:
+		return errors.New("unknown log format " + *f.format)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// Master configuration for the parsed flags, block mode
+func (f *peerFlags) configuration() (configuration.Configuration, error) {
+	config, err := f.baseConfiguration()
+	if err != nil {
+		return config, err
+	}
+	// the slave runs where the remote file is, the master is the source unless the source is remote
+	err = config.SetLocations(*sourceLocation, *destinationLocation)
+	return config, err
+}
+
+// Master configuration for the parsed flags and profile, without source and destination, block mode
+func (f *peerFlags) baseConfiguration() (configuration.Configuration, error) {
+	err := f.applyProfile()
+	if err != nil {
+		return configuration.Configuration{}, err
+	}
+	blockSize, err := utils.ParseSize(*f.blockSize)
+	if err != nil {
+		return configuration.Configuration{}, err
+	}
+	bandwidthLimit, err := utils.ParseSize(*f.bandwidthLimit)
+	if err != nil {
+		return configuration.Configuration{}, err
+	}
+	bandwidthBurst, err := utils.ParseSize(*f.bandwidthBurst)
+	if err != nil {
+		return configuration.Configuration{}, err
+	}
 
-	//TODO to assign the isSource matters for future remote connections
 	// populate the configuration
-	globalConfig := configuration.Configuration{!*isSlave, true, configuration.FileDetails{FileName: *sourceFileName},
-		configuration.FileDetails{FileName: *destinationFileName}, 0, 4096}
+	return configuration.Configuration{
+		IsMaster:       true,
+		StartLoc:       0,
+		BlockSize:      blockSize,
+		Mode:           configuration.ModeBlock,
+		HashAlgorithm:  *f.hashName,
+		HashWorkers:    *f.hashWorkers,
+		Compression:    *f.compression,
+		BandwidthLimit: bandwidthLimit,
+		BandwidthBurst: bandwidthBurst,
+		NoChecksums:    *f.noChecksums,
+		Verbose:        *f.logging.verbose,
+		LogFormat:      *f.logging.format,
+		Progress:       *f.progress,
+		RemoteShell:    *f.remoteShell,
+		RemoteCommand:  *f.remoteCommand,
+		ConnectAddress: *f.connectAddress,
+		TLSCertFile:    *f.tlsCert,
+		TLSKeyFile:     *f.tlsKey,
+		TLSCAFile:      *f.tlsCA,
+		TLSPin:         *f.tlsPin,
+		PreHook:        *f.preHook,
+		PostHook:       *f.postHook}, nil
+}
 
-	// validate the configuration
-	_, err := globalConfig.Validate()
-	return &globalConfig, !*isSlave, err
+// Sets the flags missing on the command line to the values of the selected profile, the flags of the profile options
+// that the command does not have are ignored
+func (f *peerFlags) applyProfile() error {
+	if *f.configFile == "" {
+		if *f.profile != "" {
+			return errors.New("the profile " + *f.profile + " requires a configuration file (-config)")
+		}
+		return nil
+	}
+	profile, err := controller.LoadProfile(*f.configFile, *f.profile)
+	if err != nil {
+		return err
+	}
+	return profile.ApplyToFlags(f.flags)
+}
+
+// Prints the resolved and validated configuration of a sync as JSON, the options are the ones of the sync command.
+// Returns the exit code, 3 for invalid arguments or configuration
+func showConfig(args []string) int {
+	if len(args) == 0 || args[0] != "show" {
+		fmt.Print("goblocksync config show [-config file.json] [-profile name] [options]\n")
+		return 3
+	}
+	config, isMaster, err := parseArgs(args[1:], true)
+	if err == nil && !isMaster {
+		err = errors.New("the slave has no configuration to show")
+	}
+	if err != nil {
+		controller.ProcessLogger(controller.RoleMaster).Error("Invalid configuration", "error", err)
+		return 3
+	}
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		controller.ProcessLogger(controller.RoleMaster).Error("Invalid configuration", "error", err)
+		return 3
+	}
+	fmt.Println(string(data))
+	return 0
+}
+
+// Dry run, reports the differing extents without writing the destination, returns the exit code
+func diff(args []string) int {
+	diffFlags := flag.NewFlagSet("diff", flag.ExitOnError)
+	diffFlags.Usage = func() {
+		fmt.Print("goblocksync diff -s [[user@]host:]sourcefile -d [[user@]host:]destinationfile\n\n")
+		diffFlags.PrintDefaults()
+	}
+	peerFlags := addPeerFlags(diffFlags)
+	format := diffFlags.String("format", configuration.ReportText, "Report format, 'text' or 'json'")
+	diffFlags.Parse(args)
+
+	err := peerFlags.logging.setup()
+	var config configuration.Configuration
+	if err == nil {
+		config, err = peerFlags.configuration()
+	}
+	if err == nil {
+		config.DryRun = true
+		config.ReportFormat = *format
+		_, err = config.Validate()
+	}
+	if err != nil {
+		controller.ProcessLogger(controller.RoleMaster).Error("Invalid arguments", "error", err)
+		return 3
+	}
+	//the report is the only output on stdout, the session records report the failures
+	err = controller.NewMaster(config).Start()
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// Compares the whole-file digests of source and destination without syncing, returns the exit code: 0 when the files
+// are identical, 1 when they differ, 2 on failures and 3 for invalid arguments
+func verify(args []string) int {
+	verifyFlags := flag.NewFlagSet("verify", flag.ExitOnError)
+	verifyFlags.Usage = func() {
+		fmt.Print("goblocksync verify -s [[user@]host:]sourcefile -d [[user@]host:]destinationfile\n\n")
+		verifyFlags.PrintDefaults()
+	}
+	peerFlags := addPeerFlags(verifyFlags)
+	verifyFlags.Parse(args)
+
+	err := peerFlags.logging.setup()
+	var config configuration.Configuration
+	if err == nil {
+		config, err = peerFlags.configuration()
+	}
+	if err == nil {
+		config.Verify = true
+		_, err = config.Validate()
+	}
+	if err != nil {
+		controller.ProcessLogger(controller.RoleMaster).Error("Invalid arguments", "error", err)
+		return 3
+	}
+	//the session records report the failures
+	err = controller.NewMaster(config).Start()
+	if errors.Is(err, controller.ErrFilesDiffer) {
+		return 1
+	}
+	if err != nil {
+		return 2
+	}
+	return 0
+}
+
+// Syncs the source/destination pairs of a job manifest, returns the exit code: 0 when all the jobs succeed, 1 when
+// some job fails and 3 for invalid arguments or manifest
+func jobs(args []string) int {
+	jobsFlags := flag.NewFlagSet("jobs", flag.ExitOnError)
+	jobsFlags.Usage = func() {
+		fmt.Print("goblocksync jobs -manifest jobs.json [-parallel n]\n\n")
+		jobsFlags.PrintDefaults()
+	}
+	peerFlags := addPeerFlags(jobsFlags)
+	manifestFile := jobsFlags.String("manifest", "", "JSON job manifest with the source/destination pairs and their options")
+	parallel := jobsFlags.Int("parallel", 0, "Max number of jobs running at once, overrides the manifest. The jobs with the same transport share at most this number of slaves")
+	reportFile := jobsFlags.String("report", "", "Writes the job summary to this file as JSON")
+	jobsFlags.Parse(args)
+
+	err := peerFlags.logging.setup()
+	var base configuration.Configuration
+	if err == nil {
+		base, err = peerFlags.baseConfiguration()
+	}
+	if err == nil && *manifestFile == "" {
+		err = errors.New("please provide the job manifest (-manifest)")
+	}
+	var manifest *controller.Manifest
+	if err == nil {
+		manifest, err = controller.LoadManifest(*manifestFile)
+	}
+	var resolved []controller.ResolvedJob
+	if err == nil {
+		resolved, err = manifest.Resolve(base)
+	}
+	if err != nil {
+		controller.ProcessLogger(controller.RoleJob).Error("Invalid arguments", "error", err)
+		return 3
+	}
+	if *parallel > 0 {
+		manifest.Parallel = *parallel
+	}
+
+	report := controller.RunJobs(resolved, manifest.Parallel)
+	err = report.Write(os.Stdout, configuration.ReportText)
+	if err != nil {
+		controller.ProcessLogger(controller.RoleJob).Error("Job summary not written", "error", err)
+		return 1
+	}
+	if *reportFile != "" {
+		f, err := os.Create(*reportFile)
+		if err == nil {
+			err = report.Write(f, configuration.ReportJSON)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		if err != nil {
+			controller.ProcessLogger(controller.RoleJob).Error("Job report not written", "error", err)
+			return 1
+		}
+	}
+	if report.FailedJobs > 0 {
+		return 1
+	}
+	return 0
+}
+
+// Slave daemon, runs till SIGTERM/SIGINT, returns the exit code
+func serve(args []string) int {
+	serveFlags := flag.NewFlagSet("serve", flag.ExitOnError)
+	serveFlags.Usage = func() {
+		fmt.Print("goblocksync serve -root directory [-listen address]\n\n")
+		serveFlags.PrintDefaults()
+	}
+	root := serveFlags.String("root", "", "Directory containing all the files of the sessions (required), the relative remote paths are relative to it")
+	listenAddress := serveFlags.String("listen", configuration.DefaultListenAddress, "Listen address host:port for master connections, a non loopback address requires -tls-client-ca")
+	tlsCert := serveFlags.String("tls-cert", "", "TLS certificate (PEM) of the daemon, enables TLS")
+	tlsKey := serveFlags.String("tls-key", "", "TLS key (PEM) of the daemon")
+	tlsClientCA := serveFlags.String("tls-client-ca", "", "CA certificates (PEM) that verify the master certificates, enables mutual authentication")
+	logging := addLogFlags(serveFlags)
+	serveFlags.Parse(args)
+
+	err := logging.setup()
+	if err != nil {
+		controller.ProcessLogger(controller.RoleDaemon).Error("Invalid arguments", "error", err)
+		return 3
+	}
+	if *root == "" {
+		controller.ProcessLogger(controller.RoleDaemon).Error("Invalid arguments", "error", errors.New("the root directory is required"))
+		return 3
+	}
+	server := controller.NewServer(*listenAddress, *root)
+	tlsConfig, err := controller.ServerTLSConfig(*tlsCert, *tlsKey, *tlsClientCA)
+	if err != nil {
+		controller.ProcessLogger(controller.RoleDaemon).Error("Invalid arguments", "error", err)
+		return 3
+	}
+	server.TLSConfig = tlsConfig
+	err = server.Listen()
+	if err != nil {
+		controller.ProcessLogger(controller.RoleDaemon).Error("Listen failed", "error", err)
+		return 3
+	}
+	controller.ProcessLogger(controller.RoleDaemon).Info("Listening", "address", server.ListenAddress().String())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	shutdownErr := make(chan error, 1)
+	go func() {
+		sig := <-signals
+		controller.ProcessLogger(controller.RoleDaemon).Info("Shutting down", "signal", sig.String())
+		shutdownErr <- server.Shutdown(configuration.ShutdownTimeout)
+	}()
+
+	err = server.Serve()
+	if err != nil {
+		controller.ProcessLogger(controller.RoleDaemon).Error("Serve failed", "error", err)
+		return 1
+	}
+	//Serve returns after the shutdown request, the running sessions are still completing
+	err = <-shutdownErr
+	if err != nil {
+		controller.ProcessLogger(controller.RoleDaemon).Error("Shutdown failed", "error", err)
+		return 1
+	}
+	return 0
+}
+
+// Reads the bandwidth limit file, '<rate> [burst]' with optional K, M, G suffixes
+func readBandwidthFile(fileName string) (rate int64, burst int64, err error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return 0, 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 || len(fields) > 2 {
+		return 0, 0, errors.New("the bandwidth limit file should contain '<rate> [burst]'")
+	}
+	rate, err = utils.ParseSize(fields[0])
+	if err == nil && len(fields) == 2 {
+		burst, err = utils.ParseSize(fields[1])
+	}
+	return rate, burst, err
+}
+
+// Master whose bandwidth limit can be changed at runtime, the changes are logged with its session
+type bandwidthLimiter interface {
+	SetBandwidthLimit(rate int64, burst int64) error
+	Logger() *slog.Logger
+}
+
+// Applies the bandwidth limit file to the running sync on each SIGHUP
+func watchBandwidthFile(master bandwidthLimiter, fileName string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		rate, burst, err := readBandwidthFile(fileName)
+		if err == nil {
+			err = master.SetBandwidthLimit(rate, burst)
+		}
+		if err != nil {
+			master.Logger().Warn("Bandwidth limit not changed", "error", err)
+			continue
+		}
+		master.Logger().Info("Bandwidth limit changed", "rate", rate, "burst", burst)
+	}
 }
@@ -0,0 +1,89 @@
+package test
+
+import (
+	"github.com/ftarlao/goblocksync/controller/routines"
+	"github.com/ftarlao/goblocksync/data/configuration"
+	"github.com/ftarlao/goblocksync/data/messages"
+	"github.com/ftarlao/goblocksync/utils"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestUnitTokenBucket(t *testing.T) {
+	t.Log("***TokenBucket Test***\nThe takes are limited by the burst and delayed by the rate")
+
+	bucket := routines.NewTokenBucket(utils.MB, 64*utils.KB)
+	done := make(chan bool)
+	if n := bucket.Take(utils.MB, done); n != 64*utils.KB {
+		t.Error("expected a take of a burst, got ", n, " bytes")
+		return
+	}
+	//the bucket is empty, a burst takes 1/16 s
+	start := time.Now()
+	bucket.Take(64*utils.KB, done)
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Error("take not delayed by the rate, elapsed ", elapsed)
+	}
+
+	//a waiting take is released by a new limit and by done
+	bucket.SetLimit(1, 1)
+	bucket.Take(1, done)
+	released := make(chan int, 1)
+	go func() {
+		released <- bucket.Take(1, done)
+	}()
+	bucket.SetLimit(0, 0)
+	if n := <-released; n != 1 {
+		t.Error("take not released by the removed limit, got ", n, " bytes")
+	}
+	bucket.SetLimit(1, 1)
+	bucket.Take(1, done)
+	go func() {
+		released <- bucket.Take(1, done)
+	}()
+	close(done)
+	if n := <-released; n != 0 {
+		t.Error("take not released by done, got ", n, " bytes")
+	}
+	if rate, burst := bucket.Limit(); rate != 1 || burst != 1 {
+		t.Error("unexpected limit ", rate, " ", burst)
+	}
+}
+
+func TestUnitNetworkManagerBandwidth(t *testing.T) {
+	t.Log("***NetworkManager***\nMessages throttled by the bandwidth limit, the limit is changed by the peer")
+
+	var blockSize int64 = 64 * utils.KB
+	pipeIn, pipeOut := io.Pipe()
+	netManager := routines.NewNetworkManager(configuration.DefaultNetworkChannelSize, pipeIn, pipeOut)
+	netManager.SetBandwidthLimit(utils.MB, blockSize)
+	netManager.Start()
+
+	//the first burst is free, 8 blocks need at least 7/16 s
+	data := make([]byte, blockSize)
+	start := time.Now()
+	for i := 0; i < 8; i++ {
+		if !CheckMsgRoundtrip(messages.NewDataBlockMessage(int64(i)*blockSize, data), netManager, t) {
+			return
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Error("messages not throttled, elapsed ", elapsed)
+	}
+
+	//the loopback peer receives the new limit, the message is not delivered
+	netManager.Send(messages.NewBandwidthMessage(2*utils.MB, 0))
+	endMessage := messages.NewEndMessage()
+	if !CheckMsgRoundtrip(endMessage, netManager, t) {
+		return
+	}
+	if rate, burst := netManager.GetBandwidthLimit(); rate != 2*utils.MB || burst != routines.DefaultBurst(2*utils.MB) {
+		t.Error("limit not changed by the peer, rate ", rate, " burst ", burst)
+	}
+
+	err := netManager.Stop()
+	if err != nil {
+		t.Error(err)
+	}
+}
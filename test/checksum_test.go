@@ -0,0 +1,140 @@
+package test
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"github.com/ftarlao/goblocksync/controller/routines"
+	"github.com/ftarlao/goblocksync/data/configuration"
+	"github.com/ftarlao/goblocksync/data/messages"
+	"github.com/ftarlao/goblocksync/utils"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestUnitChecksumTrailer(t *testing.T) {
+	t.Log("***CRC32C Trailer Test***\nGob messages and binary frames with trailers, corrupted byte reported with its offset")
+
+	all := []messages.Message{
+		messages.NewCheckpointMessage(utils.MB),
+		&messages.DataBlockMessage{StartLoc: 4096, Data: []byte{1, 2, 3, 4, 5}},
+		messages.NewEndMessage()}
+	for _, protocol := range configuration.SupportedProtocols {
+		var stream bytes.Buffer
+		out := messages.NewChecksumWriter(&stream)
+		encoder := gob.NewEncoder(out)
+		var offsets []int
+		for _, m := range all {
+			offsets = append(offsets, stream.Len())
+			out.Begin()
+			if protocol == configuration.ProtocolBinary {
+				utils.Check(messages.EncodeFrame(out, m))
+			} else {
+				utils.Check(messages.EncodeMessage(encoder, m))
+			}
+			utils.Check(out.WriteTrailer())
+		}
+		data := stream.Bytes()
+
+		decodeAll := func(data []byte) ([]messages.Message, error) {
+			in := messages.NewChecksumReader(bytes.NewReader(data))
+			decoder := gob.NewDecoder(in)
+			var decoded []messages.Message
+			for range all {
+				in.Begin()
+				var m messages.Message
+				var err error
+				//as the network manager does, the trailer of a frame is checked before its payload is decoded
+				if protocol == configuration.ProtocolBinary {
+					var msgID byte
+					var payload []byte
+					msgID, payload, err = messages.ReadFrame(in, configuration.MaxFrameSize)
+					if err == nil {
+						err = in.CheckTrailer()
+					}
+					if err == nil {
+						m, err = messages.DecodePayload(msgID, payload)
+					}
+				} else {
+					m, err = messages.DecodeMessage(decoder)
+					if err == nil {
+						err = in.CheckTrailer()
+					}
+				}
+				if err != nil {
+					return decoded, err
+				}
+				decoded = append(decoded, m)
+			}
+			return decoded, nil
+		}
+
+		decoded, err := decodeAll(data)
+		if err != nil {
+			t.Error("Test failed, protocol ", protocol, " error ", err)
+			continue
+		}
+		for i, m := range all {
+			checkMsgEquality(m, decoded[i], t)
+		}
+
+		//a byte of the block data
+		corrupted := append([]byte{}, data...)
+		corrupted[offsets[1]+bytes.Index(data[offsets[1]:], []byte{1, 2, 3, 4, 5})+2] ^= 0x40
+		decoded, err = decodeAll(corrupted)
+		var corruption *messages.CorruptionError
+		if !errors.As(err, &corruption) {
+			t.Error("Test failed, protocol ", protocol, " expected a corruption error, got ", err)
+			continue
+		}
+		if len(decoded) != 1 || corruption.Offset != int64(offsets[1]) {
+			t.Error("Test failed, protocol ", protocol, " corruption reported at offset ", corruption.Offset,
+				" after ", len(decoded), " messages, expected ", offsets[1])
+		}
+		if corruption.Temporary() {
+			t.Error("Test failed, corruption reported as retryable")
+		}
+	}
+}
+
+func TestUnitNetworkManagerCorruption(t *testing.T) {
+	t.Log("***NetworkManager Corruption Test***\nA corrupted frame after the hello stops the manager with the offset of the frame")
+
+	//peer hello (gob), then a binary frame with a wrong trailer
+	var stream bytes.Buffer
+	utils.Check(messages.EncodeMessage(gob.NewEncoder(&stream), messages.NewHelloInfo()))
+	offset := stream.Len()
+	utils.Check(messages.EncodeFrame(&stream, messages.NewCheckpointMessage(utils.KB)))
+	stream.Write([]byte{0, 0, 0, 0})
+
+	netManager := routines.NewNetworkManager(configuration.DefaultNetworkChannelSize, bytes.NewReader(stream.Bytes()),
+		io.Discard)
+	utils.Check(netManager.Start())
+	defer netManager.Stop()
+	inMsgChan := netManager.GetInMsgChannel()
+	timeout := time.After(5 * time.Second)
+	for _, expected := range []byte{messages.HelloInfoMessageID, messages.ErrorMessageID} {
+		select {
+		case m := <-inMsgChan:
+			if m.GetMessageID() != expected {
+				t.Error("Test failed, expected message type ", expected, " got ", m.GetMessageID())
+				return
+			}
+			if expected == messages.ErrorMessageID {
+				//the role gets the original error
+				var corruption *messages.CorruptionError
+				err := netManager.MessageError(m.(*messages.ErrorMessage))
+				if !errors.As(err, &corruption) || corruption.Offset != int64(offset) {
+					t.Error("Test failed, unexpected error ", err)
+				}
+				if !errors.As(netManager.Err(), &corruption) {
+					t.Error("Test failed, unexpected failure ", netManager.Err())
+				}
+			}
+		case <-timeout:
+			t.Error("Test failed, timeout waiting for message type ", expected)
+			return
+		}
+	}
+}
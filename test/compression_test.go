@@ -0,0 +1,159 @@
+package test
+
+import (
+	"bytes"
+	"github.com/ftarlao/goblocksync/controller/routines"
+	"github.com/ftarlao/goblocksync/data/configuration"
+	"github.com/ftarlao/goblocksync/data/messages"
+	"github.com/ftarlao/goblocksync/utils"
+	"github.com/ftarlao/goblocksync/utils/compression"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestUnitCompressionRegistry(t *testing.T) {
+	t.Log("***Compression registry Test***\nRoundtrip of the algorithms and ordering by preference")
+
+	names := compression.Names()
+	if len(names) == 0 || names[0] != "flate" || names[len(names)-1] != compression.None {
+		t.Error("unexpected ordering of the compression algorithms: ", names)
+		return
+	}
+	data := *utils.GeneratePeriodicData(64*utils.KB, 100, 1)
+	for _, name := range names {
+		a, ok := compression.Get(name)
+		if !ok {
+			t.Error("algorithm ", name, " not found")
+			return
+		}
+		//twice, the second time the compressors are reused
+		for i := 0; i < 2; i++ {
+			compressed, err := a.Compress(data)
+			if err != nil {
+				t.Error(name, ": ", err)
+				return
+			}
+			if a.Enabled() && len(compressed) >= len(data) {
+				t.Error(name, ": periodic data not compressed")
+			}
+			result, err := a.Decompress(compressed, int64(len(data)))
+			if err != nil || !bytes.Equal(result, data) {
+				t.Error(name, ": roundtrip failed ", err)
+				return
+			}
+		}
+		if a.Enabled() {
+			compressed, _ := a.Compress(data)
+			_, err := a.Decompress(compressed, int64(len(data)-1))
+			if err == nil {
+				t.Error(name, ": decompressed block larger than the limit accepted")
+			}
+		}
+	}
+}
+
+func TestUnitCompressionSelectBest(t *testing.T) {
+	t.Log("***Compression registry Test***\nBoth peers select the preferred common algorithm")
+
+	testCompressionSelectBest(t, []string{"lzw", "gzip", "none"}, []string{"none", "gzip", "flate"}, "gzip")
+	testCompressionSelectBest(t, []string{"none", "gzip", "flate"}, []string{"lzw", "gzip", "none"}, "gzip")
+	testCompressionSelectBest(t, []string{"none"}, compression.Names(), "none")
+	testCompressionSelectBest(t, []string{"flate"}, []string{"lzw"}, "")
+	testCompressionSelectBest(t, []string{"unknown"}, []string{"unknown"}, "")
+}
+
+func testCompressionSelectBest(t *testing.T, local []string, remote []string, expected string) {
+	a, err := compression.SelectBest(local, remote)
+	if expected == "" {
+		if err == nil {
+			t.Error("expected no common algorithm for ", local, " and ", remote, ", got ", a.Name)
+		}
+		return
+	}
+	if err != nil || a.Name != expected {
+		t.Error("expected ", expected, " for ", local, " and ", remote, ", got ", a.Name, " ", err)
+	}
+}
+
+func TestUnitNetworkManagerCompression(t *testing.T) {
+	t.Log("***NetworkManager***\nCompressed data blocks, incompressible blocks are sent raw")
+
+	var blockSize int64 = 4 * utils.KB
+	rGen := rand.New(rand.NewSource(0))
+	random := make([]byte, blockSize)
+	rGen.Read(random)
+	periodic := *utils.GeneratePeriodicData(blockSize, 10, 1)
+
+	for _, name := range compression.Names() {
+		codec, _ := compression.Get(name)
+		//the sent stream is recorded, before the peer can decode it, to check the compression
+		pipeIn, pipeOut := io.Pipe()
+		var sent bytes.Buffer
+		netManager := routines.NewNetworkManager(configuration.DefaultNetworkChannelSize, pipeIn, io.MultiWriter(&sent, pipeOut))
+		netManager.SetCompression(codec, blockSize)
+		netManager.Start()
+
+		for i, data := range [][]byte{periodic, random, periodic[:10]} {
+			msgOut := messages.NewDataBlockMessage(7, append([]byte{}, data...))
+			outBefore := sent.Len()
+			if !CheckMsgRoundtrip(msgOut, netManager, t) {
+				return
+			}
+			if !bytes.Equal(msgOut.Data, data) {
+				t.Error(name, ": the sent message has been modified")
+			}
+			if codec.Enabled() && i == 0 && sent.Len()-outBefore >= len(data)/2 {
+				t.Error(name, ": periodic block sent with ", sent.Len()-outBefore, " bytes")
+			}
+		}
+		err := netManager.Stop()
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestUnitSourceDestinationCompressed(t *testing.T) {
+	t.Log("***Source/Destination V1***\nSync with compressed data blocks")
+
+	var size int64 = 300*utils.KB + 123
+	sourceData := *utils.GeneratePeriodicData(size, 1000, 1)
+	changed := append([]byte{}, sourceData...)
+	changed[10] ^= 0xFF
+	changed[200*utils.KB] ^= 0xFF
+
+	for _, name := range compression.Names() {
+		compressed := func(conf *configuration.Configuration) {
+			conf.Compression = name
+		}
+		testSourceDestination(t, sourceData, changed, "sha256", compressed)
+		testSourceDestination(t, sourceData, nil, "sha256", compressed)
+	}
+}
+
+func TestUnitNetworkManagerDecompressedLimits(t *testing.T) {
+	t.Log("***NetworkManager Decompressed Limits Test***\nA compressed block within the region limits, beyond them once decompressed, is refused")
+
+	var blockSize int64 = 4 * utils.KB
+	codec, _ := compression.Get("flate")
+	pipeIn, pipeOut := io.Pipe()
+	netManager := routines.NewNetworkManager(configuration.DefaultNetworkChannelSize, pipeIn, pipeOut)
+	netManager.SetCompression(codec, blockSize)
+	limits := messages.DefaultLimits()
+	limits.BlockSize, limits.EndLoc = blockSize, 100
+	netManager.SetLimits(limits)
+	utils.Check(netManager.Start())
+	defer netManager.Stop()
+
+	utils.Check(netManager.Send(messages.NewDataBlockMessage(0, *utils.GeneratePeriodicData(blockSize, 10, 1))))
+	select {
+	case m := <-netManager.GetInMsgChannel():
+		if m.GetMessageID() != messages.ErrorMessageID {
+			t.Error("Test failed, decompressed block beyond the limits accepted")
+		}
+	case <-time.After(TestTimeout):
+		t.Error("Test failed, timeout waiting for the refusal")
+	}
+}
@@ -0,0 +1,101 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/ftarlao/goblocksync/controller"
+	"github.com/ftarlao/goblocksync/data/configuration"
+	"github.com/ftarlao/goblocksync/utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUnitDiffReport(t *testing.T) {
+	t.Log("***Diff Report Test***\nAdjacent differing blocks are merged in extents")
+
+	report := controller.NewDiffReport(configuration.Configuration{BlockSize: 100})
+	report.Add(0, 100)
+	report.Add(100, 100)
+	report.Add(500, 100)
+	report.Add(600, 30)
+	if len(report.Extents) != 2 || report.Extents[0] != (controller.Extent{Start: 0, Length: 200}) ||
+		report.Extents[1] != (controller.Extent{Start: 500, Length: 130}) {
+		t.Error("wrong extents: ", report.Extents)
+		return
+	}
+	if report.DifferingBlocks != 4 || report.DifferingBytes != 330 {
+		t.Error("wrong totals: ", report.DifferingBlocks, " blocks, ", report.DifferingBytes, " bytes")
+		return
+	}
+
+	var b bytes.Buffer
+	utils.Check(report.Write(&b, configuration.ReportJSON))
+	var decoded controller.DiffReport
+	err := json.Unmarshal(b.Bytes(), &decoded)
+	if err != nil || len(decoded.Extents) != 2 || decoded.DifferingBytes != 330 {
+		t.Error("invalid JSON report, ", err)
+		return
+	}
+
+	//the destination bytes beyond the source size are the tail
+	report = controller.NewDiffReport(configuration.Configuration{BlockSize: 100,
+		SourceFile: configuration.FileDetails{Size: 250}, DestinationFile: configuration.FileDetails{Size: 1000}})
+	b.Reset()
+	utils.Check(report.Write(&b, configuration.ReportText))
+	if report.DestinationTail != 750 || !strings.Contains(b.String(), "Destination tail:\t 750") {
+		t.Error("wrong destination tail: ", report.DestinationTail)
+		return
+	}
+	t.Log("Test OK")
+}
+
+func TestUnitSourceDestinationDryRun(t *testing.T) {
+	t.Log("***Source/Destination Dry Run***\nThe destination is never written")
+
+	var size int64 = 100*utils.KB + 11
+	sourceData := *utils.GeneratePeriodicData(size, size, 1)
+	destinationData := append([]byte{}, sourceData[:size/2]...)
+	destinationData[10] ^= 0xFF
+
+	for _, sourceIsMaster := range []bool{true, false} {
+		dir := t.TempDir()
+		sourceName := filepath.Join(dir, "source")
+		destinationName := filepath.Join(dir, "destination")
+		utils.Check(os.WriteFile(sourceName, sourceData, 0644))
+		utils.Check(os.WriteFile(destinationName, destinationData, 0644))
+
+		conf := configuration.Configuration{
+			IsMaster:        true,
+			IsSource:        true,
+			SourceFile:      configuration.FileDetails{FileName: sourceName},
+			DestinationFile: configuration.FileDetails{FileName: destinationName},
+			BlockSize:       utils.KB,
+			HashAlgorithm:   "sha256",
+			DryRun:          true,
+			ReportFormat:    configuration.ReportText}
+		if !sourceIsMaster {
+			conf = conf.Complement()
+			conf.IsSource = true
+		}
+		err := runSourceDestination(conf)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		result, _ := os.ReadFile(destinationName)
+		if !bytes.Equal(result, destinationData) {
+			t.Error("the dry run modified the destination")
+			return
+		}
+		//the missing destination is not created
+		os.Remove(destinationName)
+		utils.Check(runSourceDestination(conf))
+		if _, err = os.Stat(destinationName); !os.IsNotExist(err) {
+			t.Error("the dry run created the destination")
+			return
+		}
+	}
+	t.Log("Test OK")
+}
@@ -0,0 +1,158 @@
+package test
+
+import (
+	"bytes"
+	"github.com/ftarlao/goblocksync/controller/routines"
+	"github.com/ftarlao/goblocksync/data/configuration"
+	"github.com/ftarlao/goblocksync/data/messages"
+	"github.com/ftarlao/goblocksync/utils"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnitFileDetails(t *testing.T) {
+	t.Log("***FileDetails Test***\nDiscovery of regular and missing files")
+
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "file")
+	utils.Check(os.WriteFile(fileName, make([]byte, 12345), 0644))
+
+	details := configuration.FileDetails{FileName: fileName}
+	exists, err := details.Update()
+	if !exists || err != nil {
+		t.Error("Test failed, regular file not found ", err)
+	}
+	if details.Size != 12345 || details.IsDevice || details.LogicalSectorSize != 0 || details.FileName != fileName {
+		t.Error("Test failed, wrong details ", details)
+	}
+	info, err := os.Stat(fileName)
+	utils.Check(err)
+	if details.ModTime != info.ModTime().UnixNano() {
+		t.Error("Test failed, wrong modification time ", details)
+	}
+
+	missing := configuration.FileDetails{FileName: filepath.Join(dir, "missing"), Size: 10}
+	exists, err = missing.Update()
+	if exists || err != nil || missing.Size != 0 {
+		t.Error("Test failed, missing file discovered as ", missing, " error ", err)
+	}
+
+	//the details of the local file are stored in the configuration
+	conf := configuration.Configuration{IsSource: false, DestinationFile: configuration.FileDetails{FileName: fileName}}
+	conf.LocalFile().Update()
+	if conf.DestinationFile.Size != 12345 || conf.RemoteFile() != &conf.SourceFile {
+		t.Error("Test failed, local file details not updated ", conf.DestinationFile)
+	}
+}
+
+func TestUnitCheckFiles(t *testing.T) {
+	t.Log("***CheckFiles Test***\nThe source should fit in a destination device")
+
+	conf := configuration.Configuration{
+		SourceFile:      configuration.FileDetails{FileName: "source", Size: 4 * utils.MB},
+		DestinationFile: configuration.FileDetails{FileName: "destination", Size: 1 * utils.MB}}
+	if conf.CheckFiles() != nil {
+		t.Error("Test failed, a regular destination grows")
+	}
+	conf.DestinationFile.IsDevice = true
+	if conf.CheckFiles() == nil {
+		t.Error("Test failed, the source does not fit in the destination device")
+	}
+	conf.DestinationFile.Size = 4 * utils.MB
+	if conf.CheckFiles() != nil {
+		t.Error("Test failed, the source fits in the destination device")
+	}
+	conf.Mode = configuration.ModeRolling
+	if conf.CheckFiles() == nil {
+		t.Error("Test failed, rolling mode accepted a destination device")
+	}
+}
+
+func TestUnitFileDetailsMessage(t *testing.T) {
+	t.Log("***FileDetailsMessage Test***\nRoundtrip of the device details")
+
+	pipeIn, pipeOut := io.Pipe()
+	netManager := routines.NewNetworkManager(configuration.DefaultNetworkChannelSize, pipeIn, pipeOut)
+	netManager.Start()
+	defer netManager.Stop()
+
+	details := configuration.FileDetails{FileName: "/dev/sdz", Size: 8 * utils.GB, IsDevice: true,
+		LogicalSectorSize: 512, PhysicalSectorSize: 4096}
+	CheckMsgRoundtrip(messages.NewFileDetailsMessage(details), netManager, t)
+}
+
+func TestUnitSizePolicy(t *testing.T) {
+	t.Log("***Size Policy Test***\nRegular destinations extended, truncated or kept")
+
+	sourceData := *utils.GeneratePeriodicData(30*utils.KB+100, 30*utils.KB+100, 21)
+	larger := *utils.GeneratePeriodicData(50*utils.KB, 50*utils.KB, 22)
+	smaller := larger[:10*utils.KB]
+	expectedSize := map[string][2]int{
+		"":                         {len(sourceData), len(sourceData)},
+		configuration.SizeTruncate: {len(sourceData), len(sourceData)},
+		configuration.SizeZeroTail: {len(sourceData), len(sourceData)},
+		configuration.SizeExtend:   {len(sourceData), len(larger)}}
+	for _, mode := range []string{configuration.ModeBlock, configuration.ModeMerkle} {
+		for policy, sizes := range expectedSize {
+			for i, destinationData := range [][]byte{smaller, larger} {
+				setup := func(conf *configuration.Configuration) {
+					conf.Mode = mode
+					conf.MerkleFanout = 4
+					conf.MerkleLevels = 2
+					conf.SizePolicy = policy
+				}
+				destinationName := syncFiles(t, sourceData, destinationData, setup)
+				result, err := os.ReadFile(destinationName)
+				if err != nil {
+					t.Error(err)
+					continue
+				}
+				if len(result) != sizes[i] {
+					t.Error("Test failed, mode ", mode, " policy ", policy, " destination of ", len(result),
+						" bytes, expected ", sizes[i])
+				}
+			}
+		}
+	}
+
+	//different sizes are refused before the sync
+	conf := configuration.Configuration{SizePolicy: configuration.SizeRefuse,
+		SourceFile:      configuration.FileDetails{FileName: "source", Size: 100},
+		DestinationFile: configuration.FileDetails{FileName: "destination", Size: 200}}
+	if conf.CheckFiles() == nil {
+		t.Error("Test failed, different sizes accepted by the refuse policy")
+	}
+	conf.DestinationFile.Size = 100
+	if conf.CheckFiles() != nil {
+		t.Error("Test failed, same sizes refused by the refuse policy")
+	}
+	conf.SizePolicy = "shrink"
+	if _, err := conf.Validate(); err == nil {
+		t.Error("Test failed, unknown size policy accepted")
+	}
+}
+
+func TestUnitZeroRange(t *testing.T) {
+	t.Log("***ZeroRange Test***\nUnaligned zeroed regions")
+
+	data := *utils.GenerateRampData(40*utils.KB, 5)
+	f, err := os.Create(filepath.Join(t.TempDir(), "device"))
+	utils.Check(err)
+	defer f.Close()
+	_, err = f.Write(data)
+	utils.Check(err)
+
+	err = routines.ZeroRange(f, 1000, 20*utils.KB, 512)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	copy(data[1000:1000+20*utils.KB], make([]byte, 20*utils.KB))
+	result, err := os.ReadFile(f.Name())
+	utils.Check(err)
+	if !bytes.Equal(result, data) {
+		t.Error("Test failed, wrong zeroed region")
+	}
+}
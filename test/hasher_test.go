@@ -10,6 +10,7 @@ import (
 	"time"
 	"io"
 	"reflect"
+	"runtime"
 )
 
 const TestTimeout = 5 * time.Second
@@ -223,3 +224,182 @@ MainLoop:
 		t.Log("Generated Hash(es):\n",hashStorage)
 	}
 }
+
+func TestUnitHasherImplStartLoc(t *testing.T) {
+	t.Log("Test the StartLoc of the HashGroupMessages, groups are aligned to the hasher start position")
+
+	var size int64 = 100 * utils.KB
+	var blockSize int64 = 64
+	var startLoc int64 = 3 * blockSize
+
+	for run := 0; run < 20; run++ {
+		fakeFile := utils.CreateRampedTmpRamReader(size, blockSize)
+		hasher := routines.NewHasherImpl(blockSize, fakeFile, startLoc, routines.DummyHash)
+		outMsg := hasher.GetOutMsgChannel()
+		hasher.Start()
+
+		expectedLoc := startLoc
+		var msg messages.Message
+	MainLoop:
+		for msg == nil || msg.GetMessageID() != messages.EndMessageID {
+			select {
+			case msg = <-outMsg:
+				if msg.GetMessageID() == messages.HashGroupMessageID {
+					hMsg := msg.(*messages.HashGroupMessage)
+					if hMsg.StartLoc != expectedLoc {
+						t.Error("HashGroupMessage StartLoc is ", hMsg.StartLoc, ", expected ", expectedLoc)
+						break MainLoop
+					}
+					expectedLoc += int64(hMsg.NumHash) * blockSize
+				}
+				if msg.GetMessageID() == messages.ErrorMessageID {
+					t.Error("error returned from hasher: ", msg.(*messages.ErrorMessage).Err)
+					break MainLoop
+				}
+			case <-time.After(TestTimeout):
+				t.Error("Timeout for Hasher, no EndMessage or no messages in queue")
+				break MainLoop
+			}
+		}
+		hasher.Stop()
+		if t.Failed() {
+			return
+		}
+	}
+	t.Log("Test OK")
+}
+
+func TestUnitHasherImplWorkers(t *testing.T) {
+	t.Log("Test the order of the hashes with many hashing workers")
+
+	var size int64 = 256*111 + 17
+	var blockSize int64 = 111
+
+	for _, workers := range []int{1, 2, 3, 16} {
+		fakeFile := utils.CreateRampedTmpRamReader(size, blockSize)
+		hasher := routines.NewHasherImplWorkers(blockSize, fakeFile, 0, routines.MaxMinHash, workers)
+		outMsg := hasher.GetOutMsgChannel()
+		hasher.Start()
+
+		var hashStorage [][]byte
+		expectedLoc := int64(0)
+		var msg messages.Message
+	MainLoop:
+		for msg == nil || msg.GetMessageID() != messages.EndMessageID {
+			select {
+			case msg = <-outMsg:
+				if msg.GetMessageID() == messages.HashGroupMessageID {
+					hMsg := msg.(*messages.HashGroupMessage)
+					if hMsg.StartLoc != expectedLoc {
+						t.Error("HashGroupMessage StartLoc is ", hMsg.StartLoc, ", expected ", expectedLoc)
+						break MainLoop
+					}
+					expectedLoc += int64(hMsg.NumHash) * blockSize
+					hashStorage = append(hashStorage, hMsg.HashGroup[:hMsg.NumHash]...)
+				}
+				if msg.GetMessageID() == messages.ErrorMessageID {
+					t.Error("error returned from hasher: ", msg.(*messages.ErrorMessage).Err)
+					break MainLoop
+				}
+			case <-time.After(TestTimeout):
+				t.Error("Timeout for Hasher, no EndMessage or no messages in queue")
+				break MainLoop
+			}
+		}
+		utils.Check(hasher.Stop())
+		if t.Failed() {
+			return
+		}
+		if int64(len(hashStorage)) != (size+blockSize-1)/blockSize {
+			t.Error("wrong number of hashes with ", workers, " workers: ", len(hashStorage))
+			return
+		}
+		for i, v := range hashStorage {
+			if v[0] != v[1] || v[0] != byte(i%256) {
+				t.Error("hash ", i, " out of order with ", workers, " workers")
+				return
+			}
+		}
+	}
+	t.Log("Test OK")
+}
+
+func TestUnitHasherImplStopMidFile(t *testing.T) {
+	t.Log("Test the stop of a hasher in the middle of a file, nothing is left running")
+
+	//larger than the internal buffers, the data reader is still reading on stop
+	var size int64 = 512 * utils.MB
+	var blockSize int64 = 4 * utils.KB
+
+	goroutines := runtime.NumGoroutine()
+	for run := 0; run < 3; run++ {
+		fakeFile := &zeroFile{size: size}
+		hasher := routines.NewHasherImplWorkers(blockSize, fakeFile, 0, routines.DummyHash, 4)
+		outMsg := hasher.GetOutMsgChannel()
+		hasher.Start()
+
+		//nobody reads the hashes after the first group
+		select {
+		case <-outMsg:
+		case <-time.After(TestTimeout):
+			t.Error("Timeout for Hasher, no messages in queue")
+			return
+		}
+		//the internal buffers fill up
+		time.Sleep(200 * time.Millisecond)
+		start := time.Now()
+		err := hasher.Stop()
+		if err != nil {
+			t.Error("stop failed: ", err)
+			return
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Error("stop took ", elapsed)
+			return
+		}
+	}
+
+	//the workers end asynchronously after the stop
+	deadline := time.Now().Add(TestTimeout)
+	for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Error("goroutines left running after the stop: ", n, ", expected ", goroutines)
+		return
+	}
+	t.Log("Test OK")
+}
+
+// Zero-filled file of the given size, the data is not allocated
+type zeroFile struct {
+	size int64
+	loc  int64
+}
+
+func (f *zeroFile) Read(p []byte) (int, error) {
+	if f.loc >= f.size {
+		return 0, io.EOF
+	}
+	n := int64(len(p))
+	if n > f.size-f.loc {
+		n = f.size - f.loc
+	}
+	for i := range p[:n] {
+		p[i] = 0
+	}
+	f.loc += n
+	return int(n), nil
+}
+
+func (f *zeroFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		f.loc = offset
+	case io.SeekCurrent:
+		f.loc += offset
+	case io.SeekEnd:
+		f.loc = f.size + offset
+	}
+	return f.loc, nil
+}
@@ -0,0 +1,49 @@
+package test
+
+import (
+	"github.com/ftarlao/goblocksync/utils/hashing"
+	"testing"
+)
+
+func TestUnitHashRegistry(t *testing.T) {
+	t.Log("***Hash registry Test***\nDeclared sizes and ordering by strength")
+
+	names := hashing.Names()
+	if len(names) == 0 || names[0] != "sha512_256" {
+		t.Error("unexpected ordering of the hash algorithms: ", names)
+		return
+	}
+	for _, name := range names {
+		a, ok := hashing.Get(name)
+		if !ok {
+			t.Error("algorithm ", name, " not found")
+			return
+		}
+		if h := a.Sum([]byte("goblocksync")); len(h) != a.Size {
+			t.Error("algorithm ", name, " declares ", a.Size, " bytes, produces ", len(h), " bytes")
+		}
+	}
+}
+
+func TestUnitHashSelectBest(t *testing.T) {
+	t.Log("***Hash registry Test***\nBoth peers select the strongest common algorithm")
+
+	testSelectBest(t, []string{"md5", "sha256", "crc32c"}, []string{"crc32c", "sha256", "sha1"}, "sha256")
+	testSelectBest(t, []string{"crc32c", "sha256", "sha1"}, []string{"md5", "sha256", "crc32c"}, "sha256")
+	testSelectBest(t, []string{"crc64"}, hashing.Names(), "crc64")
+	testSelectBest(t, []string{"md5", "unknown"}, []string{"unknown", "sha1"}, "")
+	testSelectBest(t, []string{"sha1"}, nil, "")
+}
+
+func testSelectBest(t *testing.T, local []string, remote []string, expected string) {
+	a, err := hashing.SelectBest(local, remote)
+	if expected == "" {
+		if err == nil {
+			t.Error("expected no common algorithm for ", local, " and ", remote, ", got ", a.Name)
+		}
+		return
+	}
+	if err != nil || a.Name != expected {
+		t.Error("expected ", expected, " for ", local, " and ", remote, ", got ", a.Name, " ", err)
+	}
+}
@@ -0,0 +1,84 @@
+package test
+
+import (
+	"bytes"
+	"github.com/ftarlao/goblocksync/controller"
+	"github.com/ftarlao/goblocksync/data/configuration"
+	"github.com/ftarlao/goblocksync/utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUnitHooks(t *testing.T) {
+	t.Log("***Sync Hooks Test***\nPre and post hooks around the sync, a failing hook fails the sync")
+
+	dir := t.TempDir()
+	server := controller.NewServer("127.0.0.1:0", dir)
+	err := server.Listen()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	go server.Serve()
+	defer server.Shutdown(TestTimeout)
+
+	sourceName := filepath.Join(dir, "source")
+	utils.Check(os.WriteFile(sourceName, *utils.GeneratePeriodicData(30*utils.KB, 10*utils.KB, 3), 0644))
+	outName := filepath.Join(dir, "hook.out")
+	record := `sh -c 'echo "$GOBLOCKSYNC_STATUS $GOBLOCKSYNC_DESTINATION" >> ` + outName + `'`
+	cases := []struct {
+		name     string
+		source   string
+		preHook  string
+		postHook string
+		failed   bool
+		synced   bool
+		output   string
+	}{
+		{"no hooks", sourceName, "", "", false, true, ""},
+		{"pre hook failure", sourceName, "sh -c 'exit 3'", record, true, false, ""},
+		{"post hook", sourceName, record, record, false, true, " localhost:destination\nok localhost:destination\n"},
+		{"post hook failure", sourceName, "", "sh -c 'exit 1'", true, true, ""},
+		{"sync failure", filepath.Join(dir, "missing"), "", record, true, false, "failed localhost:destination\n"}}
+	for _, c := range cases {
+		destinationName := filepath.Join(dir, "destination")
+		os.Remove(destinationName)
+		os.Remove(outName)
+		conf := configuration.Configuration{
+			IsMaster:        true,
+			IsSource:        true,
+			SourceFile:      configuration.FileDetails{FileName: c.source},
+			DestinationFile: configuration.FileDetails{FileName: "destination"},
+			BlockSize:       utils.KB,
+			RemoteHost:      "localhost",
+			ConnectAddress:  server.ListenAddress().String(),
+			NoSummary:       true,
+			PreHook:         c.preHook,
+			PostHook:        c.postHook}
+		if _, err = conf.Validate(); err != nil {
+			t.Error("Test failed, ", c.name, ": ", err)
+			continue
+		}
+		err = controller.NewMaster(conf).Start()
+		if (err != nil) != c.failed {
+			t.Error("Test failed, ", c.name, ": unexpected result ", err)
+		}
+		source, _ := os.ReadFile(c.source)
+		destination, destinationErr := os.ReadFile(destinationName)
+		if synced := destinationErr == nil && len(source) > 0 && bytes.Equal(source, destination); synced != c.synced {
+			t.Error("Test failed, ", c.name, ": synced ", synced)
+		}
+		output, _ := os.ReadFile(outName)
+		if string(output) != c.output {
+			t.Error("Test failed, ", c.name, ": hook output ", strings.TrimSpace(string(output)))
+		}
+	}
+
+	invalid := configuration.Configuration{IsMaster: true, SourceFile: configuration.FileDetails{FileName: "a"},
+		DestinationFile: configuration.FileDetails{FileName: "b"}, BlockSize: utils.KB, PostHook: `sh "unterminated`}
+	if _, err = invalid.Validate(); err == nil {
+		t.Error("Test failed, invalid hook command accepted")
+	}
+}
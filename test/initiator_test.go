@@ -0,0 +1,60 @@
+package test
+
+import (
+	"github.com/ftarlao/goblocksync/controller"
+	"github.com/ftarlao/goblocksync/data/configuration"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestUnitParseLocation(t *testing.T) {
+	t.Log("***ParseLocation Test***")
+	cases := [][3]string{
+		{"/dev/sda", "", "/dev/sda"},
+		{"host:/dev/sda", "host", "/dev/sda"},
+		{"user@host:relative/file", "user@host", "relative/file"},
+		{"./file:with:colons", "", "./file:with:colons"},
+		{":file", "", ":file"},
+	}
+	for _, c := range cases {
+		host, path := configuration.ParseLocation(c[0])
+		if host != c[1] || path != c[2] {
+			t.Error("Test failed with location = ", c[0], " host = ", host, " path = ", path)
+		}
+	}
+}
+
+func TestUnitSlaveCommand(t *testing.T) {
+	t.Log("***SlaveCommand Test***\nLocal slave and remote slave through the remote shell template")
+
+	conf := configuration.Configuration{}
+	cmd, err := controller.SlaveCommand(conf)
+	if err != nil || !reflect.DeepEqual(cmd.Args, []string{os.Args[0], "-S"}) {
+		t.Error("wrong local slave command: ", cmd.Args, err)
+	}
+	conf = configuration.Configuration{Verbose: true, LogFormat: configuration.LogJSON}
+	cmd, err = controller.SlaveCommand(conf)
+	if err != nil || !reflect.DeepEqual(cmd.Args, []string{os.Args[0], "-S", "-v", "-log-format", "json"}) {
+		t.Error("wrong local slave command with the log options: ", cmd.Args, err)
+	}
+
+	//stub remote shell, it ignores the host and executes the command locally
+	stub := filepath.Join(t.TempDir(), "rsh")
+	err = os.WriteFile(stub, []byte("#!/bin/sh\nshift 3\nexec \"$@\"\n"), 0755)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	conf = configuration.Configuration{RemoteHost: "user@host", RemoteShell: stub + " -p 2222", RemoteCommand: "echo"}
+	cmd, err = controller.SlaveCommand(conf)
+	if err != nil || !reflect.DeepEqual(cmd.Args, []string{stub, "-p", "2222", "user@host", "echo", "-S"}) {
+		t.Error("wrong remote slave command: ", cmd.Args, err)
+		return
+	}
+	out, err := cmd.Output()
+	if err != nil || string(out) != "-S\n" {
+		t.Error("the stub remote shell did not execute the slave command: ", string(out), err)
+	}
+}
@@ -0,0 +1,225 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/ftarlao/goblocksync/controller"
+	"github.com/ftarlao/goblocksync/data/configuration"
+	"github.com/ftarlao/goblocksync/utils"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func writeManifest(t *testing.T, manifest string) string {
+	fileName := filepath.Join(t.TempDir(), "jobs.json")
+	utils.Check(os.WriteFile(fileName, []byte(manifest), 0644))
+	return fileName
+}
+
+func TestUnitManifest(t *testing.T) {
+	t.Log("***Job Manifest Test***\nDefaults and job options over the command line configuration, invalid manifests")
+
+	fileName := writeManifest(t, `{
+		"Parallel": 3,
+		"Defaults": {"BlockSize": "64K", "Hash": "md5", "BandwidthLimit": 1048576, "Sparse": true},
+		"Jobs": [
+			{"Name": "lun0", "Source": "/dev/lun0", "Destination": "backup:/images/lun0.img"},
+			{"Source": "backup:/images/lun1.img", "Destination": "/tmp/lun1.img", "BlockSize": 4096, "Hash": "sha256",
+			 "Sparse": false, "Mode": "merkle"}]}`)
+	manifest, err := controller.LoadManifest(fileName)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	base := configuration.Configuration{IsMaster: true, BlockSize: utils.KB, Mode: configuration.ModeBlock,
+		MerkleFanout: configuration.DefaultMerkleFanout, MerkleLevels: configuration.DefaultMerkleLevels,
+		Compression: "none"}
+	jobs, err := manifest.Resolve(base)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if manifest.Parallel != 3 || len(jobs) != 2 {
+		t.Error("Test failed, ", manifest.Parallel, " parallel jobs and ", len(jobs), " jobs")
+		return
+	}
+	first, second := jobs[0].Config, jobs[1].Config
+	if jobs[0].Name != "lun0" || !first.IsSource || first.RemoteHost != "backup" ||
+		first.DestinationFile.FileName != "/images/lun0.img" || first.BlockSize != 64*utils.KB ||
+		first.HashAlgorithm != "md5" || first.BandwidthLimit != utils.MB || !first.Sparse || first.Compression != "none" {
+		t.Error("Test failed, wrong configuration of the first job ", first)
+	}
+	if jobs[1].Name != "/tmp/lun1.img" || second.IsSource || second.SourceFile.FileName != "/images/lun1.img" ||
+		second.BlockSize != 4096 || second.HashAlgorithm != "sha256" || second.Sparse ||
+		second.Mode != configuration.ModeMerkle || second.BandwidthLimit != utils.MB {
+		t.Error("Test failed, wrong configuration of the second job ", second)
+	}
+
+	invalid := map[string]string{
+		"unknown field": `{"Jobs": [{"Source": "a", "Destination": "b", "Blocksize2": 1}]}`,
+		"no jobs":       `{"Parallel": 2}`,
+		"bad size":      `{"Jobs": [{"Source": "a", "Destination": "b", "BlockSize": "4X"}]}`}
+	for name, data := range invalid {
+		if _, err = controller.LoadManifest(writeManifest(t, data)); err == nil {
+			t.Error("Test failed, manifest with ", name, " accepted")
+		}
+	}
+	manifest, err = controller.LoadManifest(writeManifest(t, `{"Jobs": [{"Source": "h1:a", "Destination": "h2:b"}]}`))
+	utils.Check(err)
+	if _, err = manifest.Resolve(base); err == nil {
+		t.Error("Test failed, job with two remote files accepted")
+	}
+}
+
+func TestUnitRunJobs(t *testing.T) {
+	t.Log("***Job Runner Test***\nParallel jobs through a slave daemon, a failed job does not stop the others")
+
+	dir := t.TempDir()
+	server := controller.NewServer("127.0.0.1:0", dir)
+	err := server.Listen()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	go server.Serve()
+	defer server.Shutdown(TestTimeout)
+
+	manifest := controller.Manifest{Parallel: 2, Defaults: controller.JobOptions{BlockSize: utils.KB,
+		Connect: server.ListenAddress().String()}}
+	for i := 0; i < 4; i++ {
+		sourceName := filepath.Join(dir, "source"+strconv.Itoa(i))
+		//the third source is missing
+		if i != 2 {
+			utils.Check(os.WriteFile(sourceName, *utils.GeneratePeriodicData(40*utils.KB+int64(i), 40*utils.KB, int64(i)), 0644))
+		}
+		manifest.Jobs = append(manifest.Jobs, controller.Job{Name: "job" + strconv.Itoa(i), Source: sourceName,
+			Destination: "localhost:" + filepath.Join(dir, "destination"+strconv.Itoa(i))})
+	}
+	jobs, err := manifest.Resolve(configuration.Configuration{IsMaster: true, BlockSize: configuration.DefaultBlockSize,
+		Mode: configuration.ModeBlock})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	//the summary lines of the concurrent jobs are not printed
+	stdout := os.Stdout
+	out, err := os.Create(filepath.Join(dir, "stdout"))
+	utils.Check(err)
+	os.Stdout = out
+	report := controller.RunJobs(jobs, manifest.Parallel)
+	os.Stdout = stdout
+	out.Close()
+	if printed, _ := os.ReadFile(out.Name()); len(printed) > 0 {
+		t.Error("Test failed, concurrent jobs printed ", string(printed))
+	}
+	if report.FailedJobs != 1 || len(report.Jobs) != 4 {
+		t.Error("Test failed, ", report.FailedJobs, " failed jobs of ", len(report.Jobs))
+	}
+	for i, result := range report.Jobs {
+		if result.Name != "job"+strconv.Itoa(i) || result.Failed != (i == 2) {
+			t.Error("Test failed, unexpected result ", result)
+			continue
+		}
+		if result.Failed {
+			continue
+		}
+		source, _ := os.ReadFile(filepath.Join(dir, "source"+strconv.Itoa(i)))
+		destination, _ := os.ReadFile(filepath.Join(dir, "destination"+strconv.Itoa(i)))
+		if !bytes.Equal(source, destination) {
+			t.Error("Test failed, destination ", i, " not synched")
+		}
+	}
+
+	var summary bytes.Buffer
+	utils.Check(report.Write(&summary, configuration.ReportJSON))
+	var decoded controller.JobReport
+	utils.Check(json.Unmarshal(summary.Bytes(), &decoded))
+	if decoded.FailedJobs != 1 || decoded.Jobs[2].Error == "" {
+		t.Error("Test failed, wrong JSON summary ", summary.String())
+	}
+}
+
+func TestUnitRunJobsSharedConnections(t *testing.T) {
+	t.Log("***Job Runner Test***\nThe jobs share the slave connections, at most one for each parallel job")
+
+	dir := t.TempDir()
+	server := controller.NewServer("127.0.0.1:0", dir)
+	err := server.Listen()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	go server.Serve()
+	defer server.Shutdown(TestTimeout)
+
+	//the connections to the daemon go through a counting proxy
+	proxy, err := net.Listen("tcp", "127.0.0.1:0")
+	utils.Check(err)
+	defer proxy.Close()
+	var connections int32
+	go func() {
+		for {
+			conn, err := proxy.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&connections, 1)
+			daemon, err := net.Dial("tcp", server.ListenAddress().String())
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			go func() {
+				io.Copy(daemon, conn)
+				daemon.Close()
+			}()
+			go func() {
+				io.Copy(conn, daemon)
+				conn.Close()
+			}()
+		}
+	}()
+
+	for _, parallel := range []int{1, 2} {
+		atomic.StoreInt32(&connections, 0)
+		manifest := controller.Manifest{Parallel: parallel, Defaults: controller.JobOptions{BlockSize: utils.KB,
+			Connect: proxy.Addr().String()}}
+		for i := 0; i < 5; i++ {
+			sourceName := filepath.Join(dir, "source"+strconv.Itoa(i))
+			utils.Check(os.WriteFile(sourceName, *utils.GeneratePeriodicData(20*utils.KB+int64(i), 20*utils.KB, int64(parallel+i)), 0644))
+			job := controller.Job{Source: sourceName, Destination: "localhost:" + filepath.Join(dir, "destination"+strconv.Itoa(i))}
+			//the slave is the source too
+			if i == 3 {
+				job.Source, job.Destination = "localhost:"+sourceName, filepath.Join(dir, "destination"+strconv.Itoa(i))
+			}
+			manifest.Jobs = append(manifest.Jobs, job)
+		}
+		jobs, err := manifest.Resolve(configuration.Configuration{IsMaster: true, BlockSize: configuration.DefaultBlockSize,
+			Mode: configuration.ModeBlock, NoSummary: true})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		report := controller.RunJobs(jobs, manifest.Parallel)
+		if report.FailedJobs != 0 {
+			t.Error("Test failed, ", report.FailedJobs, " failed jobs with ", parallel, " parallel jobs ", report.Jobs)
+			return
+		}
+		if n := atomic.LoadInt32(&connections); n < 1 || int(n) > parallel {
+			t.Error("Test failed, ", n, " slave connections for ", parallel, " parallel jobs")
+		}
+		for i := range manifest.Jobs {
+			source, _ := os.ReadFile(filepath.Join(dir, "source"+strconv.Itoa(i)))
+			destination, _ := os.ReadFile(filepath.Join(dir, "destination"+strconv.Itoa(i)))
+			if !bytes.Equal(source, destination) {
+				t.Error("Test failed, destination ", i, " not synched with ", parallel, " parallel jobs")
+			}
+		}
+	}
+}
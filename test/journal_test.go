@@ -0,0 +1,121 @@
+package test
+
+import (
+	"bytes"
+	"github.com/ftarlao/goblocksync/controller"
+	"github.com/ftarlao/goblocksync/data/configuration"
+	"github.com/ftarlao/goblocksync/utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUnitJournal(t *testing.T) {
+	t.Log("***Journal Test***\nThe journal resumes only the same sync, from the confirmed location")
+
+	dir := t.TempDir()
+	sourceName := filepath.Join(dir, "source")
+	destinationName := filepath.Join(dir, "destination")
+	journalName := filepath.Join(dir, "journal")
+	var size int64 = 200 * utils.KB
+	sourceData := *utils.GeneratePeriodicData(size, size, 1)
+	utils.Check(os.WriteFile(sourceName, sourceData, 0644))
+	//the first half is synced, the second one differs
+	destinationData := append([]byte{}, sourceData[:size/2]...)
+	destinationData = append(destinationData, *utils.GeneratePeriodicData(size/2, size/2, 2)...)
+	utils.Check(os.WriteFile(destinationName, destinationData, 0644))
+
+	conf := configuration.Configuration{
+		IsMaster:        true,
+		IsSource:        true,
+		SourceFile:      configuration.FileDetails{FileName: sourceName},
+		DestinationFile: configuration.FileDetails{FileName: destinationName},
+		BlockSize:       utils.KB,
+		HashAlgorithm:   "sha256",
+		JournalFile:     journalName}
+
+	//the journal records the files discovered by the peers
+	_, err := conf.SourceFile.Update()
+	utils.Check(err)
+	_, err = conf.DestinationFile.Update()
+	utils.Check(err)
+	journal := controller.NewJournal(conf)
+	journal.ConfirmedLoc = size / 2
+	utils.Check(journal.Save(journalName))
+
+	//a different sync is refused
+	other := conf
+	other.BlockSize = 2 * utils.KB
+	loaded, err := controller.LoadJournal(journalName)
+	utils.Check(err)
+	if loaded.Resume(&other) == nil {
+		t.Error("resume accepted with a different block size")
+		return
+	}
+	other = conf
+	other.DestinationFile.FileName += "2"
+	if loaded.Resume(&other) == nil {
+		t.Error("resume accepted with a different destination")
+		return
+	}
+	//the remote files are checked once discovered
+	other = conf
+	other.SourceFile.ModTime++
+	if loaded.Check(other) == nil {
+		t.Error("resume accepted with a modified remote source")
+		return
+	}
+	replacement := destinationName + ".new"
+	utils.Check(os.WriteFile(replacement, destinationData, 0644))
+	utils.Check(os.Rename(replacement, destinationName))
+	other = conf
+	_, err = other.DestinationFile.Update()
+	utils.Check(err)
+	if loaded.Check(other) == nil {
+		t.Error("resume accepted with a replaced destination")
+		return
+	}
+	later := time.Now().Add(time.Hour)
+	utils.Check(os.Chtimes(sourceName, later, later))
+	if loaded.Resume(&conf) == nil {
+		t.Error("resume accepted with a modified source")
+		return
+	}
+
+	//the files are the same again
+	_, err = conf.SourceFile.Update()
+	utils.Check(err)
+	_, err = conf.DestinationFile.Update()
+	utils.Check(err)
+	journal = controller.NewJournal(conf)
+	journal.ConfirmedLoc = size / 2
+	utils.Check(journal.Save(journalName))
+	loaded, err = controller.LoadJournal(journalName)
+	utils.Check(err)
+	err = loaded.Resume(&conf)
+	if err == nil {
+		err = loaded.Check(conf)
+	}
+	if err != nil || conf.StartLoc != size/2 || !conf.Resume {
+		t.Error("resume refused, ", err)
+		return
+	}
+	//the confirmed region is not synced again: a change there survives the resumed sync, and the whole-file
+	//verification reports it
+	destinationData[0] ^= 0xFF
+	utils.Check(os.WriteFile(destinationName, destinationData, 0644))
+	err = runSourceDestination(conf)
+	if err == nil || !strings.Contains(err.Error(), "integrity verification failed") {
+		t.Error("the change in the confirmed region should fail the verification, ", err)
+		return
+	}
+	result, err := os.ReadFile(destinationName)
+	utils.Check(err)
+	if !bytes.Equal(result[1:], sourceData[1:]) || result[0] == sourceData[0] {
+		t.Error("the resumed sync should sync only the region after the confirmed location")
+		return
+	}
+	t.Log("Test OK")
+}
@@ -0,0 +1,167 @@
+package test
+
+import (
+	"bytes"
+	"encoding/gob"
+	"github.com/ftarlao/goblocksync/data/configuration"
+	"github.com/ftarlao/goblocksync/data/messages"
+	"github.com/ftarlao/goblocksync/utils"
+	"github.com/ftarlao/goblocksync/utils/hashing"
+	"runtime"
+	"testing"
+)
+
+// Limits of a 1MB block mode sync with 4K blocks and sha256 hashes
+func testLimits() messages.Limits {
+	algorithm, _ := hashing.Get("sha256")
+	return messages.NewLimits(configuration.Configuration{
+		BlockSize:       4 * utils.KB,
+		Mode:            configuration.ModeBlock,
+		SourceFile:      configuration.FileDetails{Size: utils.MB},
+		DestinationFile: configuration.FileDetails{Size: utils.MB / 2}}, algorithm)
+}
+
+func TestUnitLimits(t *testing.T) {
+	t.Log("***Message Limits Test***\nMessages within and beyond the negotiated limits")
+
+	limits := testLimits()
+	hashGroup := func(numHash int, hashSize int) *messages.HashGroupMessage {
+		m := messages.NewHashGroupMessage(0)
+		for i := 0; i < numHash; i++ {
+			m.AddHash(make([]byte, hashSize))
+		}
+		m.TruncHashGroup()
+		return m
+	}
+	accepted := []messages.Message{
+		hashGroup(configuration.HashGroupMessageSize, 32),
+		messages.NewDataBlockMessage(utils.MB-4*utils.KB, make([]byte, 4*utils.KB)),
+		messages.NewLiteralDeltaMessage(0, make([]byte, 100)),
+		messages.NewCopyDeltaMessage(utils.KB, 0, utils.MB/2),
+		messages.NewZeroBlockMessage(0, utils.MB),
+		messages.NewCheckpointMessage(utils.MB),
+		messages.NewHashRequestMessage(0, 0)}
+	for _, m := range accepted {
+		if err := limits.Check(m); err != nil {
+			t.Error("Test failed, message type ", m.GetMessageID(), " refused: ", err)
+		}
+	}
+	tooLarge := messages.NewHashGroupMessage(0)
+	tooLarge.HashGroup = append(tooLarge.HashGroup, []byte{1})
+	refused := map[string]messages.Message{
+		"hash size":          hashGroup(10, 20),
+		"hashes per group":   tooLarge,
+		"negative numhash":   &messages.HashGroupMessage{NumHash: -1},
+		"hash level":         &messages.HashRequestMessage{Level: 1},
+		"block size":         messages.NewDataBlockMessage(0, make([]byte, 4*utils.KB+1)),
+		"negative startloc":  messages.NewDataBlockMessage(-1, []byte{1}),
+		"beyond the files":   messages.NewDataBlockMessage(utils.MB-1, []byte{1, 2}),
+		"overflowing region": messages.NewZeroBlockMessage(1, 1<<62+1<<62-1),
+		"delta length":       &messages.DeltaMessage{Length: 10, Data: []byte{1}},
+		"copy location":      messages.NewCopyDeltaMessage(0, -5, 10),
+		"hello lists":        &messages.HelloInfoMessage{SupportedProtocols: make([]int, configuration.MaxHelloListSize+1)}}
+	for name, m := range refused {
+		if err := limits.Check(m); err == nil {
+			t.Error("Test failed, ", name, " accepted")
+		}
+	}
+}
+
+func TestUnitGobLimitReader(t *testing.T) {
+	t.Log("***Gob Limit Reader Test***\nGob messages larger than the limit are refused before their decoding")
+
+	var stream bytes.Buffer
+	encoder := gob.NewEncoder(&stream)
+	utils.Check(messages.EncodeMessage(encoder, messages.NewCheckpointMessage(utils.KB)))
+	utils.Check(messages.EncodeMessage(encoder, messages.NewDataBlockMessage(0, make([]byte, 64*utils.KB))))
+
+	decode := func(max int) (decoded int, err error) {
+		decoder := gob.NewDecoder(messages.NewGobLimitReader(messages.NewChecksumReader(bytes.NewReader(stream.Bytes())), max))
+		for ; decoded < 2; decoded++ {
+			_, err = messages.DecodeMessage(decoder)
+			if err != nil {
+				return decoded, err
+			}
+		}
+		return decoded, nil
+	}
+	if decoded, err := decode(65 * utils.KB); err != nil || decoded != 2 {
+		t.Error("Test failed, ", decoded, " messages decoded within the limit, error ", err)
+	}
+	if decoded, err := decode(16 * utils.KB); err == nil || decoded != 1 {
+		t.Error("Test failed, large block decoded beyond the limit, ", decoded, " messages decoded")
+	}
+}
+
+// Seeds of the fuzz targets, one message of each type
+func fuzzSeeds() []messages.Message {
+	hashGroup := messages.NewHashGroupMessage(4096)
+	hashGroup.AddHash(make([]byte, 32))
+	hashGroup.TruncHashGroup()
+	return []messages.Message{
+		hashGroup,
+		messages.NewHelloInfo(),
+		messages.NewErrorMessage(bytes.ErrTooLarge),
+		&configuration.Configuration{BlockSize: 4 * utils.KB, SourceFile: configuration.FileDetails{FileName: "source"}},
+		messages.NewEndMessage(),
+		messages.NewDataBlockMessage(0, []byte{1, 2, 3}),
+		messages.NewHashRequestMessage(0, 0),
+		messages.NewLiteralDeltaMessage(0, []byte{4, 5}),
+		messages.NewCheckpointMessage(utils.KB),
+		messages.NewExtentMessage(0, utils.KB),
+		messages.NewBandwidthMessage(utils.MB, 0),
+		messages.NewDigestMessage("sha256", 3, make([]byte, 32)),
+		messages.NewZeroBlockMessage(0, utils.KB),
+		messages.NewFileDetailsMessage(configuration.FileDetails{FileName: "destination", Size: utils.KB})}
+}
+
+// Decodes the messages of data, the allocated bytes should be bounded by the message limit
+func fuzzDecode(t *testing.T, data []byte, decode func(limits messages.Limits, in *messages.ChecksumReader) (messages.Message, error)) {
+	limits := testLimits()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	in := messages.NewChecksumReader(bytes.NewReader(data))
+	for i := 0; i < 16; i++ {
+		m, err := decode(limits, in)
+		if err != nil {
+			break
+		}
+		if limits.Check(m) != nil {
+			break
+		}
+	}
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > uint64(16*limits.MaxMessageSize()+len(data)) {
+		t.Error("Test failed, ", allocated, " bytes allocated decoding ", len(data), " bytes")
+	}
+}
+
+func FuzzDecodeMessage(f *testing.F) {
+	for _, m := range fuzzSeeds() {
+		var stream bytes.Buffer
+		utils.Check(messages.EncodeMessage(gob.NewEncoder(&stream), m))
+		f.Add(stream.Bytes())
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var decoder *gob.Decoder
+		fuzzDecode(t, data, func(limits messages.Limits, in *messages.ChecksumReader) (messages.Message, error) {
+			if decoder == nil {
+				decoder = gob.NewDecoder(messages.NewGobLimitReader(in, limits.MaxMessageSize()))
+			}
+			return messages.DecodeMessage(decoder)
+		})
+	})
+}
+
+func FuzzDecodeFrame(f *testing.F) {
+	for _, m := range fuzzSeeds() {
+		var stream bytes.Buffer
+		utils.Check(messages.EncodeFrame(&stream, m))
+		f.Add(stream.Bytes())
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzDecode(t, data, func(limits messages.Limits, in *messages.ChecksumReader) (messages.Message, error) {
+			return messages.DecodeFrame(in, limits.MaxMessageSize())
+		})
+	})
+}
@@ -0,0 +1,88 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/ftarlao/goblocksync/controller"
+	"github.com/ftarlao/goblocksync/data/configuration"
+	"github.com/ftarlao/goblocksync/utils"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Thread safe log output
+type logBuffer struct {
+	lock sync.Mutex
+	b    bytes.Buffer
+}
+
+func (l *logBuffer) Write(p []byte) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.b.Write(p)
+}
+
+func TestUnitSessionLog(t *testing.T) {
+	t.Log("***Session Log Test***\nThe records of master and slave carry the same session, their roles and the offset")
+
+	var out logBuffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	dir := t.TempDir()
+	server := controller.NewServer("127.0.0.1:0", dir)
+	err := server.Listen()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	go server.Serve()
+
+	source := filepath.Join(dir, "source")
+	utils.Check(os.WriteFile(source, *utils.GeneratePeriodicData(20*utils.KB, 4*utils.KB, 1), 0644))
+	config := configuration.Configuration{IsMaster: true, BlockSize: 4 * utils.KB, Mode: configuration.ModeBlock,
+		ConnectAddress: server.ListenAddress().String()}
+	utils.Check(config.SetLocations(source, "localhost:"+filepath.Join(dir, "destination")))
+	err = controller.NewMaster(config).Start()
+	//the slave records are complete after the shutdown
+	server.Shutdown(TestTimeout)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	roles := make(map[string]int)
+	sessions := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(out.b.String()), "\n") {
+		var record map[string]any
+		if json.Unmarshal([]byte(line), &record) != nil {
+			t.Error("Test failed, invalid record ", line)
+			continue
+		}
+		session, hasSession := record[configuration.LogSession].(string)
+		role, _ := record[configuration.LogRole].(string)
+		if _, ok := record[configuration.LogOffset]; !ok || !hasSession || role == "" {
+			t.Error("Test failed, record without session, role or offset ", line)
+			continue
+		}
+		//records of the daemon outside the sessions
+		if role == controller.RoleDaemon {
+			roles[role]++
+			continue
+		}
+		if session == "" {
+			t.Error("Test failed, session record without session ", line)
+			continue
+		}
+		sessions[session] = true
+		roles[role]++
+	}
+	if len(sessions) != 1 || roles["master/source"] == 0 || roles["slave/destination"] == 0 ||
+		roles[controller.RoleDaemon] == 0 {
+		t.Error("Test failed, sessions ", sessions, " roles ", roles)
+	}
+}
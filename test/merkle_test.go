@@ -0,0 +1,66 @@
+package test
+
+import (
+	"bytes"
+	"github.com/ftarlao/goblocksync/controller/routines"
+	"github.com/ftarlao/goblocksync/utils"
+	"github.com/ftarlao/goblocksync/utils/hashing"
+	"testing"
+)
+
+func TestUnitMerkleTree(t *testing.T) {
+	t.Log("***Merkle Tree Test***\nNode hashes are the hashes of the children hashes, at each level")
+
+	algorithm, _ := hashing.Get("sha256")
+	tree := routines.MerkleTree{BlockSize: 64, Fanout: 4, Algorithm: algorithm}
+	var size int64 = 64*4*4*3 + 100
+	fakeFile := utils.CreatePeriodicTmpRamReader(size, size, 3)
+
+	levelHashes := func(start int64, end int64, level int) (hashes [][]byte, locs []int64) {
+		err := tree.NodeHashes(fakeFile, start, end, level, func(startLoc int64, hash []byte) error {
+			hashes = append(hashes, hash)
+			locs = append(locs, startLoc)
+			return nil
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		return
+	}
+
+	blocks, _ := levelHashes(0, -1, 0)
+	if int64(len(blocks)) != (size+63)/64 {
+		t.Error("wrong number of block hashes: ", len(blocks))
+		return
+	}
+	for level := 1; level <= 3; level++ {
+		children, _ := levelHashes(0, -1, level-1)
+		nodes, locs := levelHashes(0, -1, level)
+		expectedNodes := (len(children) + 3) / 4
+		if len(nodes) != expectedNodes {
+			t.Error("level ", level, " has ", len(nodes), " nodes, expected ", expectedNodes)
+			return
+		}
+		for i, node := range nodes {
+			if locs[i] != int64(i)*tree.NodeSize(level) {
+				t.Error("level ", level, " node ", i, " starts at ", locs[i])
+				return
+			}
+			last := 4 * (i + 1)
+			if last > len(children) {
+				last = len(children)
+			}
+			if !bytes.Equal(node, algorithm.Sum(bytes.Join(children[4*i:last], nil))) {
+				t.Error("level ", level, " node ", i, " is not the hash of its children")
+				return
+			}
+			//the children of a single node, as computed for the refinement
+			nodeChildren, _ := levelHashes(locs[i], locs[i]+tree.NodeSize(level), level-1)
+			if !bytes.Equal(bytes.Join(nodeChildren, nil), bytes.Join(children[4*i:last], nil)) {
+				t.Error("level ", level, " node ", i, " children differ when computed on the node region")
+				return
+			}
+		}
+	}
+	t.Log("Test OK")
+}
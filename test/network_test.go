@@ -16,7 +16,16 @@ import (
 
 func TestUnitNetworkManagerRoundtrip(t *testing.T) {
 	t.Log("***NetworkManager***\nCheck Roundtrip for different message types")
+	for _, protocol := range configuration.SupportedProtocols {
+		for _, checksums := range []bool{false, true} {
+			t.Log("Protocol version ", protocol, ", CRC32C trailers ", checksums)
+			testNetworkManagerRoundtrip(t, protocol, checksums)
+		}
+	}
+}
 
+// Roundtrip of the messages following the hello, encoded with the protocol version and the optional trailers
+func testNetworkManagerRoundtrip(t *testing.T, protocol int, checksums bool) {
 	//Base configuration
 	confOut := &configuration.Configuration{
 		StartLoc:        0,
@@ -33,14 +42,19 @@ func TestUnitNetworkManagerRoundtrip(t *testing.T) {
 	pipeIn, pipeOut := io.Pipe()
 	netManager := routines.NewNetworkManager(confOut.EstimateNetworkChannelSize(), pipeIn, pipeOut)
 	inMsgChan := netManager.GetInMsgChannel()
+	netManager.SetSupportedProtocols([]int{configuration.ProtocolGob, protocol})
+	netManager.SetChecksums(checksums)
 
 	netManager.Start()
 
+	//the hello is always gob encoded, the reader switches after it as the handshake does
 	helloOut := messages.NewHelloInfo()
+	helloOut.Checksums = checksums
 	res := CheckMsgRoundtrip(helloOut, netManager, t)
 	if !res {
 		return
 	}
+	netManager.SwitchProtocol(protocol, checksums)
 
 	res = CheckMsgRoundtrip(confOut, netManager, t)
 	if !res {
@@ -96,7 +110,7 @@ func TestUnitNetworkManagerRoundtrip(t *testing.T) {
 	}
 }
 
-func CheckMsgRoundtrip(msgOut messages.Message, netManager routines.NetworkManager, t *testing.T) bool {
+func CheckMsgRoundtrip(msgOut messages.Message, netManager *routines.NetworkManager, t *testing.T) bool {
 	outMsgChan := netManager.GetOutMsgChannel()
 	inMsgChan := netManager.GetInMsgChannel()
 
@@ -170,3 +184,42 @@ func benchmarkMsgRoundtrip(msg messages.Message, msgSize int64, testDataBytes in
 	mbSec := dataPayloadMB / duration.Seconds()
 	t.Logf("Size of data payload: %.3f MB, Duration [sec]: %.3f  Serialization speed: %.3f MB/s", dataPayloadMB, duration.Seconds(), mbSec)
 }
+
+func TestUnitNetworkManagerStopWhileSending(t *testing.T) {
+	t.Log("***NetworkManager Stop Test***\nStop while other goroutines are sending, the sends fail after the stop")
+
+	in, inWriter := io.Pipe()
+	defer inWriter.Close()
+	netManager := routines.NewNetworkManager(configuration.DefaultNetworkChannelSize, in, io.Discard)
+	utils.Check(netManager.Start())
+
+	senders := 4
+	results := make(chan error, senders)
+	for i := 0; i < senders; i++ {
+		go func() {
+			for {
+				err := netManager.Send(messages.NewCheckpointMessage(utils.KB))
+				if err != nil {
+					results <- err
+					return
+				}
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	err := netManager.Stop()
+	if err != nil {
+		t.Error(err)
+	}
+	for i := 0; i < senders; i++ {
+		select {
+		case <-results:
+		case <-time.After(5 * time.Second):
+			t.Error("Test failed, a sender is still running after the stop")
+			return
+		}
+	}
+	if netManager.Send(messages.NewEndMessage()) == nil {
+		t.Error("Test failed, message sent after the stop")
+	}
+}
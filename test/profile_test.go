@@ -0,0 +1,80 @@
+package test
+
+import (
+	"flag"
+	"github.com/ftarlao/goblocksync/controller"
+	"github.com/ftarlao/goblocksync/utils"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnitProfile(t *testing.T) {
+	t.Log("***Configuration Profile Test***\nNamed and default profiles, unknown profiles and fields")
+
+	fileName := filepath.Join(t.TempDir(), "goblocksync.json")
+	utils.Check(os.WriteFile(fileName, []byte(`{
+		"DefaultProfile": "lan",
+		"Profiles": {
+			"lan": {"BlockSize": "64K", "Hash": "sha256", "RemoteShell": "ssh -p 2222", "Sparse": false},
+			"daemon": {"Connect": "backup:7373", "TLSPin": "ab01", "BandwidthLimit": "10M"}}}`), 0644))
+
+	profile, err := controller.LoadProfile(fileName, "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if profile.BlockSize != 64*utils.KB || profile.Hash != "sha256" || profile.RemoteShell != "ssh -p 2222" ||
+		profile.Sparse == nil || *profile.Sparse {
+		t.Error("Test failed, wrong default profile ", profile)
+	}
+	profile, err = controller.LoadProfile(fileName, "daemon")
+	if err != nil || profile.Connect != "backup:7373" || profile.TLSPin != "ab01" ||
+		profile.BandwidthLimit != 10*utils.MB || profile.BlockSize != 0 {
+		t.Error("Test failed, wrong daemon profile ", profile, ", error ", err)
+	}
+	if _, err = controller.LoadProfile(fileName, "wan"); err == nil {
+		t.Error("Test failed, unknown profile accepted")
+	}
+
+	utils.Check(os.WriteFile(fileName, []byte(`{"Profiles": {"lan": {"Blocksize2": 1}}}`), 0644))
+	if _, err = controller.LoadProfile(fileName, "lan"); err == nil {
+		t.Error("Test failed, unknown profile field accepted")
+	}
+	//no default profile, no options
+	utils.Check(os.WriteFile(fileName, []byte(`{"Profiles": {"lan": {"Hash": "md5"}}}`), 0644))
+	if profile, err = controller.LoadProfile(fileName, ""); err != nil || profile.Hash != "" {
+		t.Error("Test failed, options without a default profile ", profile, ", error ", err)
+	}
+}
+
+func TestUnitProfileFlags(t *testing.T) {
+	t.Log("***Configuration Profile Flags Test***\nThe command line options override the profile, the other flags take the profile values")
+
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	blockSize := flags.String("block-size", "4096", "")
+	hash := flags.String("hash", "", "")
+	rsh := flags.String("rsh", "ssh", "")
+	flags.StringVar(rsh, "e", "ssh", "")
+	sparse := flags.Bool("sparse", false, "")
+	preHook := flags.String("pre-hook", "", "")
+	postHook := flags.String("post-hook", "", "")
+	utils.Check(flags.Parse([]string{"-hash", "md5", "-e", "ssh -p 1", "-post-hook", "cli-post"}))
+
+	enabled := true
+	profile := controller.JobOptions{BlockSize: 64 * utils.KB, Hash: "sha256", RemoteShell: "ssh -p 2222",
+		Sparse: &enabled, Connect: "backup:7373", PreHook: "profile-pre", PostHook: "profile-post"}
+	err := profile.ApplyToFlags(flags)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if *blockSize != "65536" || !*sparse || *preHook != "profile-pre" {
+		t.Error("Test failed, profile options not applied, block size ", *blockSize, " sparse ", *sparse, " pre hook ",
+			*preHook)
+	}
+	if *hash != "md5" || *rsh != "ssh -p 1" || *postHook != "cli-post" {
+		t.Error("Test failed, command line options overridden, hash ", *hash, " remote shell ", *rsh, " post hook ",
+			*postHook)
+	}
+}
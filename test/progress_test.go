@@ -0,0 +1,82 @@
+package test
+
+import (
+	"github.com/ftarlao/goblocksync/controller/routines"
+	"github.com/ftarlao/goblocksync/data/messages"
+	"github.com/ftarlao/goblocksync/utils"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUnitProgress(t *testing.T) {
+	t.Log("***Progress Test***\nCounters, hasher position and progress line")
+
+	var size int64 = 100 * utils.KB
+	reader := utils.CreatePeriodicTmpRamReader(size, size, 1)
+	hasher := routines.NewHasherImpl(utils.KB, reader, 10*utils.KB, routines.DummyHash)
+
+	progress := routines.NewProgress(true)
+	progress.SetTotal(size - 10*utils.KB)
+	progress.SetHasher(hasher, 10*utils.KB)
+	hasher.Start()
+	for msg := range hasher.GetOutMsgChannel() {
+		if msg.GetMessageID() != messages.HashGroupMessageID {
+			break
+		}
+	}
+	hasher.Stop()
+	progress.SetHashedRemote(30 * utils.KB)
+	progress.AddCompared(45 * utils.KB)
+	progress.AddMatched(40 * utils.KB)
+	progress.AddTransferred(5 * utils.KB)
+
+	s := progress.Snapshot()
+	if s.HashedLocal != 90*utils.KB || s.HashedRemote != 30*utils.KB || s.Matched != 40*utils.KB || s.Written >= 0 || s.Done() != 45*utils.KB {
+		t.Error("unexpected snapshot ", s)
+		return
+	}
+	line := routines.FormatProgress(s, float64(15*utils.KB))
+	expected := "hashed 90.0 KiB/30.0 KiB matched 40.0 KiB transferred 5.0 KiB | 15.0 KiB/s 50% ETA 00:03"
+	if line != expected {
+		t.Error("unexpected progress line: ", line)
+	}
+
+	//the destination does not know the total
+	s = routines.NewProgress(false).Snapshot()
+	if line = routines.FormatProgress(s, 0); strings.Contains(line, "ETA") || strings.Contains(line, "matched") {
+		t.Error("unexpected destination progress line: ", line)
+	}
+}
+
+func TestUnitProgressReporter(t *testing.T) {
+	t.Log("***Progress Test***\nLog lines when the output is not a terminal, final line on Finish")
+
+	out, err := os.Create(filepath.Join(t.TempDir(), "progress"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer out.Close()
+
+	progress := routines.NewProgress(true)
+	progress.SetTotal(utils.MB)
+	routines.NewProgressReporter(progress, out, slog.New(slog.NewTextHandler(out, nil))).Start()
+	progress.AddCompared(utils.MB)
+	time.Sleep(10 * time.Millisecond)
+	progress.Finish()
+	progress.Finish()
+
+	data, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 1 || !strings.Contains(lines[0], "msg=Progress") || !strings.Contains(lines[0], "offset=1048576") || !strings.Contains(lines[0], "100%") || strings.Contains(lines[0], "\r") {
+		t.Error("unexpected reporter output: ", string(data))
+	}
+}
@@ -0,0 +1,186 @@
+package test
+
+import (
+	"bytes"
+	"github.com/ftarlao/goblocksync/controller"
+	"github.com/ftarlao/goblocksync/controller/routines"
+	"github.com/ftarlao/goblocksync/data/configuration"
+	"github.com/ftarlao/goblocksync/utils"
+	"github.com/ftarlao/goblocksync/utils/compression"
+	"github.com/ftarlao/goblocksync/utils/hashing"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnitSourceDestinationV1(t *testing.T) {
+	t.Log("***Source/Destination V1***\nSync destination files of different sizes and contents")
+
+	var size int64 = 300*utils.KB + 123
+	sourceData := *utils.GeneratePeriodicData(size, size, 1)
+
+	//destination with few changed blocks
+	changed := append([]byte{}, sourceData...)
+	changed[10] ^= 0xFF
+	changed[200*utils.KB] ^= 0xFF
+
+	testSourceDestinationV1(t, sourceData, changed, "sha256")
+	testSourceDestinationV1(t, sourceData, sourceData[:100*utils.KB+7], "sha256")
+	testSourceDestinationV1(t, sourceData, nil, "sha256")
+	testSourceDestinationV1(t, sourceData, *utils.GeneratePeriodicData(size, size, 2), "sha256")
+
+	//all the registered algorithms
+	for _, name := range hashing.Names() {
+		testSourceDestinationV1(t, sourceData, changed, name)
+	}
+}
+
+func TestUnitSourceDestinationMerkle(t *testing.T) {
+	t.Log("***Source/Destination Merkle***\nSync destination files of different sizes and contents, hierarchical hashes")
+
+	var size int64 = 300*utils.KB + 123
+	sourceData := *utils.GeneratePeriodicData(size, size, 1)
+
+	changed := append([]byte{}, sourceData...)
+	changed[10] ^= 0xFF
+	changed[200*utils.KB] ^= 0xFF
+	changed[size-1] ^= 0xFF
+
+	for _, levels := range []int{1, 2, 3} {
+		merkle := func(conf *configuration.Configuration) {
+			conf.Mode = configuration.ModeMerkle
+			conf.MerkleFanout = 4
+			conf.MerkleLevels = levels
+		}
+		testSourceDestination(t, sourceData, sourceData, "sha256", merkle)
+		testSourceDestination(t, sourceData, changed, "sha256", merkle)
+		testSourceDestination(t, sourceData, sourceData[:100*utils.KB+7], "md5", merkle)
+		testSourceDestination(t, sourceData, nil, "sha1", merkle)
+		testSourceDestination(t, sourceData, *utils.GeneratePeriodicData(2*size, 2*size, 2), "sha256", merkle)
+	}
+}
+
+func TestUnitSourceDestinationRolling(t *testing.T) {
+	t.Log("***Source/Destination Rolling***\nSync destination files with shifted content, rolling checksum deltas")
+
+	var size int64 = 300*utils.KB + 123
+	sourceData := *utils.GeneratePeriodicData(size, size, 1)
+
+	//bytes inserted and removed, the following blocks are shifted
+	shifted := append([]byte{}, sourceData[:1000]...)
+	shifted = append(shifted, 1, 2, 3)
+	shifted = append(shifted, sourceData[1000:150*utils.KB]...)
+	shifted = append(shifted, sourceData[150*utils.KB+17:]...)
+
+	rolling := func(conf *configuration.Configuration) {
+		conf.Mode = configuration.ModeRolling
+	}
+	testSourceDestination(t, sourceData, sourceData, "sha256", rolling)
+	testSourceDestination(t, sourceData, shifted, "sha256", rolling)
+	testSourceDestination(t, sourceData, sourceData[500:], "md5", rolling)
+	testSourceDestination(t, sourceData, append(append([]byte{}, sourceData...), sourceData...), "sha1", rolling)
+	testSourceDestination(t, sourceData, nil, "sha256", rolling)
+	testSourceDestination(t, sourceData[:100], shifted, "sha256", rolling)
+}
+
+func testSourceDestinationV1(t *testing.T, sourceData []byte, destinationData []byte, hashName string) {
+	testSourceDestination(t, sourceData, destinationData, hashName, nil)
+}
+
+// Syncs the destination data with the source data, setup customizes the configuration
+func testSourceDestination(t *testing.T, sourceData []byte, destinationData []byte, hashName string,
+	setup func(*configuration.Configuration)) {
+	var conf configuration.Configuration
+	destinationName := syncFiles(t, sourceData, destinationData, func(c *configuration.Configuration) {
+		c.HashAlgorithm = hashName
+		if setup != nil {
+			setup(c)
+		}
+		conf = *c
+	})
+	if destinationName == "" {
+		return
+	}
+
+	result, err := os.ReadFile(destinationName)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if conf.Mode == configuration.ModeRolling && len(result) != len(sourceData) {
+		t.Error("destination file size differs from the source file size")
+		return
+	}
+	if !bytes.HasPrefix(result, sourceData) {
+		t.Error("destination file is not synched with the source file")
+		return
+	}
+	t.Log("Destination of ", len(destinationData), " bytes synched with ", hashName, ", OK")
+}
+
+// Writes the source and destination files (no destination file when destinationData is nil) and syncs them with the
+// master source, returns the destination file name, empty when the sync fails
+func syncFiles(t *testing.T, sourceData []byte, destinationData []byte, setup func(*configuration.Configuration)) string {
+	dir := t.TempDir()
+	sourceName := filepath.Join(dir, "source")
+	destinationName := filepath.Join(dir, "destination")
+	utils.Check(os.WriteFile(sourceName, sourceData, 0644))
+	if destinationData != nil {
+		utils.Check(os.WriteFile(destinationName, destinationData, 0644))
+	}
+
+	conf := configuration.Configuration{
+		IsMaster:        true,
+		IsSource:        true,
+		SourceFile:      configuration.FileDetails{FileName: sourceName},
+		DestinationFile: configuration.FileDetails{FileName: destinationName},
+		BlockSize:       utils.KB,
+		HashAlgorithm:   "sha256"}
+	if setup != nil {
+		setup(&conf)
+	}
+
+	err := runSourceDestination(conf)
+	if err != nil {
+		t.Error(err)
+		return ""
+	}
+	return destinationName
+}
+
+// Runs source and destination controllers connected by a pair of pipes, returns the first error
+func runSourceDestination(conf configuration.Configuration) error {
+	sourceIn, destinationOut := io.Pipe()
+	destinationIn, sourceOut := io.Pipe()
+	sourceNet := routines.NewNetworkManager(conf.EstimateNetworkChannelSize(), sourceIn, sourceOut)
+	destinationNet := routines.NewNetworkManager(conf.EstimateNetworkChannelSize(), destinationIn, destinationOut)
+	sourceNet.Start()
+	destinationNet.Start()
+	if conf.Compression != "" {
+		codec, _ := compression.Get(conf.Compression)
+		sourceNet.SetCompression(codec, conf.BlockSize)
+		destinationNet.SetCompression(codec, conf.BlockSize)
+	}
+
+	source, err := controller.NewSource(conf, 1, sourceNet)
+	if err != nil {
+		return err
+	}
+	destination, err := controller.NewDestination(conf.Complement(), 1, destinationNet)
+	if err != nil {
+		return err
+	}
+
+	destinationErr := make(chan error, 1)
+	go func() {
+		destinationErr <- destination.Start()
+	}()
+	err = source.Start()
+	if dErr := <-destinationErr; err == nil {
+		err = dErr
+	}
+	sourceNet.Stop()
+	destinationNet.Stop()
+	return err
+}
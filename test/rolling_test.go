@@ -0,0 +1,82 @@
+package test
+
+import (
+	"bytes"
+	"github.com/ftarlao/goblocksync/controller/routines"
+	"github.com/ftarlao/goblocksync/data/messages"
+	"github.com/ftarlao/goblocksync/utils"
+	"github.com/ftarlao/goblocksync/utils/hashing"
+	"testing"
+)
+
+func TestUnitRollingChecksum(t *testing.T) {
+	t.Log("***Rolling Checksum Test***\nThe rolled checksum equals the checksum computed on the window")
+
+	data := *utils.GeneratePeriodicData(4*utils.KB, 4*utils.KB, 5)
+	window := 100
+	var rolling, direct routines.RollingChecksum
+	rolling.Init(data[:window])
+	for i := 1; i+window <= len(data); i++ {
+		rolling.Roll(data[i-1], data[i+window-1])
+		direct.Init(data[i : i+window])
+		if rolling.Sum() != direct.Sum() {
+			t.Error("rolled checksum differs at offset ", i)
+			return
+		}
+	}
+	t.Log("Test OK")
+}
+
+func TestUnitDeltaScan(t *testing.T) {
+	t.Log("***Delta Scan Test***\nThe delta instructions rebuild the source from the old blocks")
+
+	var blockSize int64 = 256
+	algorithm, _ := hashing.Get("sha256")
+	old := *utils.GeneratePeriodicData(64*blockSize+10, 64*blockSize+10, 7)
+	source := append([]byte{}, old[:1000]...)
+	source = append(source, []byte("inserted bytes")...)
+	source = append(source, old[1000:]...)
+	//new tail longer than a block, its last literal reaches the end of the source
+	source = append(source, *utils.GeneratePeriodicData(3*blockSize/2, 3*blockSize/2, 9)...)
+
+	index := routines.NewSignatureIndex(blockSize, algorithm)
+	for loc := int64(0); loc < int64(len(old)); loc += blockSize {
+		end := loc + blockSize
+		if end > int64(len(old)) {
+			end = int64(len(old))
+		}
+		utils.Check(index.Add(loc, routines.BlockSignature(old[loc:end], algorithm)))
+	}
+
+	var rebuilt []byte
+	var copied int64
+	err := routines.DeltaScan(bytes.NewReader(source), index, blockSize, func(delta *messages.DeltaMessage) error {
+		if delta.StartLoc != int64(len(rebuilt)) {
+			t.Error("delta instruction out of order at ", delta.StartLoc)
+		}
+		if delta.IsLiteral() {
+			if delta.Length > blockSize {
+				t.Error("literal larger than a block, ", delta.Length)
+			}
+			rebuilt = append(rebuilt, delta.Data...)
+		} else {
+			rebuilt = append(rebuilt, old[delta.CopyLoc:delta.CopyLoc+delta.Length]...)
+			copied += delta.Length
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !bytes.Equal(rebuilt, source) {
+		t.Error("rebuilt data differs from the source")
+		return
+	}
+	//all the old blocks but the ones around the insertion and the partial tail are copied
+	if copied < int64(len(old))-3*blockSize {
+		t.Error("too few bytes copied from the old blocks: ", copied)
+		return
+	}
+	t.Log("Copied ", copied, " bytes of ", len(source), ", OK")
+}
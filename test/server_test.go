@@ -0,0 +1,127 @@
+package test
+
+import (
+	"bytes"
+	"github.com/ftarlao/goblocksync/controller"
+	"github.com/ftarlao/goblocksync/data/configuration"
+	"github.com/ftarlao/goblocksync/utils"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestUnitServerSessions(t *testing.T) {
+	t.Log("***Server***\nConcurrent master sessions over TCP, then graceful shutdown")
+
+	dir := t.TempDir()
+	server := controller.NewServer("127.0.0.1:0", dir)
+	err := server.Listen()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve()
+	}()
+
+	const numSessions = 4
+	results := make(chan error, numSessions)
+	for i := 0; i < numSessions; i++ {
+		sourceName := filepath.Join(dir, "source"+strconv.Itoa(i))
+		destinationName := filepath.Join(dir, "destination"+strconv.Itoa(i))
+		utils.Check(os.WriteFile(sourceName, *utils.GeneratePeriodicData(50*utils.KB+int64(i), 50*utils.KB, int64(i)), 0644))
+
+		conf := configuration.Configuration{
+			IsMaster:        true,
+			IsSource:        true,
+			SourceFile:      configuration.FileDetails{FileName: sourceName},
+			DestinationFile: configuration.FileDetails{FileName: destinationName},
+			BlockSize:       utils.KB,
+			RemoteHost:      "localhost",
+			ConnectAddress:  server.ListenAddress().String()}
+		go func() {
+			results <- controller.NewMaster(conf).Start()
+		}()
+	}
+	for i := 0; i < numSessions; i++ {
+		select {
+		case err = <-results:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(TestTimeout):
+			t.Error("Timeout for the master sessions")
+			return
+		}
+	}
+	for i := 0; i < numSessions; i++ {
+		source, _ := os.ReadFile(filepath.Join(dir, "source"+strconv.Itoa(i)))
+		destination, _ := os.ReadFile(filepath.Join(dir, "destination"+strconv.Itoa(i)))
+		if !bytes.Equal(source, destination) {
+			t.Error("destination ", i, " is not synched with the source")
+		}
+	}
+
+	err = server.Shutdown(TestTimeout)
+	if err != nil {
+		t.Error(err)
+	}
+	if err = <-serveErr; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUnitServerRoot(t *testing.T) {
+	t.Log("***Server Root Test***\nThe sessions are confined to the root, a non loopback address requires the client authentication")
+
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	utils.Check(os.Mkdir(root, 0755))
+	utils.Check(os.Symlink(dir, filepath.Join(root, "outside")))
+	source := filepath.Join(dir, "source")
+	utils.Check(os.WriteFile(source, *utils.GeneratePeriodicData(10*utils.KB, 2*utils.KB, 1), 0644))
+
+	if controller.NewServer(":0", root).Listen() == nil {
+		t.Error("Test failed, listening on all the interfaces without client authentication")
+	}
+	server := controller.NewServer("127.0.0.1:0", root)
+	err := server.Listen()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	go server.Serve()
+	defer server.Shutdown(TestTimeout)
+
+	for _, c := range []struct {
+		destination string
+		allowed     bool
+	}{
+		{"relative", true},
+		{filepath.Join(root, "sub", "..", "absolute"), true},
+		{"../escaped", false},
+		{filepath.Join(dir, "absolute"), false},
+		{"outside/linked", false},
+	} {
+		config := configuration.Configuration{IsMaster: true, BlockSize: utils.KB, Mode: configuration.ModeBlock,
+			ConnectAddress: server.ListenAddress().String()}
+		utils.Check(config.SetLocations(source, "localhost:"+c.destination))
+		err = controller.NewMaster(config).Start()
+		if (err == nil) != c.allowed {
+			t.Error("Test failed, destination ", c.destination, " allowed ", c.allowed, ", error ", err)
+		}
+	}
+	for _, name := range []string{"escaped", "absolute", "linked"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			t.Error("Test failed, file written outside the root ", name)
+		}
+	}
+	for _, name := range []string{"relative", "absolute"} {
+		if _, err := os.Stat(filepath.Join(root, name)); err != nil {
+			t.Error("Test failed, file not written inside the root ", name)
+		}
+	}
+}
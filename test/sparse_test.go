@@ -0,0 +1,135 @@
+package test
+
+import (
+	"bytes"
+	"github.com/ftarlao/goblocksync/controller/routines"
+	"github.com/ftarlao/goblocksync/data/configuration"
+	"github.com/ftarlao/goblocksync/data/messages"
+	"github.com/ftarlao/goblocksync/utils"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// In memory sparse file, the punched regions are zeroed and recorded
+type memoryPuncher struct {
+	memoryWriterAt
+	punched     int64
+	unsupported bool
+}
+
+func (m *memoryPuncher) PunchHole(off int64, length int64) error {
+	if m.unsupported {
+		return routines.ErrHolesUnsupported
+	}
+	if end := off + length; end > int64(len(m.data)) {
+		m.data = append(m.data, make([]byte, end-int64(len(m.data)))...)
+	}
+	copy(m.data[off:off+length], make([]byte, length))
+	m.punched += length
+	return nil
+}
+
+func TestUnitWriterZeroBlocks(t *testing.T) {
+	t.Log("***Writer ZeroBlockMessage Test***\nZero regions written as zeros, or punched in sparse files")
+
+	var blockSize int64 = 100
+	data := *utils.GenerateRampData(20*blockSize, 7)
+	expected := append([]byte{}, data...)
+	copy(expected[3*blockSize:8*blockSize], make([]byte, 5*blockSize))
+	//the last zero region extends the file
+	expected = append(expected, make([]byte, 4*blockSize)...)
+
+	plain := &memoryPuncher{memoryWriterAt: memoryWriterAt{failAt: -1}}
+	plainFile := struct{ routines.WriterAtSyncer }{plain}
+	unsupported := &memoryPuncher{memoryWriterAt: memoryWriterAt{failAt: -1}, unsupported: true}
+	sparse := &memoryPuncher{memoryWriterAt: memoryWriterAt{failAt: -1}}
+
+	for _, file := range []routines.WriterAtSyncer{plainFile, unsupported, sparse} {
+		writer := routines.NewWriterImpl(file, 64, 8*blockSize)
+		in := writer.GetInMsgChannel()
+		in <- messages.NewDataBlockMessage(0, data)
+		in <- messages.NewZeroBlockMessage(3*blockSize, 5*blockSize)
+		in <- messages.NewZeroBlockMessage(20*blockSize, 4*blockSize)
+		in <- messages.NewEndMessage()
+		writer.Start()
+
+		select {
+		case msg := <-writer.GetOutMsgChannel():
+			if msg.GetMessageID() != messages.EndMessageID {
+				t.Error("expected EndMessage from writer, got message type ", msg.GetMessageID())
+			}
+		case <-time.After(TestTimeout):
+			t.Error("Timeout for Writer, no EndMessage")
+		}
+		writer.Stop()
+		if writer.GetWrittenBytes() != int64(len(data))+9*blockSize {
+			t.Error("wrong number of written bytes: ", writer.GetWrittenBytes())
+		}
+	}
+	for i, m := range []*memoryPuncher{plain, unsupported, sparse} {
+		if !bytes.Equal(m.data, expected) {
+			t.Error("Test failed, wrong data with file ", i)
+		}
+	}
+	if plain.punched != 0 || unsupported.punched != 0 || sparse.punched != 9*blockSize {
+		t.Error("Test failed, wrong punched bytes ", plain.punched, unsupported.punched, sparse.punched)
+	}
+}
+
+func TestUnitSparseFile(t *testing.T) {
+	t.Log("***SparseFile Test***\nHoles inside the file and beyond its end")
+
+	data := *utils.GenerateRampData(64*utils.KB, 3)
+	f, err := os.Create(filepath.Join(t.TempDir(), "sparse"))
+	utils.Check(err)
+	defer f.Close()
+	_, err = f.Write(data)
+	utils.Check(err)
+
+	sparse := routines.NewSparseFile(f)
+	expected := append([]byte{}, data...)
+	for _, hole := range [][2]int64{{16 * utils.KB, 8 * utils.KB}, {60 * utils.KB, 8 * utils.KB}, {100 * utils.KB, 4 * utils.KB}} {
+		err = sparse.PunchHole(hole[0], hole[1])
+		if err == routines.ErrHolesUnsupported {
+			t.Skip("hole punching is not supported here")
+		}
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if end := hole[0] + hole[1]; end > int64(len(expected)) {
+			expected = append(expected, make([]byte, end-int64(len(expected)))...)
+		}
+		copy(expected[hole[0]:hole[0]+hole[1]], make([]byte, hole[1]))
+	}
+	result, err := os.ReadFile(f.Name())
+	utils.Check(err)
+	if !bytes.Equal(result, expected) {
+		t.Error("Test failed, the file with holes has the wrong content")
+	}
+}
+
+func TestUnitSourceDestinationZeroBlocks(t *testing.T) {
+	t.Log("***Source/Destination Zero Blocks Test***\nZero regions of the source, plain and sparse destinations")
+
+	sourceData := *utils.GeneratePeriodicData(100*utils.KB, 100*utils.KB, 11)
+	copy(sourceData[10*utils.KB:40*utils.KB], make([]byte, 30*utils.KB))
+	sourceData = append(sourceData, make([]byte, 50*utils.KB)...)
+	destinationData := *utils.GeneratePeriodicData(120*utils.KB, 120*utils.KB, 12)
+
+	for _, mode := range []string{configuration.ModeBlock, configuration.ModeMerkle} {
+		for _, sparse := range []bool{false, true} {
+			setup := func(conf *configuration.Configuration) {
+				conf.Mode = mode
+				conf.MerkleFanout = 4
+				conf.MerkleLevels = 2
+				conf.Sparse = sparse
+			}
+			testSourceDestination(t, sourceData, destinationData, "sha256", setup)
+			testSourceDestination(t, sourceData, destinationData[:20*utils.KB], "sha256", setup)
+			testSourceDestination(t, sourceData, nil, "sha256", setup)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/ftarlao/goblocksync/controller"
+	"github.com/ftarlao/goblocksync/data/configuration"
+	"github.com/ftarlao/goblocksync/utils"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Throwaway certificate, signed by parent (self-signed when parent is nil); files are written in dir as name.crt and
+// name.key
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+func newTestCert(t *testing.T, dir string, name string, isCA bool, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	utils.Check(err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signerCert, signerKey := template, key
+	if parent != nil {
+		signerCert, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signerCert, &key.PublicKey, signerKey)
+	utils.Check(err)
+	cert, err := x509.ParseCertificate(der)
+	utils.Check(err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	utils.Check(err)
+
+	c := &testCert{cert: cert, key: key, certFile: filepath.Join(dir, name+".crt"), keyFile: filepath.Join(dir, name+".key")}
+	utils.Check(os.WriteFile(c.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	utils.Check(os.WriteFile(c.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return c
+}
+
+func TestUnitServerTLS(t *testing.T) {
+	t.Log("***Server TLS***\nMutual authentication and certificate pinning")
+
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "ca", true, nil)
+	serverCert := newTestCert(t, dir, "server", false, ca)
+	clientCert := newTestCert(t, dir, "client", false, ca)
+	otherCA := newTestCert(t, dir, "otherca", true, nil)
+	rogueClient := newTestCert(t, dir, "rogue", false, otherCA)
+
+	tlsConfig, err := controller.ServerTLSConfig(serverCert.certFile, serverCert.keyFile, ca.certFile)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	server := controller.NewServer("127.0.0.1:0", dir)
+	server.TLSConfig = tlsConfig
+	err = server.Listen()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	go server.Serve()
+	defer server.Shutdown(TestTimeout)
+
+	base := configuration.Configuration{ConnectAddress: server.ListenAddress().String()}
+
+	conf := base
+	conf.TLSCertFile, conf.TLSKeyFile, conf.TLSCAFile = clientCert.certFile, clientCert.keyFile, ca.certFile
+	testTLSSync(t, dir, conf, true, "mutual authentication")
+
+	conf.TLSPin = controller.CertificateFingerprint(serverCert.cert)
+	testTLSSync(t, dir, conf, true, "mutual authentication and pin")
+
+	conf = base
+	conf.TLSCertFile, conf.TLSKeyFile = clientCert.certFile, clientCert.keyFile
+	conf.TLSPin = controller.CertificateFingerprint(serverCert.cert)
+	testTLSSync(t, dir, conf, true, "pin only")
+
+	conf.TLSPin = controller.CertificateFingerprint(clientCert.cert)
+	testTLSSync(t, dir, conf, false, "wrong pin")
+
+	conf = base
+	conf.TLSCAFile = ca.certFile
+	testTLSSync(t, dir, conf, false, "no client certificate")
+
+	conf.TLSCertFile, conf.TLSKeyFile = rogueClient.certFile, rogueClient.keyFile
+	testTLSSync(t, dir, conf, false, "client certificate from unknown CA")
+
+	conf = base
+	conf.TLSCertFile, conf.TLSKeyFile, conf.TLSCAFile = clientCert.certFile, clientCert.keyFile, otherCA.certFile
+	testTLSSync(t, dir, conf, false, "daemon certificate from unknown CA")
+}
+
+func testTLSSync(t *testing.T, dir string, conf configuration.Configuration, expectSuccess bool, description string) {
+	sourceName := filepath.Join(dir, "source")
+	destinationName := filepath.Join(dir, "destination")
+	data := *utils.GeneratePeriodicData(20*utils.KB, 20*utils.KB, time.Now().UnixNano())
+	utils.Check(os.WriteFile(sourceName, data, 0644))
+	os.Remove(destinationName)
+
+	conf.IsMaster = true
+	conf.IsSource = true
+	conf.SourceFile = configuration.FileDetails{FileName: sourceName}
+	conf.DestinationFile = configuration.FileDetails{FileName: destinationName}
+	conf.BlockSize = utils.KB
+	conf.RemoteHost = "localhost"
+
+	result := make(chan error, 1)
+	go func() {
+		result <- controller.NewMaster(conf).Start()
+	}()
+	var err error
+	select {
+	case err = <-result:
+	case <-time.After(TestTimeout):
+		t.Error("Timeout for the master session, ", description)
+		return
+	}
+	if expectSuccess {
+		destination, _ := os.ReadFile(destinationName)
+		if err != nil || !bytes.Equal(data, destination) {
+			t.Error("TLS sync failed, ", description, ": ", err)
+			return
+		}
+	} else if err == nil {
+		t.Error("TLS sync should fail, ", description)
+		return
+	}
+	t.Log(description, ", OK ", err)
+}
@@ -0,0 +1,86 @@
+package test
+
+import (
+	"bytes"
+	"github.com/ftarlao/goblocksync/controller"
+	"github.com/ftarlao/goblocksync/data/configuration"
+	"github.com/ftarlao/goblocksync/utils"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUnitTreeSync(t *testing.T) {
+	t.Log("***Directory Tree Sync Test***\nNested directories through a slave daemon, missing and changed files synced, " +
+		"unchanged files skipped, extra entries deleted")
+
+	source, destination := filepath.Join(t.TempDir(), "source"), filepath.Join(t.TempDir(), "destination")
+	server := controller.NewServer("127.0.0.1:0", filepath.Dir(destination))
+	err := server.Listen()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	go server.Serve()
+	defer server.Shutdown(TestTimeout)
+
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	files := map[string][]byte{
+		"a":          *utils.GeneratePeriodicData(50*utils.KB, 10*utils.KB, 1),
+		"sub/b":      *utils.GeneratePeriodicData(30*utils.KB+7, 4*utils.KB, 2),
+		"sub/deep/c": {},
+		"same":       []byte("source content"),
+		"changed":    *utils.GeneratePeriodicData(20*utils.KB, 2*utils.KB, 3)}
+	for name, data := range files {
+		fileName := filepath.Join(source, filepath.FromSlash(name))
+		utils.Check(os.MkdirAll(filepath.Dir(fileName), 0755))
+		utils.Check(os.WriteFile(fileName, data, 0640))
+		utils.Check(os.Chtimes(fileName, modTime, modTime))
+	}
+	utils.Check(os.Mkdir(filepath.Join(source, "empty"), 0700))
+
+	//same size and modification time, skipped by the quick check even if the content differs
+	utils.Check(os.MkdirAll(filepath.Join(destination, "extra/dir"), 0755))
+	utils.Check(os.WriteFile(filepath.Join(destination, "same"), []byte("stale  content"), 0644))
+	utils.Check(os.Chtimes(filepath.Join(destination, "same"), modTime, modTime))
+	utils.Check(os.WriteFile(filepath.Join(destination, "changed"), files["a"], 0644))
+	utils.Check(os.WriteFile(filepath.Join(destination, "extra/dir/x"), []byte{1}, 0644))
+	utils.Check(os.WriteFile(filepath.Join(destination, "y"), []byte{2}, 0644))
+
+	config := configuration.Configuration{IsMaster: true, BlockSize: 4 * utils.KB, Mode: configuration.ModeBlock,
+		Recursive: true, DeleteExtras: true, ConnectAddress: server.ListenAddress().String()}
+	utils.Check(config.SetLocations(source, "localhost:"+destination))
+	_, err = config.Validate()
+	if err == nil {
+		err = controller.NewMaster(config).Start()
+	}
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for name, data := range files {
+		fileName := filepath.Join(destination, filepath.FromSlash(name))
+		synced, err := os.ReadFile(fileName)
+		if name == "same" {
+			data = []byte("stale  content")
+		}
+		if err != nil || !bytes.Equal(synced, data) {
+			t.Error("Test failed, unexpected content of ", name, ", error ", err)
+			continue
+		}
+		info, _ := os.Stat(fileName)
+		if !info.ModTime().Equal(modTime) || (name != "same" && info.Mode().Perm() != 0640) {
+			t.Error("Test failed, ", name, " modified at ", info.ModTime(), " with permissions ", info.Mode())
+		}
+	}
+	if info, err := os.Stat(filepath.Join(destination, "empty")); err != nil || !info.IsDir() {
+		t.Error("Test failed, empty directory not created, error ", err)
+	}
+	for _, name := range []string{"extra", "y"} {
+		if _, err := os.Stat(filepath.Join(destination, name)); !os.IsNotExist(err) {
+			t.Error("Test failed, extra entry ", name, " not deleted")
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"testing"
 	"github.com/ftarlao/goblocksync/utils"
 	"reflect"
+	"time"
 )
 
 func TestUnitSliceContains(t *testing.T){
@@ -53,4 +54,72 @@ func TestUnitGenerateRampData(t *testing.T){
 	} else {
 		t.Log("Test ok")
 		}
-}
\ No newline at end of file
+}
+func TestUnitSplitCommandLine(t *testing.T) {
+	t.Log("***SplitCommandLine Test***")
+	success := testSplitCommandLine("ssh", []string{"ssh"}, t)
+	success = success && testSplitCommandLine("  ssh -p 2222  -i key ", []string{"ssh", "-p", "2222", "-i", "key"}, t)
+	success = success && testSplitCommandLine(`ssh -o "ProxyCommand nc %h %p" 'a b'\ c`, []string{"ssh", "-o", "ProxyCommand nc %h %p", "a b c"}, t)
+	success = success && testSplitCommandLine(`ssh ""`, []string{"ssh", ""}, t)
+	if _, err := utils.SplitCommandLine(`ssh "unterminated`); err == nil {
+		t.Error("Test failed, unterminated quote accepted")
+		success = false
+	}
+	if success {
+		t.Log("Test ok")
+	}
+}
+
+func testSplitCommandLine(command string, expected []string, t *testing.T) bool {
+	if args, err := utils.SplitCommandLine(command); err != nil || !reflect.DeepEqual(args, expected) {
+		t.Error("Test failed with command = ", command, " args = ", args, " expected = ", expected)
+		return false
+	}
+	return true
+}
+
+func TestUnitParseSize(t *testing.T) {
+	t.Log("***ParseSize Test***")
+	expected := map[string]int64{"0": 0, "100": 100, "4K": 4 * utils.KB, " 10m ": 10 * utils.MB, "2G": 2 * utils.GB, "1T": utils.TB}
+	for size, bytes := range expected {
+		if result, err := utils.ParseSize(size); err != nil || result != bytes {
+			t.Error("Test failed with size = ", size, " result = ", result, " expected = ", bytes, " ", err)
+		}
+	}
+	for _, size := range []string{"", "K", "-1", "10X", "1.5M", "9999999999T"} {
+		if _, err := utils.ParseSize(size); err == nil {
+			t.Error("Test failed, invalid size ", size, " accepted")
+		}
+	}
+}
+
+func TestUnitFormatBytes(t *testing.T) {
+	t.Log("***FormatBytes and FormatDuration Test***")
+	expected := map[int64]string{0: "0 B", 1023: "1023 B", 1536: "1.5 KiB", 10 * utils.MB: "10.0 MiB", 3 * utils.TB: "3.0 TiB"}
+	for size, formatted := range expected {
+		if result := utils.FormatBytes(size); result != formatted {
+			t.Error("Test failed with size = ", size, " result = ", result, " expected = ", formatted)
+		}
+	}
+	durations := map[time.Duration]string{0: "00:00", 61 * time.Second: "01:01", 3725*time.Second + 400*time.Millisecond: "1:02:05", -time.Second: "00:00"}
+	for d, formatted := range durations {
+		if result := utils.FormatDuration(d); result != formatted {
+			t.Error("Test failed with duration = ", d, " result = ", result, " expected = ", formatted)
+		}
+	}
+}
+
+func TestUnitIsZero(t *testing.T) {
+	t.Log("***IsZero Test***")
+	data := make([]byte, 200*utils.KB)
+	if !utils.IsZero(data) || !utils.IsZero(nil) {
+		t.Error("Test failed, zero data not recognized")
+	}
+	for _, i := range []int{0, 100, 64 * utils.KB, len(data) - 1} {
+		data[i] = 1
+		if utils.IsZero(data) {
+			t.Error("Test failed, non zero byte at ", i, " not found")
+		}
+		data[i] = 0
+	}
+}
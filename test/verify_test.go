@@ -0,0 +1,105 @@
+package test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"github.com/ftarlao/goblocksync/controller"
+	"github.com/ftarlao/goblocksync/controller/routines"
+	"github.com/ftarlao/goblocksync/data/configuration"
+	"github.com/ftarlao/goblocksync/data/messages"
+	"github.com/ftarlao/goblocksync/utils"
+	"github.com/ftarlao/goblocksync/utils/hashing"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnitDigestReader(t *testing.T) {
+	t.Log("***DigestReader Test***\nWhole-file digest of sequential reads, skipped and repeated regions")
+
+	var size int64 = 100*utils.KB + 17
+	data := *utils.GeneratePeriodicData(size, size, 1)
+	expected := sha256.Sum256(data)
+	algorithm, _ := hashing.Get("sha256")
+
+	//the hasher reads from a start location
+	reader := routines.NewDigestReader(bytes.NewReader(data), algorithm)
+	hasher := routines.NewHasherImpl(utils.KB, reader, 30*utils.KB, routines.DummyHash)
+	hasher.Start()
+	for msg := range hasher.GetOutMsgChannel() {
+		if msg.GetMessageID() != messages.HashGroupMessageID {
+			break
+		}
+	}
+	hasher.Stop()
+	readSize, digest := reader.Sum()
+	if readSize != size || !bytes.Equal(digest, expected[:]) {
+		t.Error("wrong digest of the hasher reads, size ", readSize)
+		return
+	}
+
+	//repeated and skipped regions
+	reader = routines.NewDigestReader(bytes.NewReader(data), algorithm)
+	chunk := make([]byte, 10*utils.KB)
+	for _, loc := range []int64{0, 5 * utils.KB, 40 * utils.KB, 45 * utils.KB, 95 * utils.KB} {
+		reader.ReadAt(chunk, loc)
+	}
+	readSize, digest = reader.Sum()
+	if readSize != size || !bytes.Equal(digest, expected[:]) {
+		t.Error("wrong digest of the repeated and skipped reads, size ", readSize)
+		return
+	}
+
+	//a region of the file
+	readSize, digest, err := routines.FileDigest(bytes.NewReader(data), 10, algorithm, nil)
+	expected = sha256.Sum256(data[:10])
+	if err != nil || readSize != 10 || !bytes.Equal(digest, expected[:]) {
+		t.Error("wrong digest of the file region, size ", readSize, " ", err)
+	}
+	readSize, _, err = routines.FileDigest(bytes.NewReader(data), size+1, algorithm, nil)
+	if err != nil || readSize != size {
+		t.Error("wrong size of the digest of a short file ", readSize, " ", err)
+	}
+}
+
+func TestUnitSourceDestinationVerify(t *testing.T) {
+	t.Log("***Verify Test***\nComparison of the file digests without syncing")
+
+	var size int64 = 300*utils.KB + 123
+	sourceData := *utils.GeneratePeriodicData(size, size, 1)
+	changed := append([]byte{}, sourceData...)
+	changed[200*utils.KB] ^= 0xFF
+
+	for _, masterIsSource := range []bool{true, false} {
+		testVerify(t, sourceData, sourceData, masterIsSource, nil)
+		testVerify(t, sourceData, changed, masterIsSource, controller.ErrFilesDiffer)
+		testVerify(t, sourceData, sourceData[:size-1], masterIsSource, controller.ErrFilesDiffer)
+	}
+}
+
+func testVerify(t *testing.T, sourceData []byte, destinationData []byte, masterIsSource bool, expected error) {
+	dir := t.TempDir()
+	sourceName := filepath.Join(dir, "source")
+	destinationName := filepath.Join(dir, "destination")
+	utils.Check(os.WriteFile(sourceName, sourceData, 0644))
+	utils.Check(os.WriteFile(destinationName, destinationData, 0644))
+
+	conf := configuration.Configuration{
+		IsMaster:        masterIsSource,
+		IsSource:        true,
+		SourceFile:      configuration.FileDetails{FileName: sourceName},
+		DestinationFile: configuration.FileDetails{FileName: destinationName},
+		BlockSize:       utils.KB,
+		HashAlgorithm:   "sha256",
+		Verify:          true}
+	err := runSourceDestination(conf)
+	if err != expected {
+		t.Error("expected ", expected, ", got ", err)
+		return
+	}
+	result, err := os.ReadFile(destinationName)
+	utils.Check(err)
+	if !bytes.Equal(result, destinationData) {
+		t.Error("the destination has been modified by the verification")
+	}
+}
@@ -0,0 +1,166 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"github.com/ftarlao/goblocksync/controller"
+	"github.com/ftarlao/goblocksync/controller/routines"
+	"github.com/ftarlao/goblocksync/data/configuration"
+	"github.com/ftarlao/goblocksync/data/messages"
+	"github.com/ftarlao/goblocksync/utils"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnitWireFrame(t *testing.T) {
+	t.Log("***Binary Frame Test***\nDocumented layout, roundtrip of every message type, malformed frames")
+
+	//type, length, payload
+	var frame bytes.Buffer
+	utils.Check(messages.EncodeFrame(&frame, messages.NewDigestMessage("md5", 258, []byte{9, 8})))
+	expected := []byte{messages.DigestMessageID, 0, 0, 0, 21,
+		0, 0, 0, 3, 'm', 'd', '5',
+		0, 0, 0, 0, 0, 0, 1, 2,
+		0, 0, 0, 2, 9, 8}
+	if !bytes.Equal(frame.Bytes(), expected) {
+		t.Error("Test failed, wrong frame layout ", frame.Bytes())
+	}
+
+	hashGroup := messages.NewHashGroupMessage(4096)
+	hashGroup.AddHash([]byte{1, 2, 3})
+	hashGroup.AddHash([]byte{4, 5, 6})
+	hashGroup.TruncHashGroup()
+	hashGroup.Level = 2
+	all := []messages.Message{
+		hashGroup,
+		messages.NewHelloInfo(),
+		messages.NewErrorMessage(errors.New("boom")),
+		&configuration.Configuration{IsMaster: true, BlockSize: utils.KB, Mode: configuration.ModeMerkle,
+			SourceFile:      configuration.FileDetails{FileName: "source", Size: 10, ModTime: 5, Inode: 6},
+			DestinationFile: configuration.FileDetails{FileName: "/dev/sdz", IsDevice: true, LogicalSectorSize: 512},
+			StartLoc:        utils.GB, MerkleFanout: 16, MerkleLevels: 3, HashAlgorithm: "sha256", HashWorkers: 4,
+			Compression: "zstd", BandwidthLimit: utils.MB, BandwidthBurst: utils.KB, SizePolicy: configuration.SizeExtend,
+			Sparse: true, NoChecksums: true, JournalFile: "journal", DryRun: true, ReportFormat: configuration.ReportJSON,
+			Verify: true, Recursive: true, DeleteExtras: true, SessionID: "0123456789abcdef", Verbose: true,
+			LogFormat: configuration.LogJSON},
+		messages.NewEndMessage(),
+		&messages.DataBlockMessage{StartLoc: 8192, Data: []byte{1, 2, 3}, Compressed: true},
+		messages.NewHashRequestMessage(1<<40, 3),
+		&messages.DeltaMessage{StartLoc: 1, CopyLoc: -1, Length: 3, Data: []byte{7, 7, 7}},
+		messages.NewCheckpointMessage(utils.GB),
+		messages.NewExtentMessage(100, 200),
+		messages.NewBandwidthMessage(utils.MB, 16*utils.KB),
+		messages.NewDigestMessage("sha256", 12, []byte{1}),
+		messages.NewZeroBlockMessage(300, 400),
+		messages.NewFileDetailsMessage(configuration.FileDetails{FileName: "/dev/sdz", Size: utils.GB, IsDevice: true,
+			LogicalSectorSize: 512, PhysicalSectorSize: 4096, ModTime: 1700000000123456789, Inode: 1 << 63})}
+	var stream bytes.Buffer
+	for _, m := range all {
+		utils.Check(messages.EncodeFrame(&stream, m))
+	}
+	for _, m := range all {
+		decoded, err := messages.DecodeFrame(&stream, configuration.MaxFrameSize)
+		if err != nil {
+			t.Error("Test failed, message type ", m.GetMessageID(), " error ", err)
+			continue
+		}
+		checkMsgEquality(m, decoded, t)
+	}
+	if _, err := messages.DecodeFrame(&stream, configuration.MaxFrameSize); err != io.EOF {
+		t.Error("Test failed, expected EOF at the end of the stream, got ", err)
+	}
+
+	malformed := map[string][]byte{
+		"too large":      {messages.DataBlockMessageID, 0xff, 0xff, 0xff, 0xff},
+		"truncated":      {messages.CheckpointMessageID, 0, 0, 0, 8, 1, 2},
+		"short payload":  {messages.CheckpointMessageID, 0, 0, 0, 2, 1, 2},
+		"trailing bytes": {messages.EndMessageID, 0, 0, 0, 1, 0},
+		"huge list":      {messages.ErrorMessageID, 0, 0, 0, 4, 0xff, 0xff, 0xff, 0xff},
+		"unknown type":   {200, 0, 0, 0, 0},
+		"config layout":  {configuration.ConfigurationMessageID, 0, 0, 0, 1, messages.ConfigurationLayout + 1}}
+	for name, data := range malformed {
+		if _, err := messages.DecodeFrame(bytes.NewReader(data), configuration.MaxFrameSize); err == nil {
+			t.Error("Test failed, ", name, " frame accepted")
+		}
+	}
+}
+
+func TestUnitProtocolNegotiation(t *testing.T) {
+	t.Log("***Protocol Negotiation Test***\nA slave syncs with gob (v1 only) and binary (v2) masters")
+
+	for _, protocols := range [][]int{{configuration.ProtocolGob}, {configuration.ProtocolGob, configuration.ProtocolBinary}} {
+		dir := t.TempDir()
+		sourceName := filepath.Join(dir, "source")
+		destinationName := filepath.Join(dir, "destination")
+		sourceData := *utils.GeneratePeriodicData(60*utils.KB, 60*utils.KB, 7)
+		utils.Check(os.WriteFile(sourceName, sourceData, 0644))
+
+		masterIn, slaveOut := io.Pipe()
+		slaveIn, masterOut := io.Pipe()
+		slaveErr := make(chan error, 1)
+		go func() {
+			slaveErr <- controller.NewStreamSlave(slaveIn, slaveOut).Start()
+		}()
+
+		//a master speaking only the listed protocol versions
+		netManager := routines.NewNetworkManager(configuration.DefaultNetworkChannelSize, masterIn, masterOut)
+		netManager.SetSupportedProtocols(protocols)
+		netManager.Start()
+		hello := messages.NewHelloInfo()
+		hello.SupportedProtocols = protocols
+		hello.SupportedHashes = []string{"sha256"}
+		hello.SupportedCompressions = []string{"none"}
+		utils.Check(netManager.Send(hello))
+		msg := <-netManager.GetInMsgChannel()
+		if msg.GetMessageID() != messages.HelloInfoMessageID {
+			t.Error("Test failed, expected the slave hello, got message type ", msg.GetMessageID())
+			return
+		}
+		slaveHello := msg.(*messages.HelloInfoMessage)
+		protocol, err := routines.BestProtocol(protocols, slaveHello.SupportedProtocols)
+		utils.Check(err)
+		if protocol != protocols[len(protocols)-1] {
+			t.Error("Test failed, negotiated protocol ", protocol)
+		}
+		if !slaveHello.Checksums {
+			t.Error("Test failed, the slave does not advertise the CRC32C trailers")
+		}
+		utils.Check(netManager.SwitchProtocol(protocol, hello.Checksums && slaveHello.Checksums))
+
+		conf := configuration.Configuration{
+			IsMaster:        true,
+			IsSource:        true,
+			SourceFile:      configuration.FileDetails{FileName: sourceName},
+			DestinationFile: configuration.FileDetails{FileName: destinationName},
+			BlockSize:       utils.KB,
+			HashAlgorithm:   "sha256",
+			Compression:     "none"}
+		//the slave bounds the received regions with the file details, as sent by the master
+		_, err = conf.LocalFile().Update()
+		utils.Check(err)
+		remoteConf := conf.Complement()
+		utils.Check(netManager.Send(&remoteConf))
+		msg = <-netManager.GetInMsgChannel()
+		if msg.GetMessageID() != messages.FileDetailsMessageID {
+			t.Error("Test failed, expected the slave file details, got message type ", msg.GetMessageID())
+			return
+		}
+
+		source, err := controller.NewSource(conf, protocol, netManager)
+		utils.Check(err)
+		err = source.Start()
+		netManager.Stop()
+		if err != nil {
+			t.Error(err)
+		}
+		if err = <-slaveErr; err != nil {
+			t.Error(err)
+		}
+		result, _ := os.ReadFile(destinationName)
+		if !bytes.Equal(result, sourceData) {
+			t.Error("Test failed, destination not synched with protocol ", protocol)
+		}
+	}
+}
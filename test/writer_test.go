@@ -0,0 +1,146 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"github.com/ftarlao/goblocksync/controller/routines"
+	"github.com/ftarlao/goblocksync/data/messages"
+	"github.com/ftarlao/goblocksync/utils"
+	"testing"
+	"time"
+)
+
+// In memory WriterAtSyncer, counts the performed writes
+type memoryWriterAt struct {
+	data      []byte
+	numWrites int
+	failAt    int64
+}
+
+func (m *memoryWriterAt) WriteAt(b []byte, off int64) (int, error) {
+	if m.failAt >= 0 && off <= m.failAt && m.failAt < off+int64(len(b)) {
+		return 0, errors.New("boom")
+	}
+	m.numWrites++
+	if end := off + int64(len(b)); end > int64(len(m.data)) {
+		m.data = append(m.data, make([]byte, end-int64(len(m.data)))...)
+	}
+	copy(m.data[off:], b)
+	return len(b), nil
+}
+
+func (m *memoryWriterAt) Sync() error {
+	return nil
+}
+
+func TestUnitWriterImpl(t *testing.T) {
+	t.Log("***Writer Test***\nPositioned writes, coalescing of adjacent blocks")
+
+	var blockSize int64 = 100
+	data := *utils.GenerateRampData(20*blockSize, 7)
+	fakeFile := &memoryWriterAt{failAt: -1}
+
+	writer := routines.NewWriterImpl(fakeFile, 64, 8*blockSize)
+	in := writer.GetInMsgChannel()
+	//blocks are queued before the start, adjacent blocks are coalesced
+	for i := int64(19); i >= 10; i-- {
+		in <- messages.NewDataBlockMessage(i*blockSize, data[i*blockSize:(i+1)*blockSize])
+	}
+	for i := int64(0); i < 10; i++ {
+		in <- messages.NewDataBlockMessage(i*blockSize, data[i*blockSize:(i+1)*blockSize])
+	}
+	in <- messages.NewEndMessage()
+	writer.Start()
+
+	select {
+	case msg := <-writer.GetOutMsgChannel():
+		if msg.GetMessageID() != messages.EndMessageID {
+			t.Error("expected EndMessage from writer, got message type ", msg.GetMessageID())
+			return
+		}
+	case <-time.After(TestTimeout):
+		t.Error("Timeout for Writer, no EndMessage")
+		return
+	}
+	if !bytes.Equal(fakeFile.data, data) {
+		t.Error("written data differs from the provided blocks")
+	}
+	if writer.GetWrittenBytes() != int64(len(data)) {
+		t.Error("wrong number of written bytes: ", writer.GetWrittenBytes())
+	}
+	//10 reversed blocks are written one by one, the 10 adjacent blocks need two writes (max 8 blocks per write)
+	t.Log("Number of writes: ", fakeFile.numWrites)
+	if fakeFile.numWrites != 12 {
+		t.Error("adjacent blocks have not been coalesced as expected")
+	}
+	err := writer.Stop()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUnitWriterImplError(t *testing.T) {
+	t.Log("***Writer Test***\nWrite errors are reported as ErrorMessage")
+
+	fakeFile := &memoryWriterAt{failAt: 250}
+	writer := routines.NewWriterImpl(fakeFile, 64, 1000)
+	writer.Start()
+	in := writer.GetInMsgChannel()
+	for i := int64(0); i < 5; i++ {
+		in <- messages.NewDataBlockMessage(i*100, make([]byte, 100))
+	}
+	in <- messages.NewEndMessage()
+
+	select {
+	case msg := <-writer.GetOutMsgChannel():
+		if msg.GetMessageID() != messages.ErrorMessageID {
+			t.Error("expected ErrorMessage from writer, got message type ", msg.GetMessageID())
+		}
+	case <-time.After(TestTimeout):
+		t.Error("Timeout for Writer, no ErrorMessage")
+	}
+	writer.Stop()
+}
+
+func TestUnitWriterImplCheckpoint(t *testing.T) {
+	t.Log("***Writer Test***\nCheckpoints are provided back once the previous blocks are written")
+
+	fakeFile := &memoryWriterAt{failAt: -1}
+	writer := routines.NewWriterImpl(fakeFile, 64, 1000)
+	writer.Start()
+	defer writer.Stop()
+	in := writer.GetInMsgChannel()
+	for i := int64(0); i < 5; i++ {
+		in <- messages.NewDataBlockMessage(i*100, make([]byte, 100))
+	}
+	in <- messages.NewCheckpointMessage(500)
+
+	select {
+	case msg := <-writer.GetOutMsgChannel():
+		if msg.GetMessageID() != messages.CheckpointMessageID || msg.(*messages.CheckpointMessage).Loc != 500 {
+			t.Error("expected the CheckpointMessage from writer, got message type ", msg.GetMessageID())
+			return
+		}
+	case <-time.After(TestTimeout):
+		t.Error("Timeout for Writer, no CheckpointMessage")
+		return
+	}
+	if writer.GetWrittenBytes() != 500 {
+		t.Error("blocks before the checkpoint not written, ", writer.GetWrittenBytes(), " bytes")
+		return
+	}
+	//the writer goes on after a checkpoint
+	in <- messages.NewDataBlockMessage(500, make([]byte, 100))
+	in <- messages.NewEndMessage()
+	select {
+	case msg := <-writer.GetOutMsgChannel():
+		if msg.GetMessageID() != messages.EndMessageID {
+			t.Error("expected EndMessage from writer, got message type ", msg.GetMessageID())
+			return
+		}
+	case <-time.After(TestTimeout):
+		t.Error("Timeout for Writer, no EndMessage")
+		return
+	}
+	t.Log("Test OK")
+}
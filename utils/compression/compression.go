@@ -0,0 +1,202 @@
+package compression
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/lzw"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Named compression algorithm for the data blocks. Preference ranks the algorithms, the preferred common algorithm is
+// chosen during the handshake. The "none" algorithm disables the compression
+type Algorithm struct {
+	Name       string
+	Preference int
+	// Compressor writing to w, nil for "none"
+	NewWriter func(w io.Writer) io.WriteCloser
+	// Reuses a compressor for a new destination
+	ResetWriter func(c io.WriteCloser, w io.Writer)
+	// Decompressor reading from r
+	NewReader func(r io.Reader) (io.ReadCloser, error)
+	// Reuses a decompressor for a new source
+	ResetReader func(d io.ReadCloser, r io.Reader) error
+	writers     *sync.Pool
+	readers     *sync.Pool
+}
+
+// Name of the algorithm that disables the compression
+const None = "none"
+
+// True when the algorithm actually compresses
+func (a Algorithm) Enabled() bool {
+	return a.NewWriter != nil
+}
+
+// Compressed data, the result is not shorter than data when data does not compress
+func (a Algorithm) Compress(data []byte) ([]byte, error) {
+	if !a.Enabled() {
+		return data, nil
+	}
+	var b bytes.Buffer
+	var c io.WriteCloser
+	if pooled := a.writers.Get(); pooled != nil {
+		c = pooled.(io.WriteCloser)
+		a.ResetWriter(c, &b)
+	} else {
+		c = a.NewWriter(&b)
+	}
+	_, err := c.Write(data)
+	if closeErr := c.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	a.writers.Put(c)
+	return b.Bytes(), nil
+}
+
+// Decompressed data, at most maxSize bytes are accepted
+func (a Algorithm) Decompress(data []byte, maxSize int64) ([]byte, error) {
+	if !a.Enabled() {
+		return data, nil
+	}
+	var d io.ReadCloser
+	var err error
+	if pooled := a.readers.Get(); pooled != nil {
+		d = pooled.(io.ReadCloser)
+		err = a.ResetReader(d, bytes.NewReader(data))
+	} else {
+		d, err = a.NewReader(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, err
+	}
+	result, err := io.ReadAll(io.LimitReader(d, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(result)) > maxSize {
+		return nil, fmt.Errorf("decompressed block larger than %d bytes", maxSize)
+	}
+	a.readers.Put(d)
+	return result, nil
+}
+
+var registry = map[string]Algorithm{}
+
+func init() {
+	Register(Algorithm{Name: None})
+	Register(Algorithm{
+		Name:       "lzw",
+		Preference: 10,
+		NewWriter: func(w io.Writer) io.WriteCloser {
+			return lzw.NewWriter(w, lzw.LSB, 8)
+		},
+		ResetWriter: func(c io.WriteCloser, w io.Writer) {
+			c.(*lzw.Writer).Reset(w, lzw.LSB, 8)
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return lzw.NewReader(r, lzw.LSB, 8), nil
+		},
+		ResetReader: func(d io.ReadCloser, r io.Reader) error {
+			d.(*lzw.Reader).Reset(r, lzw.LSB, 8)
+			return nil
+		}})
+	Register(Algorithm{
+		Name:       "gzip",
+		Preference: 20,
+		NewWriter: func(w io.Writer) io.WriteCloser {
+			return gzip.NewWriter(w)
+		},
+		ResetWriter: func(c io.WriteCloser, w io.Writer) {
+			c.(*gzip.Writer).Reset(w)
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+		ResetReader: func(d io.ReadCloser, r io.Reader) error {
+			return d.(*gzip.Reader).Reset(r)
+		}})
+	Register(Algorithm{
+		Name:       "flate",
+		Preference: 30,
+		NewWriter: func(w io.Writer) io.WriteCloser {
+			//the error is only for invalid levels
+			c, _ := flate.NewWriter(w, flate.DefaultCompression)
+			return c
+		},
+		ResetWriter: func(c io.WriteCloser, w io.Writer) {
+			c.(*flate.Writer).Reset(w)
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return flate.NewReader(r), nil
+		},
+		ResetReader: func(d io.ReadCloser, r io.Reader) error {
+			return d.(flate.Resetter).Reset(r, nil)
+		}})
+}
+
+// Adds (or replaces) an algorithm in the registry
+func Register(a Algorithm) {
+	a.writers = &sync.Pool{}
+	a.readers = &sync.Pool{}
+	registry[a.Name] = a
+}
+
+// Returns the algorithm with the given name, false when unknown
+func Get(name string) (Algorithm, bool) {
+	a, ok := registry[name]
+	return a, ok
+}
+
+// Names of the registered algorithms, from the preferred to the least preferred
+func Names() []string {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := registry[names[i]], registry[names[j]]
+		if a.Preference != b.Preference {
+			return a.Preference > b.Preference
+		}
+		return a.Name < b.Name
+	})
+	return names
+}
+
+// Chooses the preferred algorithm known by both the peers, the result does not depend on the order of the lists so
+// the two peers always agree
+func SelectBest(local []string, remote []string) (Algorithm, error) {
+	var best Algorithm
+	found := false
+	for _, name := range local {
+		a, ok := registry[name]
+		if !ok || !contains(remote, name) {
+			continue
+		}
+		if !found || a.Preference > best.Preference || (a.Preference == best.Preference && a.Name < best.Name) {
+			best = a
+			found = true
+		}
+	}
+	if !found {
+		return best, errors.New("master and slave have no compression algorithm in common")
+	}
+	return best, nil
+}
+
+func contains(arr []string, el string) bool {
+	for _, a := range arr {
+		if a == el {
+			return true
+		}
+	}
+	return false
+}
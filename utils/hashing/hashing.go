@@ -0,0 +1,106 @@
+package hashing
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
+	"hash/fnv"
+	"sort"
+)
+
+// Named hash algorithm, Size is the declared output size [bytes]. Strength ranks the algorithms, the strongest common
+// algorithm is chosen during the handshake
+type HashAlgorithm struct {
+	Name     string
+	Size     int
+	Strength int
+	New      func() hash.Hash
+}
+
+// Hash of data
+func (a HashAlgorithm) Sum(data []byte) []byte {
+	h := a.New()
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+var registry = map[string]HashAlgorithm{}
+
+func init() {
+	Register(HashAlgorithm{"crc32c", crc32.Size, 10, func() hash.Hash { return crc32.New(crc32cTable) }})
+	Register(HashAlgorithm{"crc64", crc64.Size, 20, func() hash.Hash { return crc64.New(crc64Table) }})
+	Register(HashAlgorithm{"fnv1a", 16, 30, fnv.New128a})
+	Register(HashAlgorithm{"md5", md5.Size, 40, md5.New})
+	Register(HashAlgorithm{"sha1", sha1.Size, 50, sha1.New})
+	Register(HashAlgorithm{"sha256", sha256.Size, 60, sha256.New})
+	Register(HashAlgorithm{"sha512_256", sha512.Size256, 70, sha512.New512_256})
+}
+
+// Adds (or replaces) an algorithm in the registry
+func Register(a HashAlgorithm) {
+	registry[a.Name] = a
+}
+
+// Returns the algorithm with the given name, false when unknown
+func Get(name string) (HashAlgorithm, bool) {
+	a, ok := registry[name]
+	return a, ok
+}
+
+// Names of the registered algorithms, from the strongest to the weakest
+func Names() []string {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sortByStrength(names)
+	return names
+}
+
+// Chooses the strongest algorithm known by both the peers, the result does not depend on the order of the lists so
+// the two peers always agree
+func SelectBest(local []string, remote []string) (HashAlgorithm, error) {
+	var best HashAlgorithm
+	found := false
+	for _, name := range local {
+		a, ok := registry[name]
+		if !ok || !contains(remote, name) {
+			continue
+		}
+		if !found || a.Strength > best.Strength || (a.Strength == best.Strength && a.Name < best.Name) {
+			best = a
+			found = true
+		}
+	}
+	if !found {
+		return best, errors.New("master and slave have no hash algorithm in common")
+	}
+	return best, nil
+}
+
+func sortByStrength(names []string) {
+	sort.Slice(names, func(i, j int) bool {
+		a, b := registry[names[i]], registry[names[j]]
+		if a.Strength != b.Strength {
+			return a.Strength > b.Strength
+		}
+		return a.Name < b.Name
+	})
+}
+
+func contains(arr []string, el string) bool {
+	for _, a := range arr {
+		if a == el {
+			return true
+		}
+	}
+	return false
+}
@@ -1,12 +1,18 @@
 package utils
 
 import (
+	"encoding/json"
+	"errors"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"bytes"
+	"strconv"
+	"strings"
+	"time"
+	"fmt"
 )
 
 // This helper will streamline the error
@@ -60,6 +66,155 @@ func IntMax(a int64, b int64) int64 {
 	}
 }
 
+func IntMin(a int64, b int64) int64 {
+	if a < b {
+		return a
+	} else {
+		return b
+	}
+}
+
+//String utils
+
+// Splits a command line in arguments, on whitespaces. Single and double quotes group words, backslash escapes the next
+// character (outside single quotes). This is a small subset of the shell syntax, enough for templates like "ssh -p 22"
+func SplitCommandLine(command string) (args []string, err error) {
+	var current []rune
+	inArg := false
+	var quote rune
+	escaped := false
+	for _, c := range command {
+		switch {
+		case escaped:
+			current = append(current, c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped = true
+			inArg = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				current = append(current, c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inArg = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args = append(args, string(current))
+				current = current[:0]
+				inArg = false
+			}
+		default:
+			current = append(current, c)
+			inArg = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, errors.New("unterminated quote or escape in command: " + command)
+	}
+	if inArg {
+		args = append(args, string(current))
+	}
+	return args, nil
+}
+
+// Parses a size in bytes with an optional K, M, G or T suffix (powers of 1024), e.g. "512K"
+func ParseSize(size string) (int64, error) {
+	digits := strings.TrimSpace(size)
+	multiplier := int64(1)
+	if digits != "" {
+		switch strings.ToUpper(digits[len(digits)-1:]) {
+		case "K":
+			multiplier = KB
+		case "M":
+			multiplier = MB
+		case "G":
+			multiplier = GB
+		case "T":
+			multiplier = TB
+		}
+		if multiplier > 1 {
+			digits = digits[:len(digits)-1]
+		}
+	}
+	value, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || value < 0 {
+		return 0, errors.New("invalid size " + size)
+	}
+	if value > (1<<63-1)/multiplier {
+		return 0, errors.New("size too large " + size)
+	}
+	return value * multiplier, nil
+}
+
+// Size [bytes] of the JSON documents, a number or a string with an optional K, M, G or T suffix (see ParseSize)
+type Size int64
+
+func (s *Size) UnmarshalJSON(data []byte) error {
+	var text string
+	if len(data) > 0 && data[0] == '"' {
+		err := json.Unmarshal(data, &text)
+		if err != nil {
+			return err
+		}
+	} else {
+		text = string(data)
+	}
+	size, err := ParseSize(text)
+	if err != nil {
+		return err
+	}
+	*s = Size(size)
+	return nil
+}
+
+// Size with a binary unit, e.g. "1.5 MiB"
+func FormatBytes(size int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return strconv.FormatInt(size, 10) + " B"
+	}
+	return strconv.FormatFloat(value, 'f', 1, 64) + " " + units[unit]
+}
+
+// Duration as [h:]mm:ss, rounded to the second
+func FormatDuration(d time.Duration) string {
+	seconds := int64(d.Round(time.Second) / time.Second)
+	if seconds < 0 {
+		seconds = 0
+	}
+	h, m, s := seconds/3600, seconds/60%60, seconds%60
+	if h > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", h, m, s)
+	}
+	return fmt.Sprintf("%02d:%02d", m, s)
+}
+
+// True when all the bytes of data are zero
+func IsZero(data []byte) bool {
+	for len(data) > 0 {
+		n := len(zeroBlock)
+		if len(data) < n {
+			n = len(data)
+		}
+		if !bytes.Equal(data[:n], zeroBlock[:n]) {
+			return false
+		}
+		data = data[n:]
+	}
+	return true
+}
+
+var zeroBlock = make([]byte, 64*KB)
+
 //File utils
 
 func IsEOF(err error) bool {